@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// certWatcher serves the key pair loaded from CertFile and KeyFile, and reloads it when the files change.
+//
+// Kubernetes updates mounted Secrets by swapping the "..data" symlink in the mount directory,
+// so the directories containing the files are watched instead of the files themselves.
+// When reloading fails (e.g. files are read in the middle of an update), the last good key pair keeps being served.
+type certWatcher struct {
+	CertFile string
+	KeyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	notAfter time.Time
+}
+
+func newCertWatcher(certFile, keyFile string) (*certWatcher, error) {
+	w := &certWatcher{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	err := w.reload()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (w *certWatcher) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.cert, nil
+}
+
+// NotAfter returns the expiry of the currently served certificate.
+func (w *certWatcher) NotAfter() time.Time {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.notAfter
+}
+
+// Watch reloads the key pair on every change of the files until ctx is done.
+func (w *certWatcher) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	defer func() { _ = watcher.Close() }()
+
+	for _, dir := range uniqueDirs(w.CertFile, w.KeyFile) {
+		err = watcher.Add(dir)
+		if err != nil {
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// CHMOD only events does not change contents
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			err = w.reload()
+			if err != nil {
+				logger.Error(err, "failed to reload certificate; keep serving the last loaded one", "notAfter", w.NotAfter().Format(time.RFC3339))
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Error(err, "error while watching certificate files")
+		}
+	}
+}
+
+func (w *certWatcher) reload() error {
+	cert, err := tls.LoadX509KeyPair(w.CertFile, w.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair from %s and %s: %w", w.CertFile, w.KeyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate %s: %w", w.CertFile, err)
+	}
+	cert.Leaf = leaf
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cert != nil && w.cert.Leaf.Equal(leaf) {
+		return nil
+	}
+	w.cert = &cert
+	w.notAfter = leaf.NotAfter
+	logger.Info("certificate loaded", "subject", leaf.Subject.String(), "serial", leaf.SerialNumber.String(), "notAfter", leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func uniqueDirs(files ...string) []string {
+	dirs := make([]string, 0, len(files))
+	seen := make(map[string]bool, len(files))
+	for _, f := range files {
+		dir := filepath.Dir(f)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
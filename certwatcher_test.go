@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func TestCertWatcherReload(t *testing.T) {
+	defer func(l logr.Logger) { logger = l }(logger)
+	logs := &lockedBuffer{}
+	logger = newLogger(logs, logFormatJSON, 0)
+
+	mountDir := t.TempDir()
+	firstNotAfter := time.Now().Add(1 * time.Hour).Truncate(time.Second)
+	err := writeSecretMount(mountDir, "first", firstNotAfter)
+	if err != nil {
+		t.Fatal("failed to prepare certificate", err)
+	}
+
+	watcher, err := newCertWatcher(filepath.Join(mountDir, "tls.crt"), filepath.Join(mountDir, "tls.key"))
+	if err != nil {
+		t.Fatal("failed to load certificate", err)
+	}
+	if !watcher.NotAfter().Equal(firstNotAfter) {
+		t.Errorf("unexpected expiry: expected: %s, actual: %s", firstNotAfter, watcher.NotAfter())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = watcher.Watch(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// wait for watcher to start watching
+	time.Sleep(100 * time.Millisecond)
+
+	// swap "..data" like kubelet does on Secret update
+	secondNotAfter := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	err = writeSecretMount(mountDir, "second", secondNotAfter)
+	if err != nil {
+		t.Fatal("failed to update certificate", err)
+	}
+	if !waitFor(func() bool { return watcher.NotAfter().Equal(secondNotAfter) }) {
+		t.Errorf("certificate not reloaded: expected expiry: %s, actual: %s", secondNotAfter, watcher.NotAfter())
+	}
+
+	// broken update must not replace the last good key pair
+	err = swapSecretVersion(mountDir, "broken", []byte("broken"), []byte("broken"))
+	if err != nil {
+		t.Fatal("failed to break certificate", err)
+	}
+	if !waitFor(func() bool { return strings.Contains(logs.String(), "failed to reload certificate") }) {
+		t.Fatal("broken certificate not reloaded", logs.String())
+	}
+	cert, err := watcher.GetCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatal("certificate should be served after broken update", err)
+	}
+	if !cert.Leaf.NotAfter.Equal(secondNotAfter) {
+		t.Errorf("unexpected certificate served: expected expiry: %s, actual: %s", secondNotAfter, cert.Leaf.NotAfter)
+	}
+}
+
+func TestNewCertWatcherMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	_, err := newCertWatcher(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	if err == nil {
+		t.Error("error should be returned for missing files")
+	}
+}
+
+//
+// utilities
+//
+
+// writeSecretMount writes a self-signed key pair into mountDir with the layout kubelet uses for Secret volumes:
+// files are stored in a "..<version>" directory, and "..data" symlink points to it.
+func writeSecretMount(mountDir, version string, notAfter time.Time) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: version},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return swapSecretVersion(mountDir, version,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// swapSecretVersion writes certPEM and keyPEM into "..<version>" directory of mountDir,
+// and atomically points "..data" symlink to it like kubelet does on Secret update.
+func swapSecretVersion(mountDir, version string, certPEM, keyPEM []byte) error {
+	versionDir := filepath.Join(mountDir, ".."+version)
+	err := os.Mkdir(versionDir, 0700)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(versionDir, "tls.crt"), certPEM, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(versionDir, "tls.key"), keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+
+	tmpLink := filepath.Join(mountDir, "..data_tmp")
+	err = os.Symlink(".."+version, tmpLink)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpLink, filepath.Join(mountDir, "..data"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{"tls.crt", "tls.key"} {
+		link := filepath.Join(mountDir, name)
+		_, err = os.Lstat(link)
+		if err == nil {
+			continue
+		}
+		err = os.Symlink(filepath.Join("..data", name), link)
+		if err != nil {
+			return fmt.Errorf("failed to link %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// lockedBuffer is a bytes.Buffer safe to be written by the watcher while read by tests.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 50; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
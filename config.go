@@ -0,0 +1,302 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+const (
+	envPrefix        = "KEP3633ALT_"
+	flagNameConfig   = "config"
+	defaultTLSAddr   = ":8443"
+	defaultPlainAddr = ":8080"
+)
+
+// Config is the configuration of the webhook server.
+//
+// Each field is filled from the following sources; later ones take precedence:
+//
+//  1. default values
+//  2. YAML file specified by -config flag or KEP3633ALT_CONFIG environment variable
+//  3. KEP3633ALT_* environment variables (flag name upper-cased, "-" replaced by "_")
+//  4. command line flags
+type Config struct {
+	DisableTLS          bool            `json:"disableTLS,omitempty"`
+	ListenAddress       string          `json:"listenAddress,omitempty"`
+	MetricsAddress      string          `json:"metricsAddress,omitempty"`
+	CertFile            string          `json:"certFile,omitempty"`
+	KeyFile             string          `json:"keyFile,omitempty"`
+	ReadTimeout         metav1.Duration `json:"readTimeout,omitempty"`
+	WriteTimeout        metav1.Duration `json:"writeTimeout,omitempty"`
+	AnnotationPrefix    string          `json:"annotationPrefix,omitempty"`
+	UserErrorPolicy     string          `json:"userErrorPolicy,omitempty"`
+	DuplicateTermPolicy string          `json:"duplicateTermPolicy,omitempty"`
+	PreStopDelay        metav1.Duration `json:"preStopDelay,omitempty"`
+	ShutdownTimeout     metav1.Duration `json:"shutdownTimeout,omitempty"`
+	LogLevel            string          `json:"logLevel,omitempty"`
+	LogFormat           string          `json:"logFormat,omitempty"`
+	FeatureGates        featureGates    `json:"featureGates,omitempty"`
+	EnableEvents        bool            `json:"enableEvents,omitempty"`
+}
+
+// featureGates enables or disables mutators by name; mutators not listed are enabled.
+// As a flag value, it is a comma separated list of name=bool pairs, e.g. "TopologySpreadConstraints=false".
+type featureGates map[string]bool
+
+// Enabled reports whether the feature gate name is enabled.
+func (g featureGates) Enabled(name string) bool {
+	enabled, set := g[name]
+	return !set || enabled
+}
+
+func (g featureGates) String() string {
+	pairs := make([]string, 0, len(g))
+	for _, name := range sortedFeatureGateNames(g) {
+		pairs = append(pairs, fmt.Sprintf("%s=%t", name, g[name]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (g featureGates) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, enabled, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("missing bool value for %s", pair)
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(enabled))
+		if err != nil {
+			return fmt.Errorf("invalid value of %s: %w", name, err)
+		}
+		g[strings.TrimSpace(name)] = b
+	}
+	return nil
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		DisableTLS:          false,
+		ListenAddress:       "",
+		MetricsAddress:      ":8081",
+		CertFile:            "/certs/tls.crt",
+		KeyFile:             "/certs/tls.key",
+		ReadTimeout:         metav1.Duration{Duration: 30 * time.Second},
+		WriteTimeout:        metav1.Duration{Duration: 30 * time.Second},
+		AnnotationPrefix:    kep3633.DefaultAnnotationPrefix,
+		UserErrorPolicy:     userErrorPolicyDeny,
+		DuplicateTermPolicy: duplicateTermPolicySkip,
+		PreStopDelay:        metav1.Duration{Duration: 5 * time.Second},
+		ShutdownTimeout:     metav1.Duration{Duration: 20 * time.Second},
+		LogLevel:            "info",
+		LogFormat:           logFormatJSON,
+		FeatureGates:        featureGates{},
+		EnableEvents:        false,
+	}
+}
+
+// loadConfig builds Config from command line args, environment variables looked up by getenv and the config file.
+func loadConfig(name string, args []string, getenv func(string) string) (*Config, error) {
+	// find config file path before anything else, since flags and environment variables override it
+	var configFile string
+	preFlags := newConfigFlagSet(name, defaultConfig(), &configFile)
+	preFlags.SetOutput(io.Discard)
+	preFlags.Usage = func() {}
+	err := preFlags.Parse(args)
+	if err == flag.ErrHelp {
+		newConfigFlagSet(name, defaultConfig(), &configFile).Usage()
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if configFile == "" {
+		configFile = getenv(envName(flagNameConfig))
+	}
+
+	config := defaultConfig()
+	if configFile != "" {
+		err = config.loadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	flags := newConfigFlagSet(name, config, &configFile)
+	var envErr error
+	flags.VisitAll(func(f *flag.Flag) {
+		if envErr != nil || f.Name == flagNameConfig {
+			return
+		}
+		v := getenv(envName(f.Name))
+		if v == "" {
+			return
+		}
+		err := flags.Set(f.Name, v)
+		if err != nil {
+			envErr = fmt.Errorf("invalid value %q for environment variable %s: %w", v, envName(f.Name), err)
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+	err = flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func newConfigFlagSet(name string, config *Config, configFile *string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(configFile, flagNameConfig, *configFile, "Path to optional YAML config file; flags and "+envPrefix+"* environment variables override its values")
+	flags.BoolVar(&config.DisableTLS, "disable-tls", config.DisableTLS, "Serve plain HTTP instead of HTTPS (for local testing only; the API server requires HTTPS)")
+	flags.StringVar(&config.ListenAddress, "listen-address", config.ListenAddress, "Listen address of the webhook server (default \""+defaultTLSAddr+"\", or \""+defaultPlainAddr+"\" with -disable-tls)")
+	flags.StringVar(&config.MetricsAddress, "metrics-address", config.MetricsAddress, "Listen address of plain HTTP server for /metrics; if empty, /metrics is served by the webhook server")
+	flags.StringVar(&config.CertFile, "cert-file", config.CertFile, "Path to PEM encoded TLS certificate")
+	flags.StringVar(&config.KeyFile, "key-file", config.KeyFile, "Path to PEM encoded TLS private key")
+	flags.DurationVar(&config.ReadTimeout.Duration, "read-timeout", config.ReadTimeout.Duration, "Maximum duration for reading an entire request")
+	flags.DurationVar(&config.WriteTimeout.Duration, "write-timeout", config.WriteTimeout.Duration, "Maximum duration before timing out writes of a response")
+	flags.StringVar(&config.AnnotationPrefix, "annotation-prefix", config.AnnotationPrefix, "Prefix of pod annotations handled by this webhook")
+	flags.StringVar(&config.UserErrorPolicy, "user-error-policy", config.UserErrorPolicy, "How to respond when pod annotations cannot be applied: \""+userErrorPolicyDeny+"\" rejects the pod, \""+userErrorPolicyWarn+"\" admits it unchanged with warnings")
+	flags.StringVar(&config.DuplicateTermPolicy, "duplicate-term-policy", config.DuplicateTermPolicy, "How to handle terms equal to ones already in pod spec: \""+duplicateTermPolicySkip+"\" skips them, \""+duplicateTermPolicyMerge+"\" merges weight, maxSkew and whenUnsatisfiable into the existing ones")
+	flags.DurationVar(&config.PreStopDelay.Duration, "pre-stop-delay", config.PreStopDelay.Duration, "Duration to keep serving after readiness fails on SIGTERM/SIGINT, so that endpoints are updated before the listener closes")
+	flags.DurationVar(&config.ShutdownTimeout.Duration, "shutdown-timeout", config.ShutdownTimeout.Duration, "Deadline for in-flight requests to finish after the listener closes")
+	flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "Log level; one of "+logLevelNames())
+	if config.FeatureGates == nil {
+		config.FeatureGates = featureGates{}
+	}
+	flags.Var(config.FeatureGates, "feature-gates", "Comma separated list of name=bool pairs enabling or disabling mutators; known names are "+strings.Join(kep3633.MutatorNames(), ", "))
+	flags.BoolVar(&config.EnableEvents, "enable-events", config.EnableEvents, "Publish Kubernetes Events on owners of pods (or pods) describing injected terms and failed annotations; requires in-cluster credentials")
+	flags.StringVar(&config.LogFormat, "log-format", config.LogFormat, "Log format; \""+logFormatJSON+"\" or \""+logFormatText+"\"")
+	return flags
+}
+
+func (c *Config) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	err = yaml.UnmarshalStrict(content, c)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	errs := make([]string, 0)
+
+	if c.ListenAddress != "" {
+		_, _, err := net.SplitHostPort(c.ListenAddress)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("listenAddress %q is invalid: %v", c.ListenAddress, err))
+		}
+	}
+	if c.MetricsAddress != "" {
+		_, _, err := net.SplitHostPort(c.MetricsAddress)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("metricsAddress %q is invalid: %v", c.MetricsAddress, err))
+		} else if c.MetricsAddress == c.Addr() {
+			errs = append(errs, fmt.Sprintf("metricsAddress %q must differ from listenAddress", c.MetricsAddress))
+		}
+	}
+	if !c.DisableTLS && (c.CertFile == "" || c.KeyFile == "") {
+		errs = append(errs, "certFile and keyFile are required unless disableTLS is set")
+	}
+	if c.ReadTimeout.Duration <= 0 {
+		errs = append(errs, "readTimeout must be positive")
+	}
+	if c.WriteTimeout.Duration <= 0 {
+		errs = append(errs, "writeTimeout must be positive")
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(c.AnnotationPrefix) {
+		errs = append(errs, fmt.Sprintf("annotationPrefix %q is invalid: %s", c.AnnotationPrefix, msg))
+	}
+	if c.UserErrorPolicy != userErrorPolicyDeny && c.UserErrorPolicy != userErrorPolicyWarn {
+		errs = append(errs, fmt.Sprintf("userErrorPolicy %q is invalid: must be %q or %q", c.UserErrorPolicy, userErrorPolicyDeny, userErrorPolicyWarn))
+	}
+	if c.DuplicateTermPolicy != duplicateTermPolicySkip && c.DuplicateTermPolicy != duplicateTermPolicyMerge {
+		errs = append(errs, fmt.Sprintf("duplicateTermPolicy %q is invalid: must be %q or %q", c.DuplicateTermPolicy, duplicateTermPolicySkip, duplicateTermPolicyMerge))
+	}
+	if c.PreStopDelay.Duration < 0 {
+		errs = append(errs, "preStopDelay must not be negative")
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		errs = append(errs, "shutdownTimeout must be positive")
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		errs = append(errs, fmt.Sprintf("logLevel %q is invalid: must be one of %s", c.LogLevel, logLevelNames()))
+	}
+	for _, name := range sortedFeatureGateNames(c.FeatureGates) {
+		if !containsString(kep3633.MutatorNames(), name) {
+			errs = append(errs, fmt.Sprintf("featureGates %q is unknown: must be one of %s", name, strings.Join(kep3633.MutatorNames(), ", ")))
+		}
+	}
+	if c.LogFormat != logFormatJSON && c.LogFormat != logFormatText {
+		errs = append(errs, fmt.Sprintf("logFormat %q is invalid: must be %q or %q", c.LogFormat, logFormatJSON, logFormatText))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Addr returns the listen address, defaulting by whether TLS is enabled.
+func (c *Config) Addr() string {
+	if c.ListenAddress != "" {
+		return c.ListenAddress
+	}
+	if c.DisableTLS {
+		return defaultPlainAddr
+	}
+	return defaultTLSAddr
+}
+
+// AnnotationKey returns the annotation key of name under the configured prefix.
+func (c *Config) AnnotationKey(name string) string {
+	return c.AnnotationPrefix + "/" + name
+}
+
+func sortedFeatureGateNames(g featureGates) []string {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, err := loadConfig("test", []string{}, emptyEnv)
+	if err != nil {
+		t.Fatal("failed to load default config", err)
+	}
+
+	if config.Addr() != defaultTLSAddr {
+		t.Error("unexpected listen address", config.Addr())
+	}
+	if config.CertFile != "/certs/tls.crt" || config.KeyFile != "/certs/tls.key" {
+		t.Error("unexpected cert paths", config.CertFile, config.KeyFile)
+	}
+	if config.AnnotationKey(annotationNamePodAntiAffinityHard) != "kep-3633-alt.10h.in/podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution" {
+		t.Error("unexpected annotation key", config.AnnotationKey(annotationNamePodAntiAffinityHard))
+	}
+	if config.UserErrorPolicy != userErrorPolicyDeny {
+		t.Error("unexpected user error policy", config.UserErrorPolicy)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	configFile := writeConfigFile(t, `
+disableTLS: true
+readTimeout: 10s
+annotationPrefix: example.com
+userErrorPolicy: warn
+`)
+
+	config, err := loadConfig("test", []string{"-config", configFile}, emptyEnv)
+	if err != nil {
+		t.Fatal("failed to load config file", err)
+	}
+
+	if config.Addr() != defaultPlainAddr {
+		t.Error("unexpected listen address", config.Addr())
+	}
+	if config.ReadTimeout.Duration != 10*time.Second {
+		t.Error("unexpected read timeout", config.ReadTimeout.Duration)
+	}
+	if config.WriteTimeout.Duration != 30*time.Second {
+		t.Error("unspecified field should keep default", config.WriteTimeout.Duration)
+	}
+	if config.AnnotationPrefix != "example.com" {
+		t.Error("unexpected annotation prefix", config.AnnotationPrefix)
+	}
+	if config.UserErrorPolicy != userErrorPolicyWarn {
+		t.Error("unexpected user error policy", config.UserErrorPolicy)
+	}
+}
+
+func TestLoadConfigFileUnknownField(t *testing.T) {
+	configFile := writeConfigFile(t, `
+userErrorPolcy: warn
+`)
+
+	_, err := loadConfig("test", []string{"-config", configFile}, emptyEnv)
+	if err == nil {
+		t.Error("unknown field should be rejected")
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	configFile := writeConfigFile(t, `
+listenAddress: ":9443"
+userErrorPolicy: warn
+`)
+	env := map[string]string{
+		"KEP3633ALT_CONFIG":            configFile,
+		"KEP3633ALT_USER_ERROR_POLICY": "deny",
+		"KEP3633ALT_CERT_FILE":         "/etc/webhook/tls.crt",
+		"KEP3633ALT_PRE_STOP_DELAY":    "0s",
+	}
+
+	config, err := loadConfig("test", []string{}, mapEnv(env))
+	if err != nil {
+		t.Fatal("failed to load config from env", err)
+	}
+
+	if config.Addr() != ":9443" {
+		t.Error("config file specified by env should be loaded", config.Addr())
+	}
+	if config.UserErrorPolicy != userErrorPolicyDeny {
+		t.Error("env should override config file", config.UserErrorPolicy)
+	}
+	if config.CertFile != "/etc/webhook/tls.crt" {
+		t.Error("unexpected cert file", config.CertFile)
+	}
+	if config.PreStopDelay.Duration != 0 {
+		t.Error("unexpected pre-stop delay", config.PreStopDelay.Duration)
+	}
+
+	_, err = loadConfig("test", []string{}, mapEnv(map[string]string{"KEP3633ALT_READ_TIMEOUT": "soon"}))
+	if err == nil || !strings.Contains(err.Error(), "KEP3633ALT_READ_TIMEOUT") {
+		t.Error("invalid env should be reported with its name", err)
+	}
+}
+
+func TestLoadConfigFlags(t *testing.T) {
+	configFile := writeConfigFile(t, `
+userErrorPolicy: warn
+writeTimeout: 5s
+`)
+	env := map[string]string{
+		"KEP3633ALT_USER_ERROR_POLICY": "warn",
+		"KEP3633ALT_WRITE_TIMEOUT":     "7s",
+	}
+
+	config, err := loadConfig("test", []string{"-config", configFile, "-user-error-policy", "deny", "-listen-address", "127.0.0.1:8444"}, mapEnv(env))
+	if err != nil {
+		t.Fatal("failed to load config from flags", err)
+	}
+
+	if config.UserErrorPolicy != userErrorPolicyDeny {
+		t.Error("flag should override env and config file", config.UserErrorPolicy)
+	}
+	if config.WriteTimeout.Duration != 7*time.Second {
+		t.Error("env should override config file when flag is not set", config.WriteTimeout.Duration)
+	}
+	if config.Addr() != "127.0.0.1:8444" {
+		t.Error("unexpected listen address", config.Addr())
+	}
+}
+
+func TestLoadConfigFeatureGates(t *testing.T) {
+	configFile := writeConfigFile(t, `
+featureGates:
+  PodAffinityRequired: false
+  TopologySpreadConstraints: false
+`)
+	env := map[string]string{
+		"KEP3633ALT_FEATURE_GATES": "PodAffinityPreferred=false",
+	}
+
+	config, err := loadConfig("test", []string{"-config", configFile, "-feature-gates", "TopologySpreadConstraints=true"}, mapEnv(env))
+	if err != nil {
+		t.Fatal("failed to load feature gates", err)
+	}
+
+	expected := map[string]bool{
+		"PodAffinityRequired":       false,
+		"PodAffinityPreferred":      false,
+		"PodAntiAffinityRequired":   true,
+		"PodAntiAffinityPreferred":  true,
+		"TopologySpreadConstraints": true,
+	}
+	for name, enabled := range expected {
+		if config.FeatureGates.Enabled(name) != enabled {
+			t.Errorf("unexpected feature gate %s: %s", name, config.FeatureGates.String())
+		}
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	invalidArgs := [][]string{
+		{"-user-error-policy", "ignore"},
+		{"-cert-file", ""},
+		{"-annotation-prefix", "Not_A_Domain"},
+		{"-listen-address", "8443"},
+		{"-read-timeout", "0s"},
+		{"-pre-stop-delay", "-1s"},
+		{"-duplicate-term-policy", "replace"},
+		{"-feature-gates", "UnknownMutator=false"},
+		{"-feature-gates", "TopologySpreadConstraints"},
+	}
+
+	for _, args := range invalidArgs {
+		_, err := loadConfig("test", args, emptyEnv)
+		if err == nil {
+			t.Error("invalid configuration should be rejected", args)
+		}
+	}
+
+	_, err := loadConfig("test", []string{"-disable-tls", "-cert-file", ""}, emptyEnv)
+	if err != nil {
+		t.Error("cert file is not required when TLS is disabled", err)
+	}
+}
+
+//
+// utilities
+//
+
+func emptyEnv(string) string {
+	return ""
+}
+
+func mapEnv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, ([]byte)(content), 0600)
+	if err != nil {
+		t.Fatal("failed to write config file", err)
+	}
+	return configFile
+}
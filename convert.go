@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+// termList is a list of terms in pod spec which has the corresponding annotation.
+type termList struct {
+	annotationName string
+	// path is the path to the list from pod spec.
+	path []string
+	// weighted is true when terms have matchLabelKeys and mismatchLabelKeys in podAffinityTerm.
+	weighted bool
+}
+
+var termLists = []termList{
+	{annotationName: kep3633.AnnotationNamePodAffinityHard, path: []string{"affinity", "podAffinity", "requiredDuringSchedulingIgnoredDuringExecution"}},
+	{annotationName: kep3633.AnnotationNamePodAffinitySoft, path: []string{"affinity", "podAffinity", "preferredDuringSchedulingIgnoredDuringExecution"}, weighted: true},
+	{annotationName: kep3633.AnnotationNamePodAntiAffinityHard, path: []string{"affinity", "podAntiAffinity", "requiredDuringSchedulingIgnoredDuringExecution"}},
+	{annotationName: kep3633.AnnotationNamePodAntiAffinitySoft, path: []string{"affinity", "podAntiAffinity", "preferredDuringSchedulingIgnoredDuringExecution"}, weighted: true},
+	{annotationName: kep3633.AnnotationNameTopologySpreadConstraints, path: []string{"topologySpreadConstraints"}},
+}
+
+// labelKeysTerm returns the node which has matchLabelKeys and mismatchLabelKeys of term in l.
+func (l termList) labelKeysTerm(term *yaml.Node) *yaml.Node {
+	if l.weighted {
+		return mappingValue(term, "podAffinityTerm")
+	}
+	return term
+}
+
+// hasLabelKeys reports whether term in l has matchLabelKeys or mismatchLabelKeys.
+func (l termList) hasLabelKeys(term *yaml.Node) bool {
+	t := l.labelKeysTerm(resolveAlias(term))
+	return mappingValue(t, "matchLabelKeys") != nil || mappingValue(t, "mismatchLabelKeys") != nil
+}
+
+// runConvert rewrites terms with matchLabelKeys or mismatchLabelKeys in pod templates of manifests
+// into the annotations the webhook expands, for clusters without native KEP-3633 support.
+// Comments and field order are preserved except for the moved terms.
+func runConvert(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: kep3633alt convert [flags] [FILE...]")
+		fmt.Fprintln(stderr, "Move terms with matchLabelKeys/mismatchLabelKeys in Pods, PodTemplates and workloads read from FILEs (or stdin) into annotations.")
+		flags.PrintDefaults()
+	}
+	annotationPrefix := flags.String("annotation-prefix", kep3633.DefaultAnnotationPrefix, "Prefix of annotations to write")
+	inPlace := flags.Bool("in-place", false, "Rewrite FILEs instead of writing to stdout")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *inPlace && flags.NArg() == 0 {
+		fmt.Fprintln(stderr, "-in-place requires FILEs")
+		return 2
+	}
+
+	return rewriteYAMLFiles(flags.Args(), *inPlace, stdin, stdout, stderr, func(d *yamlDocument) (int, error) {
+		return convertDocument(d, *annotationPrefix, stderr)
+	})
+}
+
+// rewriteYAMLFiles rewrites documents in files (or stdin) with rewrite, which returns the number of changes,
+// and writes them to stdout or back to the files. Files without changes are not rewritten.
+func rewriteYAMLFiles(paths []string, inPlace bool, stdin io.Reader, stdout, stderr io.Writer, rewrite func(*yamlDocument) (int, error)) int {
+	if len(paths) == 0 {
+		paths = []string{stdinName}
+	}
+	failed := false
+	for _, path := range paths {
+		var content []byte
+		var err error
+		if path == stdinName {
+			content, err = io.ReadAll(stdin)
+		} else {
+			content, err = os.ReadFile(path)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			failed = true
+			continue
+		}
+		docs, err := decodeYAMLDocuments(path, bytes.NewReader(content))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			failed = true
+			continue
+		}
+
+		changes := 0
+		for _, d := range docs {
+			n, err := rewrite(d)
+			if err != nil {
+				fmt.Fprintf(stderr, "%s: %v\n", d, err)
+				failed = true
+			}
+			changes += n
+		}
+
+		if !inPlace {
+			err = encodeYAMLDocuments(stdout, docs)
+		} else if changes > 0 {
+			buf := &bytes.Buffer{}
+			err = encodeYAMLDocuments(buf, docs)
+			if err == nil {
+				err = os.WriteFile(path, buf.Bytes(), 0644)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// convertDocument moves terms with label keys in the pod template of d into annotations, and returns the number of moved terms.
+// Terms are appended to the annotation if it already exists.
+func convertDocument(d *yamlDocument, annotationPrefix string, stderr io.Writer) (int, error) {
+	template := d.podTemplate()
+	if template == nil {
+		return 0, nil
+	}
+	spec := mappingValue(template, "spec")
+	if spec == nil {
+		return 0, nil
+	}
+
+	moved := 0
+	for _, l := range termLists {
+		list := mappingLookup(spec, l.path...)
+		if list == nil || list.Kind != yaml.SequenceNode {
+			continue
+		}
+		kept := make([]*yaml.Node, 0, len(list.Content))
+		terms := make([]json.RawMessage, 0)
+		for _, term := range list.Content {
+			if !l.hasLabelKeys(term) {
+				kept = append(kept, term)
+				continue
+			}
+			termJSON, err := nodeToJSON(term)
+			if err != nil {
+				return moved, fmt.Errorf("failed to convert term at line %d: %w", term.Line, err)
+			}
+			terms = append(terms, termJSON)
+		}
+		if len(terms) == 0 {
+			continue
+		}
+
+		annotationKey := annotationPrefix + "/" + l.annotationName
+		annotations := ensureMapping(template, "metadata", "annotations")
+		value, err := appendAnnotationTerms(scalarValue(mappingValue(annotations, annotationKey)), terms)
+		if err != nil {
+			return moved, fmt.Errorf("failed to append terms to annotation %s: %w", annotationKey, err)
+		}
+		setMappingValue(annotations, annotationKey, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Style: yaml.LiteralStyle, Value: value})
+		list.Content = kept
+		pruneEmpty(spec, l.path...)
+		moved += len(terms)
+		fmt.Fprintf(stderr, "%s: moved %d terms to annotation %s\n", d, len(terms), annotationKey)
+	}
+	return moved, nil
+}
+
+// appendAnnotationTerms returns indented JSON array of terms in the annotation value existing, followed by terms.
+func appendAnnotationTerms(existing string, terms []json.RawMessage) (string, error) {
+	all := make([]json.RawMessage, 0, len(terms))
+	if existing != "" {
+		err := json.Unmarshal([]byte(existing), &all)
+		if err != nil {
+			return "", err
+		}
+	}
+	all = append(all, terms...)
+	compact, err := json.Marshal(all)
+	if err != nil {
+		return "", err
+	}
+	indented := &bytes.Buffer{}
+	err = json.Indent(indented, compact, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return indented.String() + "\n", nil
+}
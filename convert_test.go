@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+const convertTestDeployment = `# nginx deployment
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx
+spec:
+  selector:
+    matchLabels:
+      app: nginx
+  template:
+    metadata:
+      labels:
+        app: nginx
+    spec:
+      # scheduling
+      affinity:
+        podAntiAffinity:
+          requiredDuringSchedulingIgnoredDuringExecution:
+            - labelSelector:
+                matchLabels:
+                  app: nginx
+              topologyKey: topology.kubernetes.io/zone
+              matchLabelKeys:
+                - pod-template-hash
+          preferredDuringSchedulingIgnoredDuringExecution:
+            - weight: 10
+              podAffinityTerm:
+                labelSelector:
+                  matchLabels:
+                    app: nginx
+                topologyKey: kubernetes.io/hostname
+            - weight: 20
+              podAffinityTerm:
+                labelSelector:
+                  matchLabels:
+                    app: nginx
+                topologyKey: kubernetes.io/hostname
+                mismatchLabelKeys:
+                  - tenant
+      containers:
+        - name: nginx # main container
+          image: nginx
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: nginx
+`
+
+func TestConvert(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runConvert(nil, strings.NewReader(convertTestDeployment), stdout, stderr)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	for _, comment := range []string{"# nginx deployment", "# scheduling", "# main container"} {
+		if !strings.Contains(stdout.String(), comment) {
+			t.Errorf("comment %q should be preserved: %s", comment, stdout.String())
+		}
+	}
+	if strings.Index(stdout.String(), "kind: Deployment") > strings.Index(stdout.String(), "metadata:") {
+		t.Errorf("field order should be preserved: %s", stdout.String())
+	}
+
+	docs := strings.Split(stdout.String(), "\n---\n")
+	if len(docs) != 2 {
+		t.Fatalf("unexpected documents: %s", stdout.String())
+	}
+	deployment := &appsv1.Deployment{}
+	err := yaml.UnmarshalStrict([]byte(docs[0]), deployment)
+	if err != nil {
+		t.Fatalf("failed to decode converted deployment: %v", err)
+	}
+	podAntiAffinity := deployment.Spec.Template.Spec.Affinity.PodAntiAffinity
+	if podAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		t.Errorf("empty list should be removed: %#v", podAntiAffinity)
+	}
+	if len(podAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution) != 1 || podAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution[0].Weight != 10 {
+		t.Errorf("terms without label keys should be kept: %#v", podAntiAffinity)
+	}
+
+	annotations := deployment.Spec.Template.Annotations
+	hardTerms := make([]kep3633.PodAffinityTerm, 0)
+	err = json.Unmarshal([]byte(annotations[kep3633.DefaultAnnotationPrefix+"/"+kep3633.AnnotationNamePodAntiAffinityHard]), &hardTerms)
+	if err != nil || len(hardTerms) != 1 || hardTerms[0].TopologyKey != "topology.kubernetes.io/zone" || hardTerms[0].MatchLabelKeys[0] != "pod-template-hash" {
+		t.Errorf("unexpected required terms in annotation: %v: %v", err, annotations)
+	}
+	softTerms := make([]kep3633.WeightedPodAffinityTerm, 0)
+	err = json.Unmarshal([]byte(annotations[kep3633.DefaultAnnotationPrefix+"/"+kep3633.AnnotationNamePodAntiAffinitySoft]), &softTerms)
+	if err != nil || len(softTerms) != 1 || softTerms[0].Weight != 20 || softTerms[0].PodAffinityTerm.MismatchLabelKeys[0] != "tenant" {
+		t.Errorf("unexpected preferred terms in annotation: %v: %v", err, annotations)
+	}
+}
+
+func TestConvertAppendAnnotation(t *testing.T) {
+	cronJob := `apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  schedule: "@daily"
+  jobTemplate:
+    spec:
+      template:
+        metadata:
+          annotations:
+            kep-3633-alt.10h.in/topologySpreadConstraints: '[{"maxSkew": 1, "topologyKey": "kubernetes.io/hostname", "whenUnsatisfiable": "ScheduleAnyway"}]'
+        spec:
+          topologySpreadConstraints:
+            - maxSkew: 1
+              topologyKey: topology.kubernetes.io/zone
+              whenUnsatisfiable: DoNotSchedule
+              matchLabelKeys: [batch.kubernetes.io/controller-uid]
+          containers:
+            - name: backup
+              image: busybox
+`
+	path := filepath.Join(t.TempDir(), "cronjob.yaml")
+	err := os.WriteFile(path, []byte(cronJob), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runConvert([]string{"-in-place", path}, nil, stdout, stderr)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("nothing should be written to stdout: %s", stdout.String())
+	}
+	converted, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered := &batchv1.CronJob{}
+	err = yaml.UnmarshalStrict(converted, rendered)
+	if err != nil {
+		t.Fatalf("failed to decode converted cron job: %v", err)
+	}
+	template := rendered.Spec.JobTemplate.Spec.Template
+	if template.Spec.TopologySpreadConstraints != nil {
+		t.Errorf("constraints with label keys should be moved: %#v", template.Spec.TopologySpreadConstraints)
+	}
+	constraints := make([]map[string]interface{}, 0)
+	err = json.Unmarshal([]byte(template.Annotations[kep3633.DefaultAnnotationPrefix+"/"+kep3633.AnnotationNameTopologySpreadConstraints]), &constraints)
+	if err != nil || len(constraints) != 2 || constraints[0]["topologyKey"] != "kubernetes.io/hostname" || constraints[1]["topologyKey"] != "topology.kubernetes.io/zone" {
+		t.Errorf("constraints should be appended to the existing annotation: %v: %v", err, constraints)
+	}
+}
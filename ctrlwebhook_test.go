@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/10hin/kep-3633-alt/pkg/ctrlwebhook"
+)
+
+type testHandlerParityCase struct {
+	Name            string
+	Policy          string
+	StrictLabelKeys bool
+	Annotations     map[string]string
+	// Reinvoke admits the pod patched by the first response again
+	Reinvoke bool
+}
+
+// TestHandlerParity checks that ctrlwebhook.Handler responds the same as the standalone webhook.
+func TestHandlerParity(t *testing.T) {
+	validTerms := `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}]`
+	missingTerms := `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["missing"]}]`
+	antiAffinityKey := config.AnnotationKey(annotationNamePodAntiAffinityHard)
+
+	testCases := []testHandlerParityCase{
+		{
+			Name:   "without annotations",
+			Policy: userErrorPolicyDeny,
+		},
+		{
+			Name:        "terms are injected",
+			Policy:      userErrorPolicyDeny,
+			Annotations: map[string]string{antiAffinityKey: validTerms},
+		},
+		{
+			Name:        "broken annotation is denied",
+			Policy:      userErrorPolicyDeny,
+			Annotations: map[string]string{antiAffinityKey: `{`},
+		},
+		{
+			Name:        "broken annotation is warned",
+			Policy:      userErrorPolicyWarn,
+			Annotations: map[string]string{antiAffinityKey: `{`},
+		},
+		{
+			Name:        "broken annotation already recorded",
+			Policy:      userErrorPolicyWarn,
+			Annotations: map[string]string{antiAffinityKey: `{`},
+			Reinvoke:    true,
+		},
+		{
+			Name:        "missing label key is warned",
+			Policy:      userErrorPolicyDeny,
+			Annotations: map[string]string{antiAffinityKey: missingTerms},
+		},
+		{
+			Name:            "missing label key is denied in strict mode",
+			Policy:          userErrorPolicyDeny,
+			StrictLabelKeys: true,
+			Annotations:     map[string]string{antiAffinityKey: missingTerms},
+		},
+		{
+			Name:   "missing label key is denied by annotation",
+			Policy: userErrorPolicyDeny,
+			Annotations: map[string]string{
+				antiAffinityKey: missingTerms,
+				config.AnnotationKey(annotationNameStrictLabelKeys): "true",
+			},
+		},
+		{
+			Name:        "already mutated",
+			Policy:      userErrorPolicyDeny,
+			Annotations: map[string]string{antiAffinityKey: validTerms},
+			Reinvoke:    true,
+		},
+	}
+
+	defer func(policy string) { config.UserErrorPolicy = policy }(config.UserErrorPolicy)
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			config.UserErrorPolicy = testCase.Policy
+			handler := ctrlwebhook.NewHandler(newExpander(logger), admission.NewDecoder(scheme.Scheme))
+			handler.StrictLabelKeys = testCase.StrictLabelKeys
+			handler.WarnOnUserError = testCase.Policy == userErrorPolicyWarn
+
+			pod := prepareBasicPod()
+			pod.Labels = map[string]string{"app": "nginx", "pod-template-hash": "abcdef"}
+			pod.Annotations = testCase.Annotations
+			if testCase.Reinvoke {
+				pod = admitPodForParity(t, pod, testCase.StrictLabelKeys)
+			}
+
+			reqReview, err := newPodReview(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := admitPod(reqReview.Request, testCase.StrictLabelKeys)
+			if err != nil {
+				t.Fatalf("failed to admit pod: %v", err)
+			}
+			actual := handler.Handle(context.Background(), admission.Request{AdmissionRequest: *reqReview.Request})
+
+			if actual.Allowed != expected.Allowed {
+				t.Fatalf("allowed differs: handler %t, webhook %t", actual.Allowed, expected.Allowed)
+			}
+			if !expected.Allowed {
+				if actual.Result.Code != expected.Result.Code || actual.Result.Reason != expected.Result.Reason || actual.Result.Message != expected.Result.Message {
+					t.Errorf("result differs:\nhandler %#v\nwebhook %#v", actual.Result, expected.Result)
+				}
+				return
+			}
+			if string(actual.Patch) != string(expected.Patch) {
+				t.Errorf("patch differs:\nhandler %s\nwebhook %s", actual.Patch, expected.Patch)
+			}
+			if !reflect.DeepEqual(actual.PatchType, expected.PatchType) {
+				t.Errorf("patch type differs: handler %v, webhook %v", actual.PatchType, expected.PatchType)
+			}
+			if !reflect.DeepEqual(actual.Warnings, expected.Warnings) {
+				t.Errorf("warnings differ:\nhandler %q\nwebhook %q", actual.Warnings, expected.Warnings)
+			}
+			if !reflect.DeepEqual(actual.AuditAnnotations, expected.AuditAnnotations) {
+				t.Errorf("audit annotations differ:\nhandler %v\nwebhook %v", actual.AuditAnnotations, expected.AuditAnnotations)
+			}
+		})
+	}
+}
+
+// admitPodForParity returns pod patched as the standalone webhook responds.
+func admitPodForParity(t *testing.T, pod *corev1.Pod, strictLabelKeys bool) *corev1.Pod {
+	t.Helper()
+	reqReview, err := newPodReview(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := admitPod(reqReview.Request, strictLabelKeys)
+	if err != nil || resp.Patch == nil {
+		t.Fatalf("pod should be patched: %v", err)
+	}
+	patched, err := applyPatchDocument(pod, resp.Patch)
+	if err != nil {
+		t.Fatalf("failed to apply patch: %v", err)
+	}
+	return patched
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+const (
+	eventSourceComponent = "kep3633alt"
+
+	eventReasonInjected           = "AffinityInjected"
+	eventReasonAnnotationIgnored  = "AnnotationIgnored"
+	eventReasonAnnotationRejected = "AnnotationRejected"
+
+	// podEventWorkers is the number of workers looking up pods without owner to record events on.
+	podEventWorkers = 2
+)
+
+// eventRecorder publishes Kubernetes Events describing the expansion, so that `kubectl describe` shows it
+// without reading logs of the webhook.
+//
+// Pods do not exist yet on admission, so events are recorded on the controller owning the pod,
+// or on the pod itself once it is created.
+type eventRecorder struct {
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+	// podLookupInterval and podLookupTimeout bound waiting for pods without owner to be created.
+	podLookupInterval time.Duration
+	podLookupTimeout  time.Duration
+	// podEvents queues events waiting for pods without owner to be created.
+	podEvents workqueue.DelayingInterface
+	// pendingPodEvents counts events in podEvents; events beyond maxPendingPodEvents are dropped.
+	pendingPodEvents    atomic.Int32
+	maxPendingPodEvents int32
+}
+
+// podEvent is an event waiting in eventRecorder.podEvents for the pod to be created.
+type podEvent struct {
+	namespace string
+	name      string
+	eventType string
+	reason    string
+	message   string
+	deadline  time.Time
+}
+
+// newEventRecorder returns eventRecorder writing events with client, and the function stopping it.
+// Stopping drops events still waiting for their pods.
+func newEventRecorder(client kubernetes.Interface) (*eventRecorder, func()) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	r := &eventRecorder{
+		client:              client,
+		recorder:            broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventSourceComponent}),
+		podLookupInterval:   time.Second,
+		podLookupTimeout:    30 * time.Second,
+		podEvents:           workqueue.NewDelayingQueue(),
+		maxPendingPodEvents: 1000,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < podEventWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.runPodEventWorker(ctx)
+		}()
+	}
+	return r, func() {
+		cancel()
+		r.podEvents.ShutDown()
+		wg.Wait()
+		broadcaster.Shutdown()
+	}
+}
+
+// Injected records an event per kind of terms injected into pod by result, e.g.
+// "Injected 2 podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution terms using pod-template-hash=abc".
+func (r *eventRecorder) Injected(pod *corev1.Pod, result *kep3633.Result) {
+	kinds := make([]string, 0, len(result.Changes))
+	for kind := range result.Changes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		change := result.Changes[kind]
+		if len(change.Injected) == 0 {
+			continue
+		}
+		msg := fmt.Sprintf("Injected %d %s terms", len(change.Injected), kind)
+		if labels := kep3633.ResolvedLabelPairs(change.ResolvedLabelKeys); len(labels) > 0 {
+			msg += " using " + strings.Join(labels, ", ")
+		}
+		r.record(pod, corev1.EventTypeNormal, eventReasonInjected, msg)
+	}
+}
+
+// AnnotationFailed records an event for the annotation which could not be applied, e.g.
+// "Ignored annotation X: invalid JSON at offset 42". denied tells whether the pod is rejected or admitted unchanged.
+func (r *eventRecorder) AnnotationFailed(pod *corev1.Pod, annotationErr *kep3633.AnnotationError, denied bool) {
+	if denied {
+		// the pod is never created, so only its owner can have the event
+		r.record(pod, corev1.EventTypeWarning, eventReasonAnnotationRejected, fmt.Sprintf("Rejected pod with annotation %s: %s", annotationErr.Key, describeAnnotationError(annotationErr.Err)))
+		return
+	}
+	r.record(pod, corev1.EventTypeWarning, eventReasonAnnotationIgnored, fmt.Sprintf("Ignored annotation %s: %s", annotationErr.Key, describeAnnotationError(annotationErr.Err)))
+}
+
+func (r *eventRecorder) record(pod *corev1.Pod, eventType, reason, message string) {
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		r.recorder.Event(&corev1.ObjectReference{
+			APIVersion: owner.APIVersion,
+			Kind:       owner.Kind,
+			Name:       owner.Name,
+			Namespace:  pod.Namespace,
+			UID:        owner.UID,
+		}, eventType, reason, message)
+		return
+	}
+	if pod.Name == "" || reason == eventReasonAnnotationRejected {
+		// neither generated names nor rejected pods can be looked up
+		logger.V(1).Info("drop event without object to record on", "namespace", pod.Namespace, "reason", reason, "message", message)
+		return
+	}
+	r.recordOnCreatedPod(pod.Namespace, pod.Name, eventType, reason, message)
+}
+
+// recordOnCreatedPod queues the event until the pod is created, since events without its UID are not shown by `kubectl describe`.
+func (r *eventRecorder) recordOnCreatedPod(namespace, name, eventType, reason, message string) {
+	if r.pendingPodEvents.Add(1) > r.maxPendingPodEvents {
+		r.pendingPodEvents.Add(-1)
+		logger.Info("drop event for pod; too many events waiting for pods", "namespace", namespace, "name", name, "reason", reason, "message", message)
+		return
+	}
+	r.podEvents.Add(podEvent{
+		namespace: namespace,
+		name:      name,
+		eventType: eventType,
+		reason:    reason,
+		message:   message,
+		deadline:  time.Now().Add(r.podLookupTimeout),
+	})
+}
+
+func (r *eventRecorder) runPodEventWorker(ctx context.Context) {
+	for {
+		item, shutdown := r.podEvents.Get()
+		if shutdown {
+			return
+		}
+		r.processPodEvent(ctx, item.(podEvent))
+		r.podEvents.Done(item)
+	}
+}
+
+// processPodEvent records e on its pod if created, or queues e again until its deadline.
+func (r *eventRecorder) processPodEvent(ctx context.Context, e podEvent) {
+	created, err := r.client.CoreV1().Pods(e.namespace).Get(ctx, e.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) && time.Now().Before(e.deadline) {
+		r.podEvents.AddAfter(e, r.podLookupInterval)
+		return
+	}
+	r.pendingPodEvents.Add(-1)
+	if err != nil {
+		logger.Info("drop event for pod not found", "namespace", e.namespace, "name", e.name, "reason", e.reason, "error", err.Error())
+		return
+	}
+	r.recorder.Event(created, e.eventType, e.reason, e.message)
+}
+
+// describeAnnotationError returns the cause of failed annotation briefly, pointing the offset of broken JSON.
+func describeAnnotationError(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("invalid JSON at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		return fmt.Sprintf("invalid value for %s at offset %d", typeErr.Field, typeErr.Offset)
+	default:
+		return err.Error()
+	}
+}
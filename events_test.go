@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+func TestEventsOnOwner(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	recorder, stop := newEventRecorder(client)
+	defer stop()
+	defer func(r *eventRecorder) { events = r }(events)
+	events = recorder
+
+	controller := true
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx", "pod-template-hash": "abcdef"}
+	pod.OwnerReferences = []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "nginx-abcdef", UID: types.UID("rs-uid"), Controller: &controller},
+	}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}, {"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "topology.kubernetes.io/zone", "matchLabelKeys": ["pod-template-hash"]}]`,
+	}
+	_, err := doMutate(pod)
+	if err != nil {
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNameTopologySpreadConstraints): `{`,
+	}
+	_, err = doMutate(pod)
+	if err != nil {
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+
+	recorded := waitForEvents(t, client, pod.Namespace, 2)
+	expected := map[string]string{
+		eventReasonInjected:           "Injected 2 " + annotationNamePodAntiAffinityHard + " terms using pod-template-hash=abcdef",
+		eventReasonAnnotationRejected: "Rejected pod with annotation " + config.AnnotationKey(annotationNameTopologySpreadConstraints) + ": invalid JSON at offset 1",
+	}
+	for _, event := range recorded {
+		if event.InvolvedObject.Kind != "ReplicaSet" || event.InvolvedObject.UID != "rs-uid" {
+			t.Errorf("event should be recorded on the owner: %#v", event.InvolvedObject)
+		}
+		if event.Message != expected[event.Reason] {
+			t.Errorf("unexpected event %s: %s", event.Reason, event.Message)
+		}
+	}
+}
+
+func TestEventsOnCreatedPod(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `{`,
+	}
+	created := pod.DeepCopy()
+	created.UID = types.UID("pod-uid")
+	client := fake.NewSimpleClientset()
+	recorder, stop := newEventRecorder(client)
+	defer stop()
+	recorder.podLookupInterval = 10 * time.Millisecond
+
+	recorder.AnnotationFailed(pod, annotationErrorOf(t, pod), false)
+	time.Sleep(50 * time.Millisecond)
+	_, err := client.CoreV1().Pods(pod.Namespace).Create(context.Background(), created, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := waitForEvents(t, client, pod.Namespace, 1)
+	if recorded[0].InvolvedObject.Kind != "Pod" || recorded[0].InvolvedObject.UID != created.UID {
+		t.Errorf("event should be recorded on the created pod: %#v", recorded[0].InvolvedObject)
+	}
+	if recorded[0].Reason != eventReasonAnnotationIgnored || recorded[0].Type != corev1.EventTypeWarning {
+		t.Errorf("unexpected event: %#v", recorded[0])
+	}
+}
+
+func TestEventsOnCreatedPodStop(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `{`,
+	}
+	client := fake.NewSimpleClientset()
+	recorder, stop := newEventRecorder(client)
+	recorder.maxPendingPodEvents = 1
+
+	recorder.AnnotationFailed(pod, annotationErrorOf(t, pod), false)
+	other := pod.DeepCopy()
+	other.Name = "other"
+	recorder.AnnotationFailed(other, annotationErrorOf(t, other), false)
+	if pending := recorder.pendingPodEvents.Load(); pending != 1 {
+		t.Errorf("events beyond the limit should be dropped: %d events pending", pending)
+	}
+
+	// the pod is never created; stopping must not wait for the lookup timeout
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event recorder should stop without waiting for pods")
+	}
+}
+
+func TestEventsReinvocation(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	recorder, stop := newEventRecorder(client)
+	defer stop()
+	defer func(r *eventRecorder) { events = r }(events)
+	events = recorder
+	defer func(policy string) { config.UserErrorPolicy = policy }(config.UserErrorPolicy)
+	config.UserErrorPolicy = userErrorPolicyWarn
+
+	controller := true
+	for _, annotation := range []string{
+		`[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname"}]`,
+		`{`,
+	} {
+		pod := prepareBasicPod()
+		pod.OwnerReferences = []metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "nginx-abcdef", UID: types.UID("rs-uid"), Controller: &controller},
+		}
+		pod.Annotations = map[string]string{
+			config.AnnotationKey(annotationNamePodAntiAffinityHard): annotation,
+		}
+		respReview, err := doMutate(pod)
+		if err != nil {
+			t.Fatalf("failed to call mutate: %v", err)
+		}
+		mutatedPod, err := applyPatchDocument(pod, respReview.Response.Patch)
+		if err != nil {
+			t.Fatalf("failed to apply patch: %v", err)
+		}
+		_, err = doMutate(mutatedPod)
+		if err != nil {
+			t.Fatalf("failed to call mutate: %v", err)
+		}
+	}
+
+	waitForEvents(t, client, "default", 2)
+	time.Sleep(100 * time.Millisecond)
+	eventList, err := client.CoreV1().Events("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// repeated events are aggregated into the count of the first one
+	reasons := make(map[string]int32)
+	for _, event := range eventList.Items {
+		reasons[event.Reason] += event.Count
+	}
+	if reasons[eventReasonInjected] != 1 || reasons[eventReasonAnnotationIgnored] != 1 {
+		t.Errorf("events should not be recorded again on reinvocation: %v", reasons)
+	}
+}
+
+func TestEventsDryRun(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	recorder, stop := newEventRecorder(client)
+	defer stop()
+	defer func(r *eventRecorder) { events = r }(events)
+	events = recorder
+
+	controller := true
+	pod := prepareBasicPod()
+	pod.OwnerReferences = []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "nginx-abcdef", UID: types.UID("rs-uid"), Controller: &controller},
+	}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname"}]`,
+	}
+	reqReview, err := newPodReview(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dryRun := true
+	reqReview.Request.DryRun = &dryRun
+	resp, err := admitPod(reqReview.Request, false)
+	if err != nil || resp.Patch == nil {
+		t.Fatalf("dry-run request should be patched: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	eventList, err := client.CoreV1().Events(pod.Namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eventList.Items) != 0 {
+		t.Errorf("events should not be recorded on dry-run: %#v", eventList.Items)
+	}
+}
+
+func TestDescribeAnnotationError(t *testing.T) {
+	pod := prepareBasicPod()
+	for source, expected := range map[string]string{
+		`[{"topologyKey": "kubernetes.io/hostname",}]`: "invalid JSON at offset 43",
+		`[{"topologyKey": 1}]`:                         "invalid value for 0.topologyKey at offset 18",
+	} {
+		pod.Annotations = map[string]string{
+			config.AnnotationKey(annotationNamePodAntiAffinityHard): source,
+		}
+		if msg := describeAnnotationError(annotationErrorOf(t, pod).Err); msg != expected {
+			t.Errorf("unexpected description of %s: %s", source, msg)
+		}
+	}
+}
+
+func annotationErrorOf(t *testing.T, pod *corev1.Pod) *kep3633.AnnotationError {
+	t.Helper()
+	_, err := newExpander(logger).ExpandResult(pod)
+	var annotationErr *kep3633.AnnotationError
+	if !errors.As(err, &annotationErr) {
+		t.Fatalf("expected AnnotationError: %v", err)
+	}
+	return annotationErr
+}
+
+func waitForEvents(t *testing.T, client kubernetes.Interface, namespace string, n int) []corev1.Event {
+	t.Helper()
+	var recorded []corev1.Event
+	err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		eventList, err := client.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		recorded = eventList.Items
+		return len(recorded) >= n, nil
+	})
+	if err != nil {
+		t.Fatalf("expected %d events, got %#v: %v", n, recorded, err)
+	}
+	return recorded
+}
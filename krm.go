@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+const (
+	resourceListAPIVersion = "config.kubernetes.io/v1"
+	resourceListKind       = "ResourceList"
+	// krmFunctionConfigAPIVersion and krmFunctionConfigKind identify the typed functionConfig.
+	// A ConfigMap with the same fields in data is accepted as well.
+	krmFunctionConfigAPIVersion = "fn.kep-3633-alt.10h.in/v1alpha1"
+	krmFunctionConfigKind       = "Kep3633Alt"
+	// annotationKeyKRMPath and annotationKeyKRMIndex locate items in files, set by the orchestrator.
+	annotationKeyKRMPath  = "internal.config.kubernetes.io/path"
+	annotationKeyKRMIndex = "internal.config.kubernetes.io/index"
+)
+
+// krmFunctionConfig is the functionConfig of the KRM function, either typed (fields in spec) or a ConfigMap (fields in data).
+type krmFunctionConfig struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       krmFunctionSpec   `json:"spec"`
+	Data       map[string]string `json:"data"`
+}
+
+type krmFunctionSpec struct {
+	// Mode is the name of the documentTransform; transformModeConvert by default.
+	Mode string `json:"mode"`
+	// AnnotationPrefix is kep3633.DefaultAnnotationPrefix by default.
+	AnnotationPrefix string `json:"annotationPrefix"`
+}
+
+// krmResult is a result in ResourceList, reported by the orchestrator.
+type krmResult struct {
+	Message     string             `json:"message"`
+	Severity    string             `json:"severity"`
+	ResourceRef *krmResourceRef    `json:"resourceRef,omitempty"`
+	File        *krmResultFileInfo `json:"file,omitempty"`
+}
+
+type krmResourceRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+}
+
+type krmResultFileInfo struct {
+	Path  string `json:"path"`
+	Index int    `json:"index"`
+}
+
+// runKRMFunction runs as a KRM function (e.g. a kustomize transformer), reading a ResourceList on stdin
+// and writing it to stdout with items rewritten in the mode selected by functionConfig.
+// Failures are written as results of the ResourceList, with exit code 1.
+func runKRMFunction(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("krm", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: kep3633alt krm")
+		fmt.Fprintln(stderr, "Rewrite items of a ResourceList on stdin as a KRM function, in the mode (\""+transformModeConvert+"\" or \""+transformModeExpand+"\") selected by functionConfig.")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	docs, err := decodeYAMLDocuments(stdinName, stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if len(docs) != 1 || docs[0].Kind() != resourceListKind {
+		fmt.Fprintf(stderr, "input must be a %s\n", resourceListKind)
+		return 1
+	}
+	resourceList := docs[0].Root()
+
+	results := make([]krmResult, 0)
+	spec, err := readKRMFunctionConfig(mappingValue(resourceList, "functionConfig"))
+	var transform documentTransform
+	if err == nil {
+		transform, err = lookupTransform(spec.Mode)
+	}
+	if err != nil {
+		results = append(results, krmResult{Message: "invalid functionConfig: " + err.Error(), Severity: "error"})
+	}
+
+	items := mappingValue(resourceList, "items")
+	if transform != nil && items != nil && items.Kind == yaml.SequenceNode {
+		for index, item := range items.Content {
+			d := krmItemDocument(item, index)
+			_, err := transform(d, spec.AnnotationPrefix, stderr)
+			if err != nil {
+				results = append(results, krmItemResult(d, err.Error(), "error"))
+			}
+		}
+	}
+
+	failed := len(results) > 0
+	if failed {
+		resultsNode, err := jsonToNode(results)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		setMappingValue(resourceList, "results", resultsNode)
+	}
+	err = encodeYAMLDocuments(stdout, docs)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// readKRMFunctionConfig returns the spec of functionConfig with defaults applied. functionConfig is optional.
+func readKRMFunctionConfig(functionConfig *yaml.Node) (*krmFunctionSpec, error) {
+	config := &krmFunctionConfig{}
+	if functionConfig != nil {
+		configBytes, err := nodeToJSON(functionConfig)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(configBytes, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	spec := &config.Spec
+	switch {
+	case functionConfig == nil:
+	case config.APIVersion == krmFunctionConfigAPIVersion && config.Kind == krmFunctionConfigKind:
+	case config.APIVersion == "v1" && config.Kind == "ConfigMap":
+		spec = &krmFunctionSpec{Mode: config.Data["mode"], AnnotationPrefix: config.Data["annotationPrefix"]}
+	default:
+		return nil, fmt.Errorf("unsupported kind %s/%s: must be %s/%s or v1/ConfigMap", config.APIVersion, config.Kind, krmFunctionConfigAPIVersion, krmFunctionConfigKind)
+	}
+	if spec.Mode == "" {
+		spec.Mode = transformModeConvert
+	}
+	if spec.AnnotationPrefix == "" {
+		spec.AnnotationPrefix = kep3633.DefaultAnnotationPrefix
+	}
+	return spec, nil
+}
+
+// krmItemDocument returns item at index of ResourceList as a document, named by the file it was read from if known.
+func krmItemDocument(item *yaml.Node, index int) *yamlDocument {
+	d := &yamlDocument{Source: "items", Index: index, Node: item}
+	if path := scalarValue(mappingLookup(item, "metadata", "annotations", annotationKeyKRMPath)); path != "" {
+		d.Source = path
+		d.Index, _ = strconv.Atoi(scalarValue(mappingLookup(item, "metadata", "annotations", annotationKeyKRMIndex)))
+	}
+	return d
+}
+
+func krmItemResult(d *yamlDocument, message, severity string) krmResult {
+	root := d.Root()
+	result := krmResult{
+		Message:  message,
+		Severity: severity,
+		ResourceRef: &krmResourceRef{
+			APIVersion: scalarValue(mappingValue(root, "apiVersion")),
+			Kind:       d.Kind(),
+			Name:       d.Name(),
+			Namespace:  scalarValue(mappingLookup(root, "metadata", "namespace")),
+		},
+	}
+	if d.Source != "items" {
+		result.File = &krmResultFileInfo{Path: d.Source, Index: d.Index}
+	}
+	return result
+}
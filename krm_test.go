@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+// krmTestResourceList is the part of ResourceList checked by tests.
+type krmTestResourceList struct {
+	APIVersion string                   `json:"apiVersion"`
+	Kind       string                   `json:"kind"`
+	Items      []map[string]interface{} `json:"items"`
+	Results    []krmResult              `json:"results"`
+}
+
+func runKRMFunctionFixture(t *testing.T, input string) (int, *krmTestResourceList, string) {
+	t.Helper()
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runKRMFunction(nil, strings.NewReader(input), stdout, stderr)
+	output := &krmTestResourceList{}
+	err := yaml.Unmarshal(stdout.Bytes(), output)
+	if err != nil {
+		t.Fatalf("failed to decode output: %v: %s", err, stdout.String())
+	}
+	if output.APIVersion != resourceListAPIVersion || output.Kind != resourceListKind {
+		t.Errorf("output should be a ResourceList: %s", stdout.String())
+	}
+	return code, output, stderr.String()
+}
+
+func readFixture(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// templateAnnotations returns annotations of the pod template of a Deployment or StatefulSet item.
+func templateAnnotations(t *testing.T, item map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	spec, _ := item["spec"].(map[string]interface{})
+	template, _ := spec["template"].(map[string]interface{})
+	metadata, _ := template["metadata"].(map[string]interface{})
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	return annotations
+}
+
+func TestKRMFunctionConvert(t *testing.T) {
+	code, output, stderr := runKRMFunctionFixture(t, readFixture(t, "testdata/krm/convert.yaml"))
+	if code != 0 || len(output.Results) != 0 {
+		t.Fatalf("unexpected exit code %d: %v: %s", code, output.Results, stderr)
+	}
+	if len(output.Items) != 2 {
+		t.Fatalf("all items should be written: %v", output.Items)
+	}
+	annotations := templateAnnotations(t, output.Items[0])
+	if _, ok := annotations[kep3633.DefaultAnnotationPrefix+"/"+kep3633.AnnotationNamePodAntiAffinityHard]; !ok {
+		t.Errorf("terms should be moved into annotation: %v", output.Items[0])
+	}
+	if !strings.Contains(stderr, "deployment.yaml#0 Deployment/nginx: moved 1 terms") {
+		t.Errorf("items should be named by their files: %s", stderr)
+	}
+}
+
+func TestKRMFunctionExpand(t *testing.T) {
+	code, output, stderr := runKRMFunctionFixture(t, readFixture(t, "testdata/krm/expand.yaml"))
+	if code != 0 || len(output.Results) != 0 {
+		t.Fatalf("unexpected exit code %d: %v: %s", code, output.Results, stderr)
+	}
+
+	statefulSet, err := yaml.Marshal(output.Items[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(statefulSet), "tenant: a") || !strings.Contains(string(statefulSet), "podAntiAffinity:") {
+		t.Errorf("static label keys should be expanded: %s", statefulSet)
+	}
+	if _, ok := templateAnnotations(t, output.Items[0])[kep3633.DefaultAnnotationPrefix+"/"+kep3633.AnnotationNameInjected]; !ok {
+		t.Errorf("provenance should be recorded for the webhook: %s", statefulSet)
+	}
+
+	if _, ok := templateAnnotations(t, output.Items[1])[kep3633.DefaultAnnotationPrefix+"/"+kep3633.AnnotationNameInjected]; ok {
+		t.Errorf("templates with runtime label keys should be left to the webhook: %v", output.Items[1])
+	}
+	if !strings.Contains(stderr, "left to the webhook: label keys not in template labels: pod-template-hash") {
+		t.Errorf("templates left to the webhook should be reported: %s", stderr)
+	}
+}
+
+func TestKRMFunctionResults(t *testing.T) {
+	tests := []struct {
+		Name            string
+		Input           string
+		ExpectedMessage string
+	}{
+		{
+			Name: "invalid mode",
+			Input: `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+functionConfig:
+  apiVersion: v1
+  kind: ConfigMap
+  data:
+    mode: inject
+items: []
+`,
+			ExpectedMessage: `invalid functionConfig: invalid mode "inject"`,
+		},
+		{
+			Name: "invalid annotation",
+			Input: `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+functionConfig:
+  apiVersion: fn.kep-3633-alt.10h.in/v1alpha1
+  kind: Kep3633Alt
+  spec:
+    mode: expand
+items:
+  - apiVersion: v1
+    kind: Pod
+    metadata:
+      name: web
+      annotations:
+        kep-3633-alt.10h.in/topologySpreadConstraints: '[{"maxSkew": }]'
+`,
+			ExpectedMessage: "annotation kep-3633-alt.10h.in/topologySpreadConstraints: invalid JSON",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			code, output, _ := runKRMFunctionFixture(t, tt.Input)
+			if code != 1 {
+				t.Errorf("unexpected exit code %d", code)
+			}
+			if len(output.Results) != 1 || output.Results[0].Severity != "error" || !strings.HasPrefix(output.Results[0].Message, tt.ExpectedMessage) {
+				t.Errorf("unexpected results: %#v", output.Results)
+			}
+		})
+	}
+}
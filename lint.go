@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+const (
+	lintOutputText  = "text"
+	lintOutputJSON  = "json"
+	lintOutputSARIF = "sarif"
+
+	lintSeverityError   = "error"
+	lintSeverityWarning = "warning"
+)
+
+// lintRule is a kind of problem found by runLint.
+type lintRule struct {
+	ID          string
+	Severity    string
+	Description string
+}
+
+var (
+	lintRuleInvalidAnnotation = lintRule{ID: "invalid-annotation", Severity: lintSeverityError, Description: "Annotation value is not valid JSON of the terms, or has fields unknown to them (e.g. a typo of matchLabelKeys)"}
+	lintRuleKEPViolation      = lintRule{ID: "kep-violation", Severity: lintSeverityError, Description: "Terms violate a validation rule of KEP-3633, so the webhook rejects or ignores the annotation"}
+	lintRuleUnknownAnnotation = lintRule{ID: "unknown-annotation", Severity: lintSeverityError, Description: "Annotation key under the prefix is not recognized by the webhook and has no effect"}
+	lintRuleMissingLabelKey   = lintRule{ID: "missing-label-key", Severity: lintSeverityWarning, Description: "Label key is neither in the template labels nor a label known to be set at runtime, so it is ignored"}
+)
+
+// lintRules are all rules, in the order of the documentation.
+var lintRules = []lintRule{lintRuleInvalidAnnotation, lintRuleKEPViolation, lintRuleUnknownAnnotation, lintRuleMissingLabelKey}
+
+// runtimeLabels are labels set on pods by the controller of each kind, so missing from templates by design.
+var runtimeLabels = map[string][]string{
+	"ReplicaSet":  {"pod-template-hash"},
+	"Deployment":  {"pod-template-hash"},
+	"StatefulSet": {"controller-revision-hash", "statefulset.kubernetes.io/pod-name", "apps.kubernetes.io/pod-index"},
+	"DaemonSet":   {"controller-revision-hash", "pod-template-generation"},
+	"Job":         {"controller-uid", "job-name", "batch.kubernetes.io/controller-uid", "batch.kubernetes.io/job-name", "batch.kubernetes.io/job-completion-index"},
+	"CronJob":     {"controller-uid", "job-name", "batch.kubernetes.io/controller-uid", "batch.kubernetes.io/job-name", "batch.kubernetes.io/job-completion-index"},
+}
+
+// lintFinding is a problem found in a manifest.
+type lintFinding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	File     string `json:"file"`
+	// Line and Column locate the annotation key, starting from 1.
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	// Object is the object the annotation is found in, e.g. "Deployment/nginx".
+	Object     string `json:"object"`
+	Annotation string `json:"annotation"`
+	Message    string `json:"message"`
+}
+
+// runLint checks kep-3633-alt annotations of pod templates in manifests, and exits with 1 if problems are found,
+// so that it can run in CI.
+func runLint(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: kep3633alt lint [flags] [FILE...]")
+		fmt.Fprintln(stderr, "Check annotations of Pods, PodTemplates and workloads read from FILEs (or stdin).")
+		flags.PrintDefaults()
+	}
+	output := flags.String("output", lintOutputText, "Output format: \""+lintOutputText+"\", \""+lintOutputJSON+"\" or \""+lintOutputSARIF+"\"")
+	annotationPrefix := flags.String("annotation-prefix", kep3633.DefaultAnnotationPrefix, "Prefix of annotations to check")
+	failOn := flags.String("fail-on", lintSeverityError, "Lowest severity of findings which fail: \""+lintSeverityError+"\" or \""+lintSeverityWarning+"\"")
+	extraRuntimeLabels := flags.String("runtime-labels", "", "Comma separated keys of labels set at runtime, besides the ones set by controllers (e.g. pod-template-hash of Deployments)")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *output != lintOutputText && *output != lintOutputJSON && *output != lintOutputSARIF {
+		fmt.Fprintf(stderr, "invalid output %q: must be %q, %q or %q\n", *output, lintOutputText, lintOutputJSON, lintOutputSARIF)
+		return 2
+	}
+	if *failOn != lintSeverityError && *failOn != lintSeverityWarning {
+		fmt.Fprintf(stderr, "invalid fail-on %q: must be %q or %q\n", *failOn, lintSeverityError, lintSeverityWarning)
+		return 2
+	}
+
+	labels := make([]string, 0)
+	for _, label := range strings.Split(*extraRuntimeLabels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{stdinName}
+	}
+	failed := false
+	findings := make([]lintFinding, 0)
+	for _, path := range paths {
+		docs, err := readYAMLFile(path, stdin)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			failed = true
+			continue
+		}
+		for _, d := range docs {
+			findings = append(findings, lintDocument(d, *annotationPrefix, labels)...)
+		}
+	}
+
+	switch *output {
+	case lintOutputJSON:
+		err = writeLintJSON(stdout, findings)
+	case lintOutputSARIF:
+		err = writeLintSARIF(stdout, findings)
+	default:
+		err = writeLintText(stdout, findings)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	for _, f := range findings {
+		if f.Severity == lintSeverityError || *failOn == lintSeverityWarning {
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// lintDocument returns findings in annotations of the pod template of d.
+// extraRuntimeLabels are keys of labels set at runtime in addition to runtimeLabels.
+func lintDocument(d *yamlDocument, annotationPrefix string, extraRuntimeLabels []string) []lintFinding {
+	template := d.podTemplate()
+	annotations := mappingLookup(template, "metadata", "annotations")
+	if annotations == nil || annotations.Kind != yaml.MappingNode {
+		return nil
+	}
+	recognized := make(map[string]bool)
+	for _, name := range kep3633.AnnotationNames() {
+		recognized[name] = true
+	}
+	for _, name := range []string{kep3633.AnnotationNameMissingLabelKeys, kep3633.AnnotationNameInjected, kep3633.AnnotationNameStatus, kep3633.AnnotationNameStrictLabelKeys} {
+		recognized[name] = false
+	}
+	labels := make(map[string]bool)
+	for _, label := range runtimeLabels[d.Kind()] {
+		labels[label] = true
+	}
+	for _, label := range extraRuntimeLabels {
+		labels[label] = true
+	}
+	templateLabels := mappingLookup(template, "metadata", "labels")
+	if templateLabels != nil && templateLabels.Kind == yaml.MappingNode {
+		for i := 0; i < len(templateLabels.Content); i += 2 {
+			labels[templateLabels.Content[i].Value] = true
+		}
+	}
+
+	findings := make([]lintFinding, 0)
+	for i := 0; i+1 < len(annotations.Content); i += 2 {
+		keyNode := annotations.Content[i]
+		name, found := strings.CutPrefix(keyNode.Value, annotationPrefix+"/")
+		if !found {
+			continue
+		}
+		newFinding := func(rule lintRule, message string) lintFinding {
+			return lintFinding{
+				Rule:       rule.ID,
+				Severity:   rule.Severity,
+				File:       d.Source,
+				Line:       keyNode.Line,
+				Column:     keyNode.Column,
+				Object:     d.Kind() + "/" + d.Name(),
+				Annotation: keyNode.Value,
+				Message:    message,
+			}
+		}
+		applied, ok := recognized[name]
+		if !ok {
+			findings = append(findings, newFinding(lintRuleUnknownAnnotation, fmt.Sprintf("not recognized by the webhook; annotations of terms under %s/ are %s", annotationPrefix, strings.Join(kep3633.AnnotationNames(), ", "))))
+			continue
+		}
+		if !applied {
+			continue
+		}
+
+		value := scalarValue(resolveAlias(annotations.Content[i+1]))
+		err := kep3633.ValidateAnnotation(name, value)
+		var aggregate utilerrors.Aggregate
+		if errors.As(err, &aggregate) {
+			for _, e := range aggregate.Errors() {
+				findings = append(findings, newFinding(lintRuleKEPViolation, e.Error()))
+			}
+			continue
+		}
+		if err != nil {
+			findings = append(findings, newFinding(lintRuleInvalidAnnotation, describeAnnotationError(err)))
+			continue
+		}
+		for _, key := range annotationLabelKeys(value) {
+			if !labels[key.Key] {
+				findings = append(findings, newFinding(lintRuleMissingLabelKey, fmt.Sprintf("label key %s in %s is neither in template labels nor a runtime label of %s", key.Key, key.Field, d.Kind())))
+			}
+		}
+	}
+	return findings
+}
+
+// annotationLabelKeys returns label keys referenced by terms in value, which is a valid annotation value, in order.
+// Field is "matchLabelKeys" or "mismatchLabelKeys".
+func annotationLabelKeys(value string) []kep3633.MissingLabelKey {
+	type labelKeys struct {
+		MatchLabelKeys    []string `json:"matchLabelKeys"`
+		MismatchLabelKeys []string `json:"mismatchLabelKeys"`
+	}
+	terms := make([]struct {
+		labelKeys
+		PodAffinityTerm *labelKeys `json:"podAffinityTerm"`
+	}, 0)
+	_ = json.Unmarshal([]byte(value), &terms)
+	keys := make([]kep3633.MissingLabelKey, 0)
+	for _, term := range terms {
+		t := term.labelKeys
+		if term.PodAffinityTerm != nil {
+			t = *term.PodAffinityTerm
+		}
+		for _, key := range t.MatchLabelKeys {
+			keys = append(keys, kep3633.MissingLabelKey{Field: "matchLabelKeys", Key: key})
+		}
+		for _, key := range t.MismatchLabelKeys {
+			keys = append(keys, kep3633.MissingLabelKey{Field: "mismatchLabelKeys", Key: key})
+		}
+	}
+	return keys
+}
+
+// readYAMLFile reads documents of the file named path, or stdin if path is stdinName.
+func readYAMLFile(path string, stdin io.Reader) ([]*yamlDocument, error) {
+	if path == stdinName {
+		return decodeYAMLDocuments(path, stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeYAMLDocuments(path, f)
+}
+
+func writeLintText(w io.Writer, findings []lintFinding) error {
+	for _, f := range findings {
+		_, err := fmt.Fprintf(w, "%s:%d:%d: %s: %s: %s: %s [%s]\n", f.File, f.Line, f.Column, f.Severity, f.Object, f.Annotation, f.Message, f.Rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeLintJSON(w io.Writer, findings []lintFinding) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(findings)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const lintTestDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx
+spec:
+  selector:
+    matchLabels:
+      app: nginx
+  template:
+    metadata:
+      labels:
+        app: nginx
+      annotations:
+        kep-3633-alt.10h.in/podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution: '[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLableKeys": ["pod-template-hash"]}]'
+        kep-3633-alt.10h.in/podAffinity.requiredDuringSchedulingIgnoredDuringExecution: '[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["app"]}]'
+        kep-3633-alt.10h.in/topologySpreadConstraint: '[]'
+        kep-3633-alt.10h.in/topologySpreadConstraints: '[{"maxSkew": 1, "topologyKey": "kubernetes.io/hostname", "whenUnsatisfiable": "DoNotSchedule", "labelSelector": {"matchLabels": {"app": "nginx"}}, "matchLabelKeys": ["pod-template-hash", "tenant"]}]'
+        kep-3633-alt.10h.in/podAffinity.preferredDuringSchedulingIgnoredDuringExecution: '[{"weight": 1, "podAffinityTerm": {"labelSelector": {"matchLabels": {"app": "nginx"}}'
+        kep-3633-alt.10h.in/strictLabelKeys: "true"
+        example.com/unrelated: "x"
+    spec:
+      containers:
+        - name: nginx
+          image: nginx
+`
+
+const lintTestValidJob = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: batch
+spec:
+  template:
+    metadata:
+      labels:
+        app: batch
+        tier: backend
+      annotations:
+        kep-3633-alt.10h.in/podAntiAffinity.preferredDuringSchedulingIgnoredDuringExecution: '[{"weight": 1, "podAffinityTerm": {"labelSelector": {"matchLabels": {"app": "batch"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["batch.kubernetes.io/controller-uid"]}}]'
+        kep-3633-alt.10h.in/topologySpreadConstraints: '[{"maxSkew": 1, "topologyKey": "kubernetes.io/hostname", "whenUnsatisfiable": "ScheduleAnyway", "labelSelector": {"matchLabels": {"app": "batch"}}, "matchLabelKeys": ["tier", "tenant"]}]'
+    spec:
+      restartPolicy: Never
+      containers:
+        - name: batch
+          image: busybox
+`
+
+const lintTestJobWarning = "-:13:9: warning: Job/batch: kep-3633-alt.10h.in/topologySpreadConstraints: label key tenant in matchLabelKeys is neither in template labels nor a runtime label of Job [missing-label-key]\n"
+
+func TestLint(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runLint([]string{"-output", "json"}, strings.NewReader(lintTestDeployment), stdout, stderr)
+	if code != 1 {
+		t.Errorf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	findings := make([]lintFinding, 0)
+	err := json.Unmarshal(stdout.Bytes(), &findings)
+	if err != nil {
+		t.Fatalf("failed to decode findings: %v: %s", err, stdout.String())
+	}
+
+	expected := []lintFinding{
+		{Rule: "invalid-annotation", Severity: "error", Line: 14, Message: `json: unknown field "matchLableKeys"`},
+		{Rule: "kep-violation", Severity: "error", Line: 15, Message: "terms[0].matchLabelKeys[0]"},
+		{Rule: "unknown-annotation", Severity: "error", Line: 16, Message: "not recognized by the webhook"},
+		{Rule: "missing-label-key", Severity: "warning", Line: 17, Message: "label key tenant in matchLabelKeys"},
+		{Rule: "invalid-annotation", Severity: "error", Line: 18, Message: "unexpected end of JSON input"},
+	}
+	if len(findings) != len(expected) {
+		t.Fatalf("unexpected findings: %s", stdout.String())
+	}
+	for i, e := range expected {
+		f := findings[i]
+		if f.Rule != e.Rule || f.Severity != e.Severity || f.Line != e.Line || f.Column != 9 || !strings.HasPrefix(f.Message, e.Message) {
+			t.Errorf("unexpected finding %d: expected %+v, got %+v", i, e, f)
+		}
+		if f.File != stdinName || f.Object != "Deployment/nginx" {
+			t.Errorf("finding %d should be located: %+v", i, f)
+		}
+	}
+}
+
+func TestLintRuntimeLabels(t *testing.T) {
+	tests := []struct {
+		Name         string
+		Args         []string
+		ExpectedCode int
+		ExpectedText string
+	}{
+		{
+			Name:         "warnings do not fail by default",
+			ExpectedCode: 0,
+			ExpectedText: lintTestJobWarning,
+		},
+		{
+			Name:         "fail on warnings",
+			Args:         []string{"-fail-on", "warning"},
+			ExpectedCode: 1,
+			ExpectedText: lintTestJobWarning,
+		},
+		{
+			Name:         "extra runtime labels",
+			Args:         []string{"-fail-on", "warning", "-runtime-labels", "tenant"},
+			ExpectedCode: 0,
+			ExpectedText: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+			code := runLint(tt.Args, strings.NewReader(lintTestValidJob), stdout, stderr)
+			if code != tt.ExpectedCode {
+				t.Errorf("unexpected exit code %d: %s", code, stderr.String())
+			}
+			if stdout.String() != tt.ExpectedText {
+				t.Errorf("unexpected output: %q", stdout.String())
+			}
+		})
+	}
+}
+
+func TestLintSARIF(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runLint([]string{"-output", "sarif"}, strings.NewReader(lintTestDeployment), stdout, stderr)
+	if code != 1 {
+		t.Errorf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	log := &sarifLog{}
+	err := json.Unmarshal(stdout.Bytes(), log)
+	if err != nil {
+		t.Fatalf("failed to decode SARIF: %v: %s", err, stdout.String())
+	}
+	if log.Version != sarifVersion || len(log.Runs) != 1 {
+		t.Fatalf("unexpected SARIF log: %s", stdout.String())
+	}
+	run := log.Runs[0]
+	if len(run.Tool.Driver.Rules) != len(lintRules) {
+		t.Errorf("all rules should be described: %+v", run.Tool.Driver.Rules)
+	}
+	if len(run.Results) != 5 {
+		t.Fatalf("unexpected results: %+v", run.Results)
+	}
+	result := run.Results[3]
+	region := result.Locations[0].PhysicalLocation.Region
+	if result.RuleID != "missing-label-key" || result.Level != "warning" || region.StartLine != 17 || region.StartColumn != 9 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
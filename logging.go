@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+var (
+	// logLevels maps log level names to logr verbosity.
+	logLevels = map[string]int{
+		"info":  0,
+		"debug": 1,
+		"trace": 2,
+	}
+
+	logger = newLogger(os.Stderr, logFormatText, 0)
+)
+
+func newLogger(w io.Writer, format string, verbosity int) logr.Logger {
+	opts := funcr.Options{
+		LogTimestamp: true,
+		Verbosity:    verbosity,
+	}
+	if format == logFormatJSON {
+		return funcr.NewJSON(func(obj string) {
+			_, _ = fmt.Fprintln(w, obj)
+		}, opts)
+	}
+	return funcr.New(func(prefix, args string) {
+		if prefix != "" {
+			_, _ = fmt.Fprintln(w, prefix, args)
+			return
+		}
+		_, _ = fmt.Fprintln(w, args)
+	}, opts)
+}
+
+// requestLogger returns logger with values to correlate log lines with the admission request.
+// pod may be nil when request.object has not been decoded yet.
+func requestLogger(reviewRequest *admissionv1.AdmissionRequest, pod *corev1.Pod) logr.Logger {
+	name := reviewRequest.Name
+	if pod != nil {
+		name = pod.Name
+		if name == "" && pod.GenerateName != "" {
+			name = pod.GenerateName + "*"
+		}
+	}
+	dryRun := reviewRequest.DryRun != nil && *reviewRequest.DryRun
+	return logger.WithValues(
+		"uid", reviewRequest.UID,
+		"namespace", reviewRequest.Namespace,
+		"pod", name,
+		"user", reviewRequest.UserInfo.Username,
+		"dryRun", dryRun,
+	)
+}
+
+// fatal logs err and exits with non-zero status.
+func fatal(err error, msg string, keysAndValues ...interface{}) {
+	logger.Error(err, msg, keysAndValues...)
+	os.Exit(1)
+}
+
+func logLevelNames() string {
+	names := make([]string, 0, len(logLevels))
+	for name := range logLevels {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return logLevels[names[i]] < logLevels[names[j]] })
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func TestRequestLogger(t *testing.T) {
+	defer func(l logr.Logger) { logger = l }(logger)
+	buf := &bytes.Buffer{}
+	logger = newLogger(buf, logFormatJSON, 0)
+
+	pod := prepareBasicPod()
+	pod.Name = ""
+	pod.GenerateName = "nginx-6d4cf56db6-"
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): "not JSON",
+	}
+	_, err := doMutate(pod)
+	if err != nil {
+		t.Fatal("failed to call mutate", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	found := false
+	for _, line := range lines {
+		var entry map[string]interface{}
+		err = json.Unmarshal(([]byte)(line), &entry)
+		if err != nil {
+			t.Fatalf("log line is not JSON: %s", line)
+		}
+		if entry["annotation"] != config.AnnotationKey(annotationNamePodAntiAffinityHard) {
+			continue
+		}
+		found = true
+		if uid, _ := entry["uid"].(string); uid == "" {
+			t.Error("uid not logged", line)
+		}
+		if entry["namespace"] != "default" {
+			t.Error("unexpected namespace", line)
+		}
+		if entry["pod"] != "nginx-6d4cf56db6-*" {
+			t.Error("unexpected pod", line)
+		}
+		if entry["user"] != "system:serviceaccount:kube-system:replicaset-controller" {
+			t.Error("unexpected user", line)
+		}
+		if entry["dryRun"] != false {
+			t.Error("unexpected dryRun", line)
+		}
+	}
+	if !found {
+		t.Error("annotation error not logged", buf.String())
+	}
+}
+
+func TestRequestLoggerAllLines(t *testing.T) {
+	defer func(l logr.Logger) { logger = l }(logger)
+	buf := &bytes.Buffer{}
+	logger = newLogger(buf, logFormatJSON, logLevels["trace"])
+
+	// broken provenance is logged by the expander
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx", "pod-template-hash": "abcdef"}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}]`,
+		config.AnnotationKey(annotationNameInjected):            "not JSON",
+	}
+	_, err := doMutate(pod)
+	if err != nil {
+		t.Fatal("failed to call mutate", err)
+	}
+	// write failure is logged by writeReview
+	reqReview, err := newPodReview(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeReview(failingResponseWriter{httptest.NewRecorder()}, reqReview, &admissionv1.AdmissionResponse{UID: reqReview.Request.UID}, requestLogger(reqReview.Request, pod))
+	if err == nil {
+		t.Fatal("write failure should be returned")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	messages := make(map[string]bool)
+	for _, line := range lines {
+		var entry map[string]interface{}
+		err = json.Unmarshal(([]byte)(line), &entry)
+		if err != nil {
+			t.Fatalf("log line is not JSON: %s", line)
+		}
+		messages[entry["msg"].(string)] = true
+		for _, key := range []string{"uid", "namespace", "pod", "user", "dryRun"} {
+			if _, exists := entry[key]; !exists {
+				t.Errorf("%s not logged: %s", key, line)
+			}
+		}
+	}
+	for _, msg := range []string{"ignore broken provenance annotation", "failed to write response"} {
+		if !messages[msg] {
+			t.Errorf("%q not logged: %s", msg, buf.String())
+		}
+	}
+}
+
+// failingResponseWriter fails to write the body.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingResponseWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestLoggerVerbosity(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := newLogger(buf, logFormatText, logLevels["info"])
+	l.V(1).Info("debug message")
+	l.Info("info message")
+
+	if strings.Contains(buf.String(), "debug message") {
+		t.Error("debug message should be suppressed at info level", buf.String())
+	}
+	if !strings.Contains(buf.String(), "info message") {
+		t.Error("info message should be logged", buf.String())
+	}
+}
@@ -1,69 +1,195 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
 )
 
 const (
-	httpHeaderKeyContentType               = "content-type"
-	mimeTypeApplicationJson                = "application/json"
-	annotationKeyPodAffinitySoft           = "kep-3633-alt.10h.in/podAffinity.preferredDuringSchedulingIgnoredDuringExecution"
-	annotationKeyPodAffinityHard           = "kep-3633-alt.10h.in/podAffinity.requiredDuringSchedulingIgnoredDuringExecution"
-	annotationKeyPodAntiAffinitySoft       = "kep-3633-alt.10h.in/podAntiAffinity.preferredDuringSchedulingIgnoredDuringExecution"
-	annotationKeyPodAntiAffinityHard       = "kep-3633-alt.10h.in/podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution"
-	annotationKeyTopologySpreadConstraints = "kep-3633-alt.10h.in/topologySpreadConstraints"
+	httpHeaderKeyContentType                = "content-type"
+	mimeTypeApplicationJson                 = "application/json"
+	annotationNamePodAffinitySoft           = kep3633.AnnotationNamePodAffinitySoft
+	annotationNamePodAffinityHard           = kep3633.AnnotationNamePodAffinityHard
+	annotationNamePodAntiAffinitySoft       = kep3633.AnnotationNamePodAntiAffinitySoft
+	annotationNamePodAntiAffinityHard       = kep3633.AnnotationNamePodAntiAffinityHard
+	annotationNameTopologySpreadConstraints = kep3633.AnnotationNameTopologySpreadConstraints
+	annotationNameStrictLabelKeys           = kep3633.AnnotationNameStrictLabelKeys
+	annotationNameMissingLabelKeys          = kep3633.AnnotationNameMissingLabelKeys
+	annotationNameInjected                  = kep3633.AnnotationNameInjected
+	pathStrict                              = "/strict"
+	userErrorPolicyDeny                     = "deny"
+	userErrorPolicyWarn                     = "warn"
+	duplicateTermPolicySkip                 = string(kep3633.DuplicateTermPolicySkip)
+	duplicateTermPolicyMerge                = string(kep3633.DuplicateTermPolicyMerge)
 )
 
 var (
-	disableTLS = flag.Bool("disable-tls", false, "Disables")
-	podsv1GVR  = metav1.GroupVersionResource{
+	config    = defaultConfig()
+	podsv1GVR = metav1.GroupVersionResource{
 		Group:    "",
 		Version:  "v1",
 		Resource: "pods",
 	}
+	podsv1GR = schema.GroupResource{
+		Group:    "",
+		Resource: "pods",
+	}
 	patchTypeJSONPatch = admissionv1.PatchTypeJSONPatch
+	ready              atomic.Bool
+	// events records Kubernetes Events if enabled; nil otherwise
+	events *eventRecorder
 )
 
 func main() {
-	flag.Parse()
-	log.Println("start application...")
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		}
+	}
+
+	var err error
+	config, err = loadConfig(os.Args[0], os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fatal(err, "failed to load configuration")
+	}
+	logger = newLogger(os.Stderr, config.LogFormat, logLevels[config.LogLevel])
+	logger.Info("start application...")
+
+	if config.EnableEvents {
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			fatal(err, "failed to load in-cluster configuration to publish events")
+		}
+		client, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			fatal(err, "failed to create Kubernetes client to publish events")
+		}
+		var stopEvents func()
+		events, stopEvents = newEventRecorder(client)
+		defer stopEvents()
+	}
 
 	router := http.NewServeMux()
 	router.HandleFunc("/", mutate)
+	router.HandleFunc(pathStrict, mutate)
 	router.HandleFunc("/healthz", health)
+	router.HandleFunc("/readyz", readiness)
 
-	var addr string
-	if *disableTLS {
-		addr = ":8080"
-		log.Println("TLS disabled; listen address:", addr)
+	var metricsServer *http.Server
+	if config.MetricsAddress == "" {
+		router.Handle("/metrics", metricsHandler())
 	} else {
-		addr = ":8443"
-		log.Println("TLS enabled; listen address:", addr)
+		metricsRouter := http.NewServeMux()
+		metricsRouter.Handle("/metrics", metricsHandler())
+		metricsServer = &http.Server{
+			Addr:         config.MetricsAddress,
+			Handler:      metricsRouter,
+			ReadTimeout:  config.ReadTimeout.Duration,
+			WriteTimeout: config.WriteTimeout.Duration,
+		}
 	}
+
+	addr := config.Addr()
 	server := serverWrapper{
 		Server: http.Server{
 			Addr:         addr,
 			Handler:      router,
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
+			ReadTimeout:  config.ReadTimeout.Duration,
+			WriteTimeout: config.WriteTimeout.Duration,
 		},
-		EnableTLS: !*disableTLS,
-		CertFile:  "/certs/tls.crt",
-		KeyFile:   "/certs/tls.key",
+		EnableTLS: !config.DisableTLS,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	if server.EnableTLS {
+		watcher, err := newCertWatcher(config.CertFile, config.KeyFile)
+		if err != nil {
+			fatal(err, "failed to load certificate")
+		}
+		go func() {
+			err := watcher.Watch(ctx)
+			if err != nil {
+				logger.Error(err, "certificate reloading stopped")
+			}
+		}()
+		server.CertWatcher = watcher
+		registerCertificateExpiry(watcher)
+	}
+
+	if metricsServer != nil {
+		logger.Info("start metrics server", "addr", metricsServer.Addr)
+		go func() {
+			err := metricsServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				logger.Error(err, "metrics server stopped")
+			}
+		}()
+	}
+
+	logger.Info("start server", "addr", addr, "tls", server.EnableTLS)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	ready.Store(true)
+
+	select {
+	case err := <-serveErr:
+		fatal(err, "server stopped")
+	case <-ctx.Done():
+	}
+	// restore default behavior, so that second signal kills immediately
+	stop()
+
+	logger.Info("shutdown requested; draining connections")
+	err = drain(&server, config.PreStopDelay.Duration, config.ShutdownTimeout.Duration)
+	if metricsServer != nil {
+		_ = metricsServer.Close()
 	}
-	log.Println("start server", addr)
-	log.Fatal(server.ListenAndServe())
+	if err != nil {
+		fatal(err, "failed to drain connections")
+	}
+	logger.Info("all connections drained; exit")
+}
+
+// drain fails readiness, waits preStopDelay for endpoints to be updated,
+// then shuts down the server waiting for in-flight requests up to timeout.
+func drain(server *serverWrapper, preStopDelay, timeout time.Duration) error {
+	ready.Store(false)
+	time.Sleep(preStopDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return server.Shutdown(ctx)
 }
 
 func health(resp http.ResponseWriter, req *http.Request) {
@@ -75,8 +201,23 @@ func health(resp http.ResponseWriter, req *http.Request) {
 	_, _ = resp.Write(([]byte)("{\"status\":\"UP\"}"))
 }
 
+func readiness(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !ready.Load() {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = resp.Write(([]byte)("{\"status\":\"OUT_OF_SERVICE\"}"))
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	_, _ = resp.Write(([]byte)("{\"status\":\"UP\"}"))
+}
+
 func mutate(resp http.ResponseWriter, req *http.Request) {
-	var err error
+	timer := prometheus.NewTimer(mutateDuration)
+	defer timer.ObserveDuration()
 
 	// HTTP request method validation
 	if req.Method != http.MethodPost {
@@ -86,148 +227,169 @@ func mutate(resp http.ResponseWriter, req *http.Request) {
 
 	// Application level request content validation and parsing
 
-	// cluster admin level (i.e. webhook configuration level) validation and input extraction
-	// When error found, response with error (4xx or 5xx)
+	// HTTP level validation of AdmissionReview itself
+	// When error found, response with error (4xx or 5xx), because no AdmissionResponse can be formed.
 
 	reqReview, clientErr, serverErr, errorMsg := validateExtractRequestReview(req.Body)
 	if clientErr != nil {
-		panic(handleClientError(resp, clientErr, errorMsg))
+		handleClientError(resp, clientErr, errorMsg, logger)
+		admissionRequestsTotal.WithLabelValues("", admissionResultError).Inc()
+		return
 	}
 	if serverErr != nil {
-		panic(handleServerError(resp, serverErr, errorMsg))
+		handleServerError(resp, serverErr, errorMsg, logger)
+		admissionRequestsTotal.WithLabelValues("", admissionResultError).Inc()
+		return
 	}
 
-	reviewRequest := reqReview.Request
-	reqObject, clientErr, serverErr, errorMsg := validateExtractRequestPod(reviewRequest)
-	if clientErr != nil {
-		panic(handleClientError(resp, clientErr, errorMsg))
-	}
-	if serverErr != nil {
-		panic(handleServerError(resp, serverErr, errorMsg))
+	// the pod is decoded only to name it in logs; admitPod denies requests whose object is not a pod
+	pod, _ := validateExtractRequestPod(reqReview.Request)
+	reqLogger := requestLogger(reqReview.Request, pod)
+	operation := string(reqReview.Request.Operation)
+	reviewResponse, err := admitPod(reqReview.Request, req.URL.Path == pathStrict)
+	if err != nil {
+		handleServerError(resp, err, "failed to review request", reqLogger)
+		admissionRequestsTotal.WithLabelValues(operation, admissionResultError).Inc()
+		return
 	}
 
-	// cluster user level (i.e. request manifest level) validation and input extraction
-	// When error found, response with OK (200), but notify error without HTTP response.
-	// (for example: annotate pod with error message)
+	// do response
 
-	labels := reqObject.GetLabels()
-	annotations := reqObject.GetAnnotations()
+	err = writeReview(resp, reqReview, reviewResponse, reqLogger)
+	if err != nil {
+		admissionRequestsTotal.WithLabelValues(operation, admissionResultError).Inc()
+		return
+	}
+	admissionRequestsTotal.WithLabelValues(operation, admissionResult(reviewResponse)).Inc()
+}
 
-	needPatch := false
-	var exists bool
+// admitPod reviews the pod in reviewRequest and builds the AdmissionResponse.
+// When strictLabelKeys is true, pods with label keys missing in its labels are denied regardless of the pod annotation.
+// Events and metrics counters of mutations are not updated for dry-run requests, as the pod is never persisted;
+// request counts and latency are still observed.
+// Returned error means internal failure, which should be responded with 500.
+func admitPod(reviewRequest *admissionv1.AdmissionRequest, strictLabelKeys bool) (*admissionv1.AdmissionResponse, error) {
+	var err error
 
-	hardPodAffinitySource, exists := annotations[annotationKeyPodAffinityHard]
-	var hardAffinitiesAppending []corev1.PodAffinityTerm
-	if exists {
-		needPatch = true
-		hardAffinitiesAppending, err = createHardAffinitiesAppending(hardPodAffinitySource, labels)
-		if err != nil {
-			// TODO: annotate pod with error message or publish events
-			log.Printf("failed to create PodAffinityTerm: %#v", err)
-			return
-		}
-	} else {
-		hardAffinitiesAppending = make([]corev1.PodAffinityTerm, 0, 0)
-	}
+	// cluster admin level (i.e. webhook configuration level) validation and input extraction
+	// When error found, response with OK (200) and an AdmissionResponse which denies the request
+	// with the status code and reason in its result.
 
-	var softAffinitiesAppending []corev1.WeightedPodAffinityTerm
-	softPodAffinitySource, exists := annotations[annotationKeyPodAffinitySoft]
-	if exists {
-		needPatch = true
-		softAffinitiesAppending, err = createSoftAffinitiesAppending(softPodAffinitySource, labels)
-		if err != nil {
-			// TODO: annotate pod with error message or publish events
-			log.Printf("failed to create WeightedPodAffinityTerm: %#v", err)
-			return
-		}
-	} else {
-		softAffinitiesAppending = make([]corev1.WeightedPodAffinityTerm, 0, 0)
+	statusErr := validateReviewRequest(reviewRequest)
+	if statusErr != nil {
+		requestLogger(reviewRequest, nil).Info("deny review request", "reason", statusErr.ErrStatus.Reason, "message", statusErr.Error())
+		return deniedResponse(reviewRequest.UID, statusErr), nil
 	}
 
-	var hardAntiAffinitiesAppending []corev1.PodAffinityTerm
-	hardPodAntiAffinitySource, exists := annotations[annotationKeyPodAntiAffinityHard]
-	if exists {
-		needPatch = true
-		hardAntiAffinitiesAppending, err = createHardAffinitiesAppending(hardPodAntiAffinitySource, labels)
-		if err != nil {
-			// TODO: annotate pod with error message or publish events
-			log.Printf("failed to create PodAffinityTerm: %#v", err)
-			return
-		}
-	} else {
-		hardAntiAffinitiesAppending = make([]corev1.PodAffinityTerm, 0, 0)
+	reqObject, statusErr := validateExtractRequestPod(reviewRequest)
+	if statusErr != nil {
+		requestLogger(reviewRequest, nil).Info("deny review request", "reason", statusErr.ErrStatus.Reason, "message", statusErr.Error())
+		return deniedResponse(reviewRequest.UID, statusErr), nil
 	}
 
-	var softAntiAffinitiesAppending []corev1.WeightedPodAffinityTerm
-	softPodAntiAffinitySource, exists := annotations[annotationKeyPodAntiAffinitySoft]
-	if exists {
-		needPatch = true
-		softAntiAffinitiesAppending, err = createSoftAffinitiesAppending(softPodAntiAffinitySource, labels)
-		if err != nil {
-			// TODO: annotate pod with error message or publish events
-			log.Printf("failed to create WeightedPodAffinityTerm: %#v", err)
-			return
-		}
-	} else {
-		softAntiAffinitiesAppending = make([]corev1.WeightedPodAffinityTerm, 0, 0)
-	}
+	reqLogger := requestLogger(reviewRequest, reqObject)
+	dryRun := reviewRequest.DryRun != nil && *reviewRequest.DryRun
 
-	var topologySpreadConstraintsAppending []corev1.TopologySpreadConstraint
-	topologySpreadConstraintsSource, exists := annotations[annotationKeyTopologySpreadConstraints]
-	if exists {
-		needPatch = true
-		topologySpreadConstraintsAppending, err = createTopologySpreadConstraintsAppending(topologySpreadConstraintsSource, labels)
-		if err != nil {
-			// TODO: annotate pod with error message or publish events
-			log.Printf("failed to create TopologySpreadConstraint: %#V", err)
-			return
-		}
-	} else {
-		topologySpreadConstraintsAppending = make([]corev1.TopologySpreadConstraint, 0, 0)
+	// cluster user level (i.e. request manifest level) validation and input extraction
+	// When error found, response with OK (200) and an AdmissionResponse which denies the pod
+	// or admits it unchanged with warnings, according to userErrorPolicy.
+	// The decision is shared with package ctrlwebhook through kep3633.Expander.Admit.
+
+	a, err := newExpander(reqLogger).Admit(reviewRequest.Object.Raw, reqObject, kep3633.AdmissionOptions{
+		StrictLabelKeys: strictLabelKeys,
+		WarnOnUserError: config.UserErrorPolicy == userErrorPolicyWarn,
+	}, reqLogger)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		observeAdmission(reqObject, a)
 	}
 
 	// create response content
 
-	respReview := admissionv1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: reqReview.APIVersion,
-			Kind:       reqReview.Kind,
-		},
-		Response: &admissionv1.AdmissionResponse{
-			Allowed: true,
-			UID:     reviewRequest.UID,
-		},
+	if a.Denied != nil {
+		return deniedResponse(reviewRequest.UID, a.Denied), nil
+	}
+	reviewResponse := &admissionv1.AdmissionResponse{
+		Allowed:          true,
+		UID:              reviewRequest.UID,
+		Warnings:         a.Warnings,
+		AuditAnnotations: a.AuditAnnotations,
+	}
+	if a.Patch != nil {
+		reviewResponse.PatchType = &patchTypeJSONPatch
+		reviewResponse.Patch = a.Patch
 	}
 
-	if needPatch {
-		podAffinityPatch := createAffinityJSONPatch(reqObject, hardAffinitiesAppending, softAffinitiesAppending, hardAntiAffinitiesAppending, softAntiAffinitiesAppending)
-		topologySpreadPatch := createTopologySpreadConstraintsJSONPatch(reqObject, topologySpreadConstraintsAppending)
-		patch := append(podAffinityPatch, topologySpreadPatch...)
+	reqLogger.V(1).Info("admit pod", "patched", reviewResponse.Patch != nil, "dryRun", dryRun)
+	reqLogger.V(2).Info("JSON patch", "patch", string(reviewResponse.Patch))
+	return reviewResponse, nil
+}
 
-		var patchBytes []byte
-		patchBytes, err = json.Marshal(patch)
-		if err != nil {
-			// TODO: return 500
+// observeAdmission updates metrics counters and records events of the decision a on pod.
+func observeAdmission(pod *corev1.Pod, a *kep3633.Admission) {
+	if a.AnnotationError != nil {
+		annotationParseFailuresTotal.WithLabelValues(a.AnnotationError.Annotation).Inc()
+		// a failure already recorded in the status annotation was reported by the invocation which recorded it
+		if events != nil && !a.FailureRecorded {
+			events.AnnotationFailed(pod, a.AnnotationError, !a.Allowed)
 		}
+		return
+	}
+	for kind, change := range a.Result.Changes {
+		observeMissingLabelKeys(kind, change.MissingLabelKeys)
+	}
+	// already mutated pods have no patch; events were recorded by the invocation which injected the terms
+	if a.Patch == nil {
+		return
+	}
+	for kind, change := range a.Result.Changes {
+		injectedTermsTotal.WithLabelValues(kind).Add(float64(len(change.Injected)))
+	}
+	if events != nil {
+		events.Injected(pod, a.Result)
+	}
+}
+
+// newExpander returns kep3633.Expander configured by config, logging with reqLogger.
+func newExpander(reqLogger logr.Logger) *kep3633.Expander {
+	return kep3633.NewExpander(kep3633.Options{
+		AnnotationPrefix:    config.AnnotationPrefix,
+		DuplicateTermPolicy: kep3633.DuplicateTermPolicy(config.DuplicateTermPolicy),
+		FeatureGates:        config.FeatureGates,
+		Logger:              reqLogger,
+	})
+}
 
-		respReview.Response.PatchType = &patchTypeJSONPatch
-		respReview.Response.Patch = patchBytes
+// deniedResponse builds the AdmissionResponse which denies the request with the code, reason and message of statusErr.
+func deniedResponse(uid types.UID, statusErr *apierrors.StatusError) *admissionv1.AdmissionResponse {
+	status := statusErr.Status()
+	return &admissionv1.AdmissionResponse{
+		UID:     uid,
+		Allowed: false,
+		Result:  &status,
 	}
+}
 
-	var respBytes []byte
-	respBytes, err = json.Marshal(respReview)
+// writeReview wraps reviewResponse into an AdmissionReview of the same apiVersion as reqReview and writes it.
+// Returned error means the review could not be sent and error response has been written instead;
+// failures are logged with reqLogger.
+func writeReview(resp http.ResponseWriter, reqReview *admissionv1.AdmissionReview, reviewResponse *admissionv1.AdmissionResponse, reqLogger logr.Logger) error {
+	respBytes, err := encodeAdmissionReview(reqReview.APIVersion, reviewResponse)
 	if err != nil {
-		// TODO: return 500
+		handleServerError(resp, err, "failed to marshal AdmissionReview", reqLogger)
+		return err
 	}
 
-	// do response
-
+	resp.Header().Set(httpHeaderKeyContentType, mimeTypeApplicationJson)
 	resp.WriteHeader(http.StatusOK)
 	_, err = resp.Write(respBytes)
 	if err != nil {
-		log.Printf("failed to write response: %#v", err)
+		reqLogger.Error(err, "failed to write response")
+		return err
 	}
-
+	return nil
 }
 
 func validateExtractRequestReview(reqBody io.Reader) (reqReview *admissionv1.AdmissionReview, clientErr, serverErr error, errorMessage string) {
@@ -236,8 +398,7 @@ func validateExtractRequestReview(reqBody io.Reader) (reqReview *admissionv1.Adm
 		return nil, nil, err, "invalid request: failed to read body"
 	}
 
-	reqReview = &admissionv1.AdmissionReview{}
-	err = json.Unmarshal(bodyBytes, reqReview)
+	reqReview, err = decodeAdmissionReview(bodyBytes)
 	if err != nil {
 		return nil, err, nil, "invalid request: failed to unmarshal request body"
 	}
@@ -245,416 +406,101 @@ func validateExtractRequestReview(reqBody io.Reader) (reqReview *admissionv1.Adm
 	reviewRequest := reqReview.Request
 	if reviewRequest == nil {
 		err = fmt.Errorf("request does not contain \"request\" field")
-		return nil, err, nil, ""
+		return nil, err, nil, "invalid request"
 	}
 
+	return reqReview, nil, nil, ""
+}
+
+func validateReviewRequest(reviewRequest *admissionv1.AdmissionRequest) *apierrors.StatusError {
 	if reviewRequest.Operation != admissionv1.Create {
-		err = fmt.Errorf("handle CREATE operation only")
-		return nil, err, nil, ""
+		return apierrors.NewMethodNotSupported(podsv1GR, string(reviewRequest.Operation))
 	}
 
 	if reviewRequest.Resource != podsv1GVR {
-		err = fmt.Errorf("accept only core/v1/pods")
-		return nil, err, nil, ""
+		return apierrors.NewBadRequest(fmt.Sprintf("resource %s is not supported; accept only core/v1/pods", reviewRequest.Resource.String()))
 	}
 
 	if reviewRequest.SubResource != "" {
-		err = fmt.Errorf("accept only core/v1/pods itself, not subresources")
-		return nil, err, nil, ""
+		return apierrors.NewBadRequest(fmt.Sprintf("subresource %q is not supported; accept only core/v1/pods itself", reviewRequest.SubResource))
 	}
 
-	return reqReview, nil, nil, ""
+	return nil
 }
 
-func validateExtractRequestPod(reviewRequest *admissionv1.AdmissionRequest) (reqPod *corev1.Pod, clientErr, serverErr error, errorMessage string) {
+func validateExtractRequestPod(reviewRequest *admissionv1.AdmissionRequest) (*corev1.Pod, *apierrors.StatusError) {
 	reqObject := &corev1.Pod{}
-	clientErr = json.Unmarshal(reviewRequest.Object.Raw, reqObject)
-	if clientErr != nil {
-		return nil, clientErr, nil, "failed to unmarshal request.object as core/v1/pods"
-	}
-
-	return reqObject, nil, nil, ""
-}
-
-func createHardAffinitiesAppending(source string, labels map[string]string) ([]corev1.PodAffinityTerm, error) {
-	var hardAffinities []KEP3633PodAffinityTerm
-	err := json.Unmarshal(([]byte)(source), &hardAffinities)
-	if err != nil {
-		return nil, err
-	}
-	hardAffinitiesAppending := make([]corev1.PodAffinityTerm, 0, len(hardAffinities))
-	for _, kep3633term := range hardAffinities {
-		term := *(kep3633term.PodAffinityTerm.DeepCopy())
-		labelSelector := term.LabelSelector
-		if labelSelector == nil {
-			labelSelector = &metav1.LabelSelector{}
-		}
-		matchExp := labelSelector.MatchExpressions
-		if matchExp == nil {
-			matchExp = make([]metav1.LabelSelectorRequirement, 0, len(kep3633term.MatchLabelKeys))
-		}
-		for _, k := range kep3633term.MatchLabelKeys {
-			requirement := matchLabelKeyToRequirement(k, labels)
-			if requirement != nil {
-				matchExp = append(matchExp, *requirement)
-			}
-		}
-		for _, k := range kep3633term.MismatchLabelKeys {
-			requirement := mismatchLabelKeyToRequirement(k, labels)
-			if requirement != nil {
-				matchExp = append(matchExp, *requirement)
-			}
-		}
-		labelSelector.MatchExpressions = matchExp
-		term.LabelSelector = labelSelector
-		hardAffinitiesAppending = append(hardAffinitiesAppending, term)
-	}
-	return hardAffinitiesAppending, nil
-}
-
-func createSoftAffinitiesAppending(source string, labels map[string]string) ([]corev1.WeightedPodAffinityTerm, error) {
-	var softAffinities []KEP3633WeightedPodAffinityTerm
-	err := json.Unmarshal(([]byte)(source), &softAffinities)
-	if err != nil {
-		return nil, err
-	}
-	softAffinitiesAppending := make([]corev1.WeightedPodAffinityTerm, 0, len(softAffinities))
-	for _, kep3633WeightedTerm := range softAffinities {
-		weightedTerm := *(kep3633WeightedTerm.WeightedPodAffinityTerm.DeepCopy())
-		weightedTerm.PodAffinityTerm = *(kep3633WeightedTerm.PodAffinityTerm.PodAffinityTerm.DeepCopy())
-		labelSelector := weightedTerm.PodAffinityTerm.LabelSelector
-		if labelSelector == nil {
-			labelSelector = &metav1.LabelSelector{}
-		}
-		matchExp := labelSelector.MatchExpressions
-		if matchExp == nil {
-			matchExp = make([]metav1.LabelSelectorRequirement, 0, len(kep3633WeightedTerm.PodAffinityTerm.MatchLabelKeys))
-		}
-		for _, k := range kep3633WeightedTerm.PodAffinityTerm.MatchLabelKeys {
-			requirement := matchLabelKeyToRequirement(k, labels)
-			if requirement != nil {
-				matchExp = append(matchExp, *requirement)
-			}
-		}
-		for _, k := range kep3633WeightedTerm.PodAffinityTerm.MismatchLabelKeys {
-			requirement := mismatchLabelKeyToRequirement(k, labels)
-			if requirement != nil {
-				matchExp = append(matchExp, *requirement)
-			}
-		}
-		labelSelector.MatchExpressions = matchExp
-		weightedTerm.PodAffinityTerm.LabelSelector = labelSelector
-		softAffinitiesAppending = append(softAffinitiesAppending, weightedTerm)
-	}
-	return softAffinitiesAppending, nil
-}
-
-func createTopologySpreadConstraintsAppending(source string, labels map[string]string) ([]corev1.TopologySpreadConstraint, error) {
-	var constraints []corev1.TopologySpreadConstraint
-	err := json.Unmarshal(([]byte)(source), &constraints)
+	err := json.Unmarshal(reviewRequest.Object.Raw, reqObject)
 	if err != nil {
-		return nil, err
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("failed to unmarshal request.object as core/v1/pods: %v", err))
 	}
 
-	constraintsAppending := make([]corev1.TopologySpreadConstraint, 0, len(constraints))
-	for _, constraint := range constraints {
-		constraintAppending := *constraint.DeepCopy()
-		constraintAppending.MatchLabelKeys = nil
-		labelSelector := constraintAppending.LabelSelector
-		if labelSelector == nil {
-			labelSelector = &metav1.LabelSelector{}
-			constraintAppending.LabelSelector = labelSelector
-		}
-		matchExp := labelSelector.MatchExpressions
-		if matchExp == nil {
-			matchExp = make([]metav1.LabelSelectorRequirement, 0, len(constraint.MatchLabelKeys))
-		}
-		for _, matchLabelKey := range constraint.MatchLabelKeys {
-			requirement := matchLabelKeyToRequirement(matchLabelKey, labels)
-			if requirement != nil {
-				matchExp = append(matchExp, *requirement)
-			}
-		}
-		constraintsAppending = append(constraintsAppending, constraintAppending)
-	}
-	return constraintsAppending, nil
+	return reqObject, nil
 }
 
-func matchLabelKeyToRequirement(matchLabelKey string, labels map[string]string) *metav1.LabelSelectorRequirement {
-	v, exists := labels[matchLabelKey]
-	if exists {
-		return &metav1.LabelSelectorRequirement{
-			Key:      matchLabelKey,
-			Operator: metav1.LabelSelectorOpIn,
-			Values:   []string{v},
-		}
-	} else {
-		// In KEP 3243, matchLabelKeys introduced, clearly describes:
-		// "If the key does not exist, the element won't be ignored"
-		// (I think "won't be ignored" must be wrong and "won't be appended")
-		// https://docs.google.com/document/d/12F1YXsvy4SmumPiL3LHMLnuMHvyMqSzDqF-L9J37ZfA/edit?usp=sharing
-		return nil
-	}
+// handleClientError logs and responds respError with 400.
+// reqLogger is the request logger if the review has been decoded, or the global logger otherwise.
+func handleClientError(resp http.ResponseWriter, respError error, msg string, reqLogger logr.Logger) {
+	reqLogger.Info("reject invalid request", "message", msg, "error", respError.Error())
+	writeErrorBody(resp, http.StatusBadRequest, respError, msg, reqLogger)
 }
 
-func mismatchLabelKeyToRequirement(matchLabelKey string, labels map[string]string) *metav1.LabelSelectorRequirement {
-	v, exists := labels[matchLabelKey]
-	if exists {
-		return &metav1.LabelSelectorRequirement{
-			Key:      matchLabelKey,
-			Operator: metav1.LabelSelectorOpNotIn,
-			Values:   []string{v},
-		}
-	} else {
-		// In KEP 3243, matchLabelKeys introduced, clearly describes:
-		// "If the key does not exist, the element won't be ignored"
-		// (I think "won't be ignored" must be wrong and "won't be appended")
-		// https://docs.google.com/document/d/12F1YXsvy4SmumPiL3LHMLnuMHvyMqSzDqF-L9J37ZfA/edit?usp=sharing
-		return nil
-	}
+// handleServerError logs and responds respError with 500.
+// reqLogger is the request logger if the review has been decoded, or the global logger otherwise.
+func handleServerError(resp http.ResponseWriter, respError error, msg string, reqLogger logr.Logger) {
+	reqLogger.Error(respError, msg)
+	writeErrorBody(resp, http.StatusInternalServerError, respError, msg, reqLogger)
 }
 
-func createAffinityJSONPatch(reqObject *corev1.Pod, hardAffinitiesAppending []corev1.PodAffinityTerm, softAffinitiesAppending []corev1.WeightedPodAffinityTerm, hardAntiAffinitiesAppending []corev1.PodAffinityTerm, softAntiAffinitiesAppending []corev1.WeightedPodAffinityTerm) (patch []map[string]interface{}) {
-
-	hardAffinitiesNeeded := hardAffinitiesAppending != nil && len(hardAffinitiesAppending) > 0
-	softAffinitiesNeeded := softAffinitiesAppending != nil && len(softAffinitiesAppending) > 0
-	hardAntiAffinitiesNeeded := hardAntiAffinitiesAppending != nil && len(hardAntiAffinitiesAppending) > 0
-	softAntiAffinitiesNeeded := softAntiAffinitiesAppending != nil && len(softAntiAffinitiesAppending) > 0
-
-	podAffinitiesNeeded := hardAffinitiesNeeded || softAffinitiesNeeded
-	podAntiAffinitiesNeeded := hardAntiAffinitiesNeeded || softAntiAffinitiesNeeded
-
-	affinitiesNeeded := podAffinitiesNeeded || podAntiAffinitiesNeeded
-
-	patch = make([]map[string]interface{}, 0)
-
-	var affinityField = reqObject.Spec.Affinity
-	var podAffinityField *corev1.PodAffinity
-	var podHardAffinityField []corev1.PodAffinityTerm
-	var podSoftAffinityField []corev1.WeightedPodAffinityTerm
-	var podAntiAffinityField *corev1.PodAntiAffinity
-	var podHardAntiAffinityField []corev1.PodAffinityTerm
-	var podSoftAntiAffinityField []corev1.WeightedPodAffinityTerm
-
-	if affinitiesNeeded {
-		if affinityField != nil {
-			podAffinityField = affinityField.PodAffinity
-			podAntiAffinityField = affinityField.PodAntiAffinity
-		} else {
-			patch = append(patch, map[string]interface{}{
-				"op":    "add",
-				"path":  "/spec/affinity",
-				"value": map[string]interface{}{},
-			})
-		}
-	}
-
-	if podAffinitiesNeeded {
-		if podAffinityField != nil {
-			podHardAffinityField = podAffinityField.RequiredDuringSchedulingIgnoredDuringExecution
-			podSoftAffinityField = podAffinityField.PreferredDuringSchedulingIgnoredDuringExecution
-		} else {
-			patch = append(patch, map[string]interface{}{
-				"op":    "add",
-				"path":  "/spec/affinity/podAffinity",
-				"value": map[string]interface{}{},
-			})
-		}
-	}
-
-	if podAntiAffinitiesNeeded {
-		if podAntiAffinityField != nil {
-			podHardAntiAffinityField = podAntiAffinityField.RequiredDuringSchedulingIgnoredDuringExecution
-			podSoftAntiAffinityField = podAntiAffinityField.PreferredDuringSchedulingIgnoredDuringExecution
-		} else {
-			patch = append(patch, map[string]interface{}{
-				"op":    "add",
-				"path":  "/spec/affinity/podAntiAffinity",
-				"value": map[string]interface{}{},
-			})
-		}
-	}
-
-	if hardAffinitiesNeeded {
-		if hardAffinitiesAppending != nil {
-			if podHardAffinityField == nil {
-				patch = append(patch, map[string]interface{}{
-					"op":    "add",
-					"path":  "/spec/affinity/podAffinity/requiredDuringSchedulingIgnoredDuringExecution",
-					"value": hardAffinitiesAppending,
-				})
-			} else {
-				for _, a := range hardAffinitiesAppending {
-					patch = append(patch, map[string]interface{}{
-						"op":    "add",
-						"path":  "/spec/affinity/podAffinity/requiredDuringSchedulingIgnoredDuringExecution/-",
-						"value": a,
-					})
-				}
-			}
-		}
-	}
-
-	if softAffinitiesNeeded {
-		if podSoftAffinityField == nil {
-			patch = append(patch, map[string]interface{}{
-				"op":    "add",
-				"path":  "/spec/affinity/podAffinity/preferredDuringSchedulingIgnoredDuringExecution",
-				"value": softAffinitiesAppending,
-			})
-		} else {
-			for _, a := range softAffinitiesAppending {
-				patch = append(patch, map[string]interface{}{
-					"op":    "add",
-					"path":  "/spec/affinity/podAffinity/preferredDuringSchedulingIgnoredDuringExecution/-",
-					"value": a,
-				})
-			}
-		}
-	}
-
-	if hardAntiAffinitiesNeeded {
-		if podHardAntiAffinityField == nil {
-			patch = append(patch, map[string]interface{}{
-				"op":    "add",
-				"path":  "/spec/affinity/podAntiAffinity/requiredDuringSchedulingIgnoredDuringExecution",
-				"value": hardAntiAffinitiesAppending,
-			})
-		} else {
-			for _, a := range hardAntiAffinitiesAppending {
-				patch = append(patch, map[string]interface{}{
-					"op":    "add",
-					"path":  "/spec/affinity/podAntiAffinity/requiredDuringSchedulingIgnoredDuringExecution/-",
-					"value": a,
-				})
-			}
-		}
-	}
-
-	if softAntiAffinitiesNeeded {
-		if podSoftAntiAffinityField == nil {
-			patch = append(patch, map[string]interface{}{
-				"op":    "add",
-				"path":  "/spec/affinity/podAntiAffinity/preferredDuringSchedulingIgnoredDuringExecution",
-				"value": softAntiAffinitiesAppending,
-			})
-		} else {
-			for _, a := range softAntiAffinitiesAppending {
-				patch = append(patch, map[string]interface{}{
-					"op":    "add",
-					"path":  "/spec/affinity/podAntiAffinity/preferredDuringSchedulingIgnoredDuringExecution/-",
-					"value": a,
-				})
-			}
-		}
-	}
-
-	return patch
-}
-
-func createTopologySpreadConstraintsJSONPatch(reqObject *corev1.Pod, constraintsAppending []corev1.TopologySpreadConstraint) []map[string]interface{} {
-	patch := make([]map[string]interface{}, 0, 0)
-
-	var topologySpreadConstraintsField = reqObject.Spec.TopologySpreadConstraints
-	if len(constraintsAppending) > 0 {
-		if topologySpreadConstraintsField == nil {
-			patch = append(patch, map[string]interface{}{
-				"op":    "add",
-				"path":  "/spec/topologySpreadConstraints",
-				"value": constraintsAppending,
-			})
-		} else {
-			for _, a := range constraintsAppending {
-				patch = append(patch, map[string]interface{}{
-					"op":    "add",
-					"path":  "/spec/topologySpreadConstraints/-",
-					"value": a,
-				})
-			}
-		}
-	}
-
-	return patch
-}
-
-func handleClientError(resp http.ResponseWriter, respError error, msg string) error {
+func writeErrorBody(resp http.ResponseWriter, statusCode int, respError error, msg string, reqLogger logr.Logger) {
 	bodyBytes, err := json.Marshal(errorBody{
-		Error:   respError,
+		Error:   respError.Error(),
 		Message: msg,
 	})
 	if err != nil {
-		log.Printf("failed to format error to JSON response: %#v; original error: %#v", err, respError)
-		return handleServerError(resp, err, "server failure")
-	}
-	resp.Header().Add(httpHeaderKeyContentType, mimeTypeApplicationJson)
-	resp.WriteHeader(400)
-	_, err = resp.Write(bodyBytes)
-	if err != nil {
-		log.Printf("failed to send error to client: %#v; original error: %#v", err, respError)
-		return err
-	}
-	if len(msg) == 0 {
-		return respError
-	}
-	return fmt.Errorf("%s: %w", msg, respError)
-}
-
-func handleServerError(resp http.ResponseWriter, respError error, msg string) error {
-	bodyBytes, err := json.Marshal(errorBody{
-		Error:   respError,
-		Message: msg,
-	})
-	if err != nil {
-		resp.WriteHeader(500)
+		reqLogger.Error(err, "failed to format error to JSON response", "originalError", respError.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
 		_, _ = resp.Write(([]byte)("server failure"))
-		return err
+		return
 	}
-	resp.Header().Add(httpHeaderKeyContentType, mimeTypeApplicationJson)
-	resp.WriteHeader(400)
+	resp.Header().Set(httpHeaderKeyContentType, mimeTypeApplicationJson)
+	resp.WriteHeader(statusCode)
 	_, err = resp.Write(bodyBytes)
 	if err != nil {
-		log.Printf("failed to send error to client: %#v; original error: %#v", err, respError)
-		return err
-	}
-	if len(msg) == 0 {
-		return respError
+		reqLogger.Error(err, "failed to send error to client", "originalError", respError.Error())
 	}
-	return fmt.Errorf("%s: %w", msg, respError)
 }
 
 type errorBody struct {
-	Error   error  `json:"error,omitempty"`
+	Error   string `json:"error,omitempty"`
 	Message string `json:"message,omitempty"`
 }
 
 type serverWrapper struct {
 	http.Server
-	EnableTLS bool
-	CertFile  string
-	KeyFile   string
+	EnableTLS   bool
+	CertWatcher *certWatcher
 }
 
 func (w *serverWrapper) ListenAndServe() error {
 	if w.EnableTLS {
-		return w.Server.ListenAndServeTLS(w.CertFile, w.KeyFile)
+		w.setupTLSConfig()
+		return w.Server.ListenAndServeTLS("", "")
 	}
 	return w.Server.ListenAndServe()
 }
 
 func (w *serverWrapper) Serve(l net.Listener) error {
 	if w.EnableTLS {
-		return w.Server.ServeTLS(l, w.CertFile, w.KeyFile)
+		w.setupTLSConfig()
+		return w.Server.ServeTLS(l, "", "")
 	}
 	return w.Server.Serve(l)
 }
 
-type KEP3633WeightedPodAffinityTerm struct {
-	corev1.WeightedPodAffinityTerm `json:",inline"`
-	PodAffinityTerm                KEP3633PodAffinityTerm `json:"podAffinityTerm,omitempty"`
-}
-
-type KEP3633PodAffinityTerm struct {
-	corev1.PodAffinityTerm `json:",inline"`
-	MatchLabelKeys         []string `json:"matchLabelKeys,omitempty"`
-	MismatchLabelKeys      []string `json:"mismatchLabelKeys,omitempty"`
+func (w *serverWrapper) setupTLSConfig() {
+	if w.Server.TLSConfig == nil {
+		w.Server.TLSConfig = &tls.Config{}
+	}
+	w.Server.TLSConfig.GetCertificate = w.CertWatcher.GetCertificate
 }
@@ -1,478 +1,855 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	jsonpatch "gopkg.in/evanphx/json-patch.v5"
 
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-)
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 
-const (
-	// testScaleIndex = 1 for normal tests. testScaleIndex = 2 make tests heavy.
-	testScaleIndex = 1
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
 )
 
-type testCreateAffinityJSONPatchCase struct {
-	BeforeHardAffinities        []corev1.PodAffinityTerm
-	BeforeSoftAffinities        []corev1.WeightedPodAffinityTerm
-	BeforeHardAntiAffinities    []corev1.PodAffinityTerm
-	BeforeSoftAntiAffinities    []corev1.WeightedPodAffinityTerm
-	HardAffinitiesAppending     []corev1.PodAffinityTerm
-	SoftAffinitiesAppending     []corev1.WeightedPodAffinityTerm
-	HardAntiAffinitiesAppending []corev1.PodAffinityTerm
-	SoftAntiAffinitiesAppending []corev1.WeightedPodAffinityTerm
+func TestMutateDuplicateTermWarning(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx"}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname"}]`,
+	}
+	pod.Spec.Affinity = &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+				{
+					LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}},
+					TopologyKey:   "kubernetes.io/hostname",
+				},
+			},
+		},
+	}
+
+	respReview, err := doMutate(pod)
+	if err != nil {
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+	warnings := respReview.Response.Warnings
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "skipped") || !strings.Contains(warnings[0], "spec.affinity.podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution[0]") {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+	patchedPod, err := applyPatchDocument(pod, respReview.Response.Patch)
+	if err != nil {
+		t.Fatalf("failed to apply patch: %v", err)
+	}
+	if terms := patchedPod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution; len(terms) != 1 {
+		t.Errorf("duplicate term should not be injected: %#v", terms)
+	}
+
+	// the term written by user should survive reinvocation
+	respReview, err = doMutate(patchedPod)
+	if err != nil {
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+	if respReview.Response.Patch != nil {
+		t.Errorf("reinvocation without changes should admit pod without patch: %s", string(respReview.Response.Patch))
+	}
 }
 
-func TestCreateAffinityJSONPatch(t *testing.T) {
-	testCases := make([]testCreateAffinityJSONPatchCase, 0, 1<<(8*testScaleIndex))
-	for bits := 0; bits < (1 << (8 * testScaleIndex)); bits++ {
-		var size int
-		testCase := testCreateAffinityJSONPatchCase{}
-
-		mask := (1 << (testScaleIndex + 1)) - 1
-		size = (bits >> (0 * testScaleIndex)) & mask
-		testCase.BeforeHardAffinities = make([]corev1.PodAffinityTerm, size, size)
-		for idx := 0; idx < size; idx++ {
-			testCase.BeforeHardAffinities[idx] = corev1.PodAffinityTerm{
-				LabelSelector: &metav1.LabelSelector{
-					MatchLabels: map[string]string{
-						"app": "nginx",
-					},
-				},
-				TopologyKey: fmt.Sprintf("topology.kubernetes.io/host%d", idx),
-			}
-		}
-		size = (bits >> (1 * testScaleIndex)) & mask
-		testCase.BeforeSoftAffinities = make([]corev1.WeightedPodAffinityTerm, size, size)
-		for idx := 0; idx < size; idx++ {
-			testCase.BeforeSoftAffinities[idx] = corev1.WeightedPodAffinityTerm{
-				Weight: 50,
-				PodAffinityTerm: corev1.PodAffinityTerm{
-					LabelSelector: &metav1.LabelSelector{
-						MatchLabels: map[string]string{
-							"app": "nginx",
-						},
-					},
-					TopologyKey: fmt.Sprintf("topology.kubernetes.io/host%d", idx),
-				},
-			}
-		}
-		size = (bits >> (2 * testScaleIndex)) & mask
-		testCase.BeforeHardAntiAffinities = make([]corev1.PodAffinityTerm, size, size)
-		for idx := 0; idx < size; idx++ {
-			testCase.BeforeHardAntiAffinities[idx] = corev1.PodAffinityTerm{
-				LabelSelector: &metav1.LabelSelector{
-					MatchLabels: map[string]string{
-						"app": "nginx",
-					},
-				},
-				TopologyKey: fmt.Sprintf("topology.kubernetes.io/host%d", idx),
-			}
-		}
-		size = (bits >> (3 * testScaleIndex)) & mask
-		testCase.BeforeSoftAntiAffinities = make([]corev1.WeightedPodAffinityTerm, size, size)
-		for idx := 0; idx < size; idx++ {
-			testCase.BeforeSoftAntiAffinities[idx] = corev1.WeightedPodAffinityTerm{
-				Weight: 50,
-				PodAffinityTerm: corev1.PodAffinityTerm{
-					LabelSelector: &metav1.LabelSelector{
-						MatchLabels: map[string]string{
-							"app": "nginx",
-						},
-					},
-					TopologyKey: fmt.Sprintf("topology.kubernetes.io/host%d", idx),
-				},
-			}
-		}
-		size = (bits >> (4 * testScaleIndex)) & mask
-		testCase.HardAffinitiesAppending = make([]corev1.PodAffinityTerm, size, size)
-		for idx := 0; idx < size; idx++ {
-			testCase.HardAffinitiesAppending[idx] = corev1.PodAffinityTerm{
-				LabelSelector: &metav1.LabelSelector{
-					MatchLabels: map[string]string{
-						"app": "nginx",
-					},
-				},
-				TopologyKey: fmt.Sprintf("topology.kubernetes.io/zone%d", idx),
-			}
-		}
-		size = (bits >> (5 * testScaleIndex)) & mask
-		testCase.SoftAffinitiesAppending = make([]corev1.WeightedPodAffinityTerm, size, size)
-		for idx := 0; idx < size; idx++ {
-			testCase.SoftAffinitiesAppending[idx] = corev1.WeightedPodAffinityTerm{
-				Weight: 50,
-				PodAffinityTerm: corev1.PodAffinityTerm{
-					LabelSelector: &metav1.LabelSelector{
-						MatchLabels: map[string]string{
-							"app": "nginx",
-						},
-					},
-					TopologyKey: fmt.Sprintf("topology.kubernetes.io/zone%d", idx),
-				},
-			}
-		}
-		size = (bits >> (6 * testScaleIndex)) & mask
-		testCase.HardAntiAffinitiesAppending = make([]corev1.PodAffinityTerm, size, size)
-		for idx := 0; idx < size; idx++ {
-			testCase.HardAntiAffinitiesAppending[idx] = corev1.PodAffinityTerm{
-				LabelSelector: &metav1.LabelSelector{
-					MatchLabels: map[string]string{
-						"app": "nginx",
-					},
-				},
-				TopologyKey: fmt.Sprintf("topology.kubernetes.io/zone%d", idx),
-			}
-		}
-		size = (bits >> (7 * testScaleIndex)) & mask
-		testCase.SoftAntiAffinitiesAppending = make([]corev1.WeightedPodAffinityTerm, size, size)
-		for idx := 0; idx < size; idx++ {
-			testCase.SoftAntiAffinitiesAppending[idx] = corev1.WeightedPodAffinityTerm{
-				Weight: 50,
-				PodAffinityTerm: corev1.PodAffinityTerm{
-					LabelSelector: &metav1.LabelSelector{
-						MatchLabels: map[string]string{
-							"app": "nginx",
-						},
-					},
-					TopologyKey: fmt.Sprintf("topology.kubernetes.io/zone%d", idx),
-				},
-			}
-		}
-		testCases = append(testCases, testCase)
+type testMutateUserErrorCase struct {
+	Policy          string
+	AnnotationKey   string
+	ExpectedAllowed bool
+}
+
+func TestMutateUserError(t *testing.T) {
+	testCases := make([]testMutateUserErrorCase, 0)
+	for _, annotationKey := range []string{
+		config.AnnotationKey(annotationNamePodAffinityHard),
+		config.AnnotationKey(annotationNamePodAffinitySoft),
+		config.AnnotationKey(annotationNamePodAntiAffinityHard),
+		config.AnnotationKey(annotationNamePodAntiAffinitySoft),
+		config.AnnotationKey(annotationNameTopologySpreadConstraints),
+	} {
+		testCases = append(testCases, testMutateUserErrorCase{
+			Policy:          userErrorPolicyDeny,
+			AnnotationKey:   annotationKey,
+			ExpectedAllowed: false,
+		}, testMutateUserErrorCase{
+			Policy:          userErrorPolicyWarn,
+			AnnotationKey:   annotationKey,
+			ExpectedAllowed: true,
+		})
 	}
 
+	defer func(policy string) { config.UserErrorPolicy = policy }(config.UserErrorPolicy)
+
 	for _, testCase := range testCases {
+		config.UserErrorPolicy = testCase.Policy
+
 		pod := prepareBasicPod()
-		if len(testCase.BeforeHardAffinities) > 0 {
-			if pod.Spec.Affinity == nil {
-				pod.Spec.Affinity = &corev1.Affinity{}
-			}
-			if pod.Spec.Affinity.PodAffinity == nil {
-				pod.Spec.Affinity.PodAffinity = &corev1.PodAffinity{}
-			}
-			pod.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution = testCase.BeforeHardAffinities
-		}
-		if len(testCase.BeforeSoftAffinities) > 0 {
-			if pod.Spec.Affinity == nil {
-				pod.Spec.Affinity = &corev1.Affinity{}
-			}
-			if pod.Spec.Affinity.PodAffinity == nil {
-				pod.Spec.Affinity.PodAffinity = &corev1.PodAffinity{}
-			}
-			pod.Spec.Affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution = testCase.BeforeSoftAffinities
-		}
-		if len(testCase.BeforeHardAntiAffinities) > 0 {
-			if pod.Spec.Affinity == nil {
-				pod.Spec.Affinity = &corev1.Affinity{}
-			}
-			if pod.Spec.Affinity.PodAntiAffinity == nil {
-				pod.Spec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
-			}
-			pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = testCase.BeforeHardAntiAffinities
-		}
-		if len(testCase.BeforeSoftAntiAffinities) > 0 {
-			if pod.Spec.Affinity == nil {
-				pod.Spec.Affinity = &corev1.Affinity{}
-			}
-			if pod.Spec.Affinity.PodAntiAffinity == nil {
-				pod.Spec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
-			}
-			pod.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = testCase.BeforeSoftAntiAffinities
+		pod.Annotations = map[string]string{
+			testCase.AnnotationKey: "[{\"topologyKey\": ",
 		}
 
-		patches := createAffinityJSONPatch(pod, testCase.HardAffinitiesAppending, testCase.SoftAffinitiesAppending, testCase.HardAntiAffinitiesAppending, testCase.SoftAntiAffinitiesAppending)
-
-		patchedPod, err := applyPatch(pod, patches)
+		respReview, err := doMutate(pod)
 		if err != nil {
-			t.Error("failed to patch pod with created JSONPatch", err)
+			t.Error("failed to call mutate", err)
+			continue
 		}
 
-		if len(testCase.BeforeHardAffinities)+len(testCase.HardAffinitiesAppending) > 0 {
-			if !hardAffinityFieldNonNil(patchedPod) {
-				t.Error("/spec/affinity/podAffinity/requiredDuringSchedulingIgnoredDuringExecution field not found")
-			}
-			expectedLen := len(testCase.BeforeHardAffinities) + len(testCase.HardAffinitiesAppending)
-			actualLen := len(patchedPod.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
-			if actualLen != expectedLen {
-				t.Errorf("unexpected pod affinity size: expected: %d, actual: %d", expectedLen, actualLen)
-			}
+		reviewResponse := respReview.Response
+		if reviewResponse == nil {
+			t.Error("response does not contain \"response\" field")
+			continue
+		}
+		if reviewResponse.Allowed != testCase.ExpectedAllowed {
+			t.Errorf("unexpected allowed: policy: %s, expected: %t, actual: %t", testCase.Policy, testCase.ExpectedAllowed, reviewResponse.Allowed)
+		}
+		if !testCase.ExpectedAllowed && reviewResponse.Patch != nil {
+			t.Error("denied pod must not be patched", string(reviewResponse.Patch))
 		}
-		if len(testCase.BeforeSoftAffinities)+len(testCase.SoftAffinitiesAppending) > 0 {
-			if !softAffinityFieldNonNil(patchedPod) {
-				t.Error("/spec/affinity/podAffinity/preferredDuringSchedulingIgnoredDuringExecution field not found")
+		if testCase.ExpectedAllowed {
+			// only the error is recorded in the status annotation
+			patchedPod, err := applyPatchDocument(pod, reviewResponse.Patch)
+			if err != nil {
+				t.Error("failed to apply patch", err)
+				continue
 			}
-			expectedLen := len(testCase.BeforeSoftAffinities) + len(testCase.SoftAffinitiesAppending)
-			actualLen := len(patchedPod.Spec.Affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
-			if actualLen != expectedLen {
-				t.Errorf("unexpected pod affinity size: expected: %d, actual: %d", expectedLen, actualLen)
+			status, err := newExpander(logger).ReadStatus(patchedPod)
+			if err != nil || status == nil || len(status.Sources) != 1 || status.Sources[0].Annotation != testCase.AnnotationKey || status.Sources[0].Error == "" {
+				t.Errorf("error should be recorded in status annotation: %v: %v", err, patchedPod.Annotations)
+			}
+			if patchedPod.Spec.Affinity != nil || len(patchedPod.Spec.TopologySpreadConstraints) != 0 || len(patchedPod.Annotations) != 2 {
+				t.Errorf("pod with broken annotation must not be modified otherwise: %s", string(reviewResponse.Patch))
 			}
 		}
-		if len(testCase.BeforeHardAntiAffinities)+len(testCase.HardAntiAffinitiesAppending) > 0 {
-			if !hardAntiAffinityFieldNonNil(patchedPod) {
-				t.Error("/spec/affinity/podAntiAffinity/requiredDuringSchedulingIgnoredDuringExecution field not found")
+		var msg string
+		if testCase.ExpectedAllowed {
+			if len(reviewResponse.Warnings) != 1 {
+				t.Error("unexpected warnings", reviewResponse.Warnings)
+				continue
 			}
-			expectedLen := len(testCase.BeforeHardAntiAffinities) + len(testCase.HardAntiAffinitiesAppending)
-			actualLen := len(patchedPod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
-			if actualLen != expectedLen {
-				t.Errorf("unexpected pod affinity size: expected: %d, actual: %d", expectedLen, actualLen)
+			msg = reviewResponse.Warnings[0]
+			if !strings.HasSuffix(msg, "; pod admitted; terms not applied") {
+				t.Errorf("warning should tell terms are not applied: %s", msg)
 			}
-		}
-		if len(testCase.BeforeSoftAntiAffinities)+len(testCase.SoftAntiAffinitiesAppending) > 0 {
-			if !softAntiAffinityFieldNonNil(patchedPod) {
-				t.Error("/spec/affinity/podAntiAffinity/preferredDuringSchedulingIgnoredDuringExecution field not found")
+		} else {
+			if reviewResponse.Result == nil {
+				t.Error("denied response does not contain \"result\" field")
+				continue
 			}
-			expectedLen := len(testCase.BeforeSoftAntiAffinities) + len(testCase.SoftAntiAffinitiesAppending)
-			actualLen := len(patchedPod.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
-			if actualLen != expectedLen {
-				t.Errorf("unexpected pod affinity size: expected: %d, actual: %d", expectedLen, actualLen)
+			if reviewResponse.Result.Code != http.StatusBadRequest {
+				t.Error("unexpected result code", reviewResponse.Result.Code)
 			}
+			msg = reviewResponse.Result.Message
+		}
+		if !strings.Contains(msg, testCase.AnnotationKey) {
+			t.Errorf("message should name annotation %s: %s", testCase.AnnotationKey, msg)
 		}
 	}
 }
 
-type testCreateTopologySpreadConstraintsJSONPatchCase struct {
-	BeforeTopologySpreadConstraints    []corev1.TopologySpreadConstraint
-	TopologySpreadconstraintsAppending []corev1.TopologySpreadConstraint
+type testMutateHTTPErrorCase struct {
+	Name               string
+	Method             string
+	Body               string
+	ExpectedStatusCode int
 }
 
-func TestCreateTopologySpreadConstrainsJSONPatch(t *testing.T) {
-	testCaseSize := 1 << 4
-	testCases := make([]testCreateTopologySpreadConstraintsJSONPatchCase, testCaseSize)
-	for bits := 0; bits < testCaseSize; bits++ {
-		testCase := testCreateTopologySpreadConstraintsJSONPatchCase{}
-		var size int
-		mask := (1 << (testScaleIndex + 1)) - 1
-		size = (bits >> (0 * testScaleIndex)) & mask
-		testCase.BeforeTopologySpreadConstraints = make([]corev1.TopologySpreadConstraint, size, size)
-		for idx := 0; idx < size; idx++ {
-			testCase.BeforeTopologySpreadConstraints[idx] = corev1.TopologySpreadConstraint{
-				LabelSelector: &metav1.LabelSelector{
-					MatchLabels: map[string]string{
-						"app": "nginx",
-					},
-				},
-				TopologyKey: fmt.Sprintf("topology.kubernetes.io/host%d", idx),
-				MaxSkew:     1,
-			}
-		}
-		size = (bits >> (1 * testScaleIndex)) & mask
-		testCase.TopologySpreadconstraintsAppending = make([]corev1.TopologySpreadConstraint, size, size)
-		for idx := 0; idx < size; idx++ {
-			testCase.TopologySpreadconstraintsAppending[idx] = corev1.TopologySpreadConstraint{
-				LabelSelector: &metav1.LabelSelector{
-					MatchLabels: map[string]string{
-						"app": "nginx",
-					},
-				},
-				TopologyKey: fmt.Sprintf("topology.kubernetes.io/zone%d", idx),
-				MaxSkew:     1,
-			}
-		}
-		testCases = append(testCases, testCase)
+func TestMutateHTTPError(t *testing.T) {
+	testCases := []testMutateHTTPErrorCase{
+		{
+			Name:               "method not allowed",
+			Method:             http.MethodGet,
+			Body:               "",
+			ExpectedStatusCode: http.StatusMethodNotAllowed,
+		},
+		{
+			Name:               "body is not JSON",
+			Method:             http.MethodPost,
+			Body:               "<AdmissionReview/>",
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			Name:               "review without request",
+			Method:             http.MethodPost,
+			Body:               "{\"apiVersion\":\"admission.k8s.io/v1\",\"kind\":\"AdmissionReview\"}",
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
 	}
 
 	for _, testCase := range testCases {
-		pod := prepareBasicPod()
-		if len(testCase.BeforeTopologySpreadConstraints) > 0 {
-			pod.Spec.TopologySpreadConstraints = testCase.BeforeTopologySpreadConstraints
-		}
-
-		patches := createTopologySpreadConstraintsJSONPatch(pod, testCase.TopologySpreadconstraintsAppending)
-
-		patchedPod, err := applyPatch(pod, patches)
-		if err != nil {
-			t.Error("failed to patch pod with created JSONPatch", err)
-		}
-
-		if len(testCase.BeforeTopologySpreadConstraints)+len(testCase.TopologySpreadconstraintsAppending) > 0 {
-			if !topologySpreadConstraintsNonNil(patchedPod) {
-				t.Error("/spec/topologySpreadConstraints field not found")
-			}
-			expectedLen := len(testCase.BeforeTopologySpreadConstraints) + len(testCase.TopologySpreadconstraintsAppending)
-			actualLen := len(patchedPod.Spec.TopologySpreadConstraints)
-			if actualLen != expectedLen {
-				t.Errorf("unexpected pod topologySpreadConstraints size: expected: %d, actual: %d", expectedLen, actualLen)
-			}
+		recorder := doRequest(testCase.Method, ([]byte)(testCase.Body))
+		if recorder.Code != testCase.ExpectedStatusCode {
+			t.Errorf("%s: unexpected status code: expected: %d, actual: %d", testCase.Name, testCase.ExpectedStatusCode, recorder.Code)
 		}
 	}
 }
 
-type testMatchLabelKeyToRequirementCase struct {
-	MatchLabelKey       string
-	Labels              map[string]string
-	IsExpectedResultNil bool
-	ExpectedKeyValue    string
+type testMutateReviewErrorCase struct {
+	Name           string
+	Modify         func(reviewRequest *admissionv1.AdmissionRequest)
+	ExpectedCode   int32
+	ExpectedReason metav1.StatusReason
 }
 
-func TestMatchLabelKeyToRequirement(t *testing.T) {
-	testCases := make([]testMatchLabelKeyToRequirementCase, 0)
-
-	// case 1 no matching label key
-	testCases = append(testCases, testMatchLabelKeyToRequirementCase{
-		MatchLabelKey: uuid.New().String(),
-		Labels: map[string]string{
-			uuid.New().String(): uuid.New().String(),
-			uuid.New().String(): uuid.New().String(),
-			uuid.New().String(): uuid.New().String(),
+func TestMutateReviewError(t *testing.T) {
+	testCases := []testMutateReviewErrorCase{
+		{
+			Name: "unsupported operation",
+			Modify: func(reviewRequest *admissionv1.AdmissionRequest) {
+				reviewRequest.Operation = admissionv1.Update
+			},
+			ExpectedCode:   http.StatusMethodNotAllowed,
+			ExpectedReason: metav1.StatusReasonMethodNotAllowed,
 		},
-		IsExpectedResultNil: true,
-	})
-
-	// case 2 there are matching label key
-	expectedKey1 := uuid.New().String()
-	expectedValue1 := uuid.New().String()
-	testCases = append(testCases, testMatchLabelKeyToRequirementCase{
-		MatchLabelKey: expectedKey1,
-		Labels: map[string]string{
-			expectedKey1:        expectedValue1,
-			uuid.New().String(): uuid.New().String(),
-			uuid.New().String(): uuid.New().String(),
+		{
+			Name: "unsupported resource",
+			Modify: func(reviewRequest *admissionv1.AdmissionRequest) {
+				reviewRequest.Resource = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+			},
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedReason: metav1.StatusReasonBadRequest,
+		},
+		{
+			Name: "subresource",
+			Modify: func(reviewRequest *admissionv1.AdmissionRequest) {
+				reviewRequest.SubResource = "status"
+			},
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedReason: metav1.StatusReasonBadRequest,
+		},
+		{
+			Name: "undecodable object",
+			Modify: func(reviewRequest *admissionv1.AdmissionRequest) {
+				reviewRequest.Object.Raw = ([]byte)("[\"not\", \"a\", \"pod\"]")
+			},
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedReason: metav1.StatusReasonBadRequest,
 		},
-		IsExpectedResultNil: false,
-		ExpectedKeyValue:    expectedValue1,
-	})
+	}
 
-	// TEST
 	for _, testCase := range testCases {
-		result := matchLabelKeyToRequirement(testCase.MatchLabelKey, testCase.Labels)
+		reqReview, err := newPodReview(prepareBasicPod())
+		if err != nil {
+			t.Fatal("failed to prepare AdmissionReview", err)
+		}
+		testCase.Modify(reqReview.Request)
+		reqBody, err := json.Marshal(reqReview)
+		if err != nil {
+			t.Fatal("failed to encode AdmissionReview", err)
+		}
 
-		if testCase.IsExpectedResultNil {
-			if result != nil {
-				t.Error("result should be nil, but not", result)
-			}
+		recorder := doRequest(http.MethodPost, reqBody)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: unexpected status code: %d", testCase.Name, recorder.Code)
 			continue
 		}
-
-		if result.Key != testCase.MatchLabelKey {
-			t.Error("returned requirements has unexpected key: ", result.Key)
+		var respReview admissionv1.AdmissionReview
+		err = json.Unmarshal(recorder.Body.Bytes(), &respReview)
+		if err != nil {
+			t.Errorf("%s: failed to decode response: %v", testCase.Name, err)
+			continue
+		}
+		reviewResponse := respReview.Response
+		if reviewResponse == nil || reviewResponse.Result == nil {
+			t.Errorf("%s: response does not contain result: %s", testCase.Name, recorder.Body.String())
+			continue
 		}
-		if result.Operator != metav1.LabelSelectorOpIn {
-			t.Error("returned requirements has unexpected operator: ", result.Operator)
+		if reviewResponse.UID != reqReview.Request.UID {
+			t.Errorf("%s: unexpected UID: %s", testCase.Name, reviewResponse.UID)
 		}
-		if result.Values == nil || len(result.Values) != 1 || result.Values[0] != testCase.ExpectedKeyValue {
-			t.Error("returned requirements has unexpected values: ", result.Values)
+		if reviewResponse.Allowed {
+			t.Errorf("%s: request should be denied", testCase.Name)
+		}
+		if reviewResponse.Result.Code != testCase.ExpectedCode {
+			t.Errorf("%s: unexpected result code: expected: %d, actual: %d", testCase.Name, testCase.ExpectedCode, reviewResponse.Result.Code)
+		}
+		if reviewResponse.Result.Reason != testCase.ExpectedReason {
+			t.Errorf("%s: unexpected result reason: expected: %s, actual: %s", testCase.Name, testCase.ExpectedReason, reviewResponse.Result.Reason)
 		}
-
 	}
 }
 
-func TestMismatchLabelKeyToRequirement(t *testing.T) {
-	testCases := make([]testMatchLabelKeyToRequirementCase, 0)
+type testMutateMissingLabelKeysCase struct {
+	Name            string
+	Path            string
+	StrictPod       bool
+	Labels          map[string]string
+	ExpectedAllowed bool
+	ExpectedMissing []string
+}
 
-	// case 1 no matching label key
-	testCases = append(testCases, testMatchLabelKeyToRequirementCase{
-		MatchLabelKey: uuid.New().String(),
-		Labels: map[string]string{
-			uuid.New().String(): uuid.New().String(),
-			uuid.New().String(): uuid.New().String(),
-			uuid.New().String(): uuid.New().String(),
+func TestMutateMissingLabelKeys(t *testing.T) {
+	source := `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"], "mismatchLabelKeys": ["tenant"]}]`
+	testCases := []testMutateMissingLabelKeysCase{
+		{
+			Name:            "missing keys are warned",
+			Path:            "/",
+			Labels:          map[string]string{"app": "nginx"},
+			ExpectedAllowed: true,
+			ExpectedMissing: []string{"pod-template-hash", "tenant"},
 		},
-		IsExpectedResultNil: true,
-	})
-
-	// case 2 there are matching label key
-	expectedKey1 := uuid.New().String()
-	expectedValue1 := uuid.New().String()
-	testCases = append(testCases, testMatchLabelKeyToRequirementCase{
-		MatchLabelKey: expectedKey1,
-		Labels: map[string]string{
-			expectedKey1:        expectedValue1,
-			uuid.New().String(): uuid.New().String(),
-			uuid.New().String(): uuid.New().String(),
+		{
+			Name:            "no missing keys",
+			Path:            "/",
+			Labels:          map[string]string{"app": "nginx", "pod-template-hash": "abcdef", "tenant": "a"},
+			ExpectedAllowed: true,
+			ExpectedMissing: []string{},
 		},
-		IsExpectedResultNil: false,
-		ExpectedKeyValue:    expectedValue1,
-	})
+		{
+			Name:            "strict pod",
+			Path:            "/",
+			StrictPod:       true,
+			Labels:          map[string]string{"app": "nginx", "pod-template-hash": "abcdef"},
+			ExpectedAllowed: false,
+			ExpectedMissing: []string{"tenant"},
+		},
+		{
+			Name:            "strict namespace",
+			Path:            pathStrict,
+			Labels:          map[string]string{"app": "nginx", "tenant": "a"},
+			ExpectedAllowed: false,
+			ExpectedMissing: []string{"pod-template-hash"},
+		},
+		{
+			Name:            "strict namespace without missing keys",
+			Path:            pathStrict,
+			Labels:          map[string]string{"app": "nginx", "pod-template-hash": "abcdef", "tenant": "a"},
+			ExpectedAllowed: true,
+			ExpectedMissing: []string{},
+		},
+	}
 
-	// TEST
 	for _, testCase := range testCases {
-		result := mismatchLabelKeyToRequirement(testCase.MatchLabelKey, testCase.Labels)
+		pod := prepareBasicPod()
+		pod.Labels = testCase.Labels
+		pod.Annotations = map[string]string{
+			config.AnnotationKey(annotationNamePodAntiAffinityHard): source,
+		}
+		if testCase.StrictPod {
+			pod.Annotations[config.AnnotationKey(annotationNameStrictLabelKeys)] = "true"
+		}
 
-		if testCase.IsExpectedResultNil {
-			if result != nil {
-				t.Error("result should be nil, but not", result)
-			}
+		respReview, err := doMutatePath(testCase.Path, pod)
+		if err != nil {
+			t.Errorf("%s: failed to call mutate: %v", testCase.Name, err)
+			continue
+		}
+		reviewResponse := respReview.Response
+		if reviewResponse.Allowed != testCase.ExpectedAllowed {
+			t.Errorf("%s: unexpected allowed: %t", testCase.Name, reviewResponse.Allowed)
 			continue
 		}
 
-		if result.Key != testCase.MatchLabelKey {
-			t.Error("returned requirements has unexpected key: ", result.Key)
+		if !testCase.ExpectedAllowed {
+			for _, key := range testCase.ExpectedMissing {
+				if !strings.Contains(reviewResponse.Result.Message, key) {
+					t.Errorf("%s: denial should name missing key %s: %s", testCase.Name, key, reviewResponse.Result.Message)
+				}
+			}
+			continue
 		}
-		if result.Operator != metav1.LabelSelectorOpNotIn {
-			t.Error("returned requirements has unexpected operator: ", result.Operator)
+
+		if len(reviewResponse.Warnings) != len(testCase.ExpectedMissing) {
+			t.Errorf("%s: unexpected warnings: %v", testCase.Name, reviewResponse.Warnings)
 		}
-		if result.Values == nil || len(result.Values) != 1 || result.Values[0] != testCase.ExpectedKeyValue {
-			t.Error("returned requirements has unexpected values: ", result.Values)
+		for idx, key := range testCase.ExpectedMissing {
+			if idx < len(reviewResponse.Warnings) && !strings.Contains(reviewResponse.Warnings[idx], key) {
+				t.Errorf("%s: warning should name missing key %s: %s", testCase.Name, key, reviewResponse.Warnings[idx])
+			}
 		}
 
+		patchedPod, err := applyPatchDocument(pod, reviewResponse.Patch)
+		if err != nil {
+			t.Errorf("%s: failed to apply patch: %v", testCase.Name, err)
+			continue
+		}
+		missingKeysJSON, exists := patchedPod.Annotations[config.AnnotationKey(annotationNameMissingLabelKeys)]
+		if len(testCase.ExpectedMissing) == 0 {
+			if exists {
+				t.Errorf("%s: unexpected missing label keys annotation: %s", testCase.Name, missingKeysJSON)
+			}
+			continue
+		}
+		var missingKeys []kep3633.MissingLabelKey
+		err = json.Unmarshal(([]byte)(missingKeysJSON), &missingKeys)
+		if err != nil {
+			t.Errorf("%s: failed to decode missing label keys annotation: %v", testCase.Name, err)
+			continue
+		}
+		if len(missingKeys) != len(testCase.ExpectedMissing) {
+			t.Errorf("%s: unexpected missing label keys annotation: %s", testCase.Name, missingKeysJSON)
+			continue
+		}
+		for idx, key := range testCase.ExpectedMissing {
+			if missingKeys[idx].Key != key || missingKeys[idx].Annotation != config.AnnotationKey(annotationNamePodAntiAffinityHard) {
+				t.Errorf("%s: unexpected missing label key: %#v", testCase.Name, missingKeys[idx])
+			}
+		}
 	}
 }
 
-//
-// utilities
-//
+func TestMutateAllAnnotations(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{
+		"app":               "nginx",
+		"pod-template-hash": "abcdef",
+		"tenant":            "a",
+	}
+	pod.Spec.Affinity = &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+				{
+					LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis"}},
+					TopologyKey:   "kubernetes.io/hostname",
+				},
+			},
+		},
+	}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAffinityHard):           `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "topology.kubernetes.io/region", "matchLabelKeys": ["tenant"]}]`,
+		config.AnnotationKey(annotationNamePodAffinitySoft):           `[{"weight": 10, "podAffinityTerm": {"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "topology.kubernetes.io/zone", "matchLabelKeys": ["pod-template-hash"]}}]`,
+		config.AnnotationKey(annotationNamePodAntiAffinityHard):       `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"], "mismatchLabelKeys": ["tenant"]}]`,
+		config.AnnotationKey(annotationNamePodAntiAffinitySoft):       `[{"weight": 50, "podAffinityTerm": {"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "topology.kubernetes.io/zone", "mismatchLabelKeys": ["tenant"]}}]`,
+		config.AnnotationKey(annotationNameTopologySpreadConstraints): `[{"maxSkew": 1, "topologyKey": "topology.kubernetes.io/zone", "whenUnsatisfiable": "DoNotSchedule", "labelSelector": {"matchLabels": {"app": "nginx"}}, "matchLabelKeys": ["pod-template-hash"]}]`,
+	}
+
+	respReview, err := doMutate(pod)
+	if err != nil {
+		t.Fatal("failed to call mutate", err)
+	}
+	reviewResponse := respReview.Response
+	if !reviewResponse.Allowed || reviewResponse.PatchType == nil || *reviewResponse.PatchType != admissionv1.PatchTypeJSONPatch {
+		t.Fatalf("pod should be allowed with JSON patch: %#v", reviewResponse)
+	}
+	if len(reviewResponse.Warnings) != 0 {
+		t.Error("unexpected warnings", reviewResponse.Warnings)
+	}
+
+	patchedPod, err := applyPatchDocument(pod, reviewResponse.Patch)
+	if err != nil {
+		t.Fatal("failed to apply patch", err)
+	}
 
-func topologySpreadConstraintsNonNil(pod *corev1.Pod) bool {
-	return pod.Spec.TopologySpreadConstraints != nil
+	// the webhook responds with the expansion of the library, which is tested term by term in pkg/kep3633
+	result, err := newExpander(logger).ExpandResult(pod)
+	if err != nil {
+		t.Fatal("failed to expand pod", err)
+	}
+	injected := 0
+	for _, change := range result.Changes {
+		injected += len(change.Injected)
+	}
+	if injected != 5 {
+		t.Errorf("a term should be injected from each annotation: %d terms injected", injected)
+	}
+	expectedBytes, err := json.Marshal(result.Pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchedBytes, err := json.Marshal(patchedPod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !jsonpatch.Equal(patchedBytes, expectedBytes) {
+		t.Errorf("patched pod should be the expanded one:\nexpected: %s\nactual: %s", string(expectedBytes), string(patchedBytes))
+	}
 }
 
-func affinityFieldNonNil(pod *corev1.Pod) bool {
-	return pod.Spec.Affinity != nil
+func TestMutateNilLabelSelector(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"pod-template-hash": "abcdef"}
+
+	// nil labelSelector without keys is kept as is, which matches no pods
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `[{"topologyKey": "kubernetes.io/hostname"}]`,
+	}
+	respReview, err := doMutate(pod)
+	if err != nil {
+		t.Fatal("failed to call mutate", err)
+	}
+	patchedPod, err := applyPatchDocument(pod, respReview.Response.Patch)
+	if err != nil {
+		t.Fatal("failed to apply patch", err)
+	}
+	if patchedPod.Spec.Affinity == nil || patchedPod.Spec.Affinity.PodAntiAffinity == nil ||
+		len(patchedPod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution) != 1 ||
+		patchedPod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution[0].LabelSelector != nil {
+		t.Error("labelSelector should be kept nil", patchedPod.Spec.Affinity)
+	}
+
+	// nil labelSelector with keys is rejected, since empty labelSelector would match every pod
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `[{"topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}]`,
+	}
+	respReview, err = doMutate(pod)
+	if err != nil {
+		t.Fatal("failed to call mutate", err)
+	}
+	if respReview.Response.Allowed {
+		t.Fatal("pod should be denied")
+	}
+	if !strings.Contains(respReview.Response.Result.Message, "must not be specified when labelSelector is not set") {
+		t.Error("unexpected message", respReview.Response.Result.Message)
+	}
 }
 
-func podAffinityFieldNonNil(pod *corev1.Pod) bool {
-	if !affinityFieldNonNil(pod) {
-		return false
+func TestMutateReinvocation(t *testing.T) {
+	userTerm := corev1.PodAffinityTerm{
+		LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis"}},
+		TopologyKey:   "kubernetes.io/hostname",
+	}
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx", "pod-template-hash": "aaaaaa"}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard):       `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}]`,
+		config.AnnotationKey(annotationNameTopologySpreadConstraints): `[{"maxSkew": 1, "topologyKey": "topology.kubernetes.io/zone", "whenUnsatisfiable": "DoNotSchedule", "labelSelector": {"matchLabels": {"app": "nginx"}}, "matchLabelKeys": ["pod-template-hash"]}]`,
+	}
+	pod.Spec.Affinity = &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{userTerm},
+		},
+	}
+
+	// first invocation
+	respReview, err := doMutate(pod)
+	if err != nil {
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+	mutatedPod, err := applyPatchDocument(pod, respReview.Response.Patch)
+	if err != nil {
+		t.Fatalf("failed to apply patch: %v", err)
+	}
+	if _, exists := mutatedPod.Annotations[config.AnnotationKey(annotationNameInjected)]; !exists {
+		t.Errorf("provenance annotation should be recorded: %v", mutatedPod.Annotations)
+	}
+
+	// reinvocation without changes
+	respReview, err = doMutate(mutatedPod)
+	if err != nil {
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+	if !respReview.Response.Allowed || respReview.Response.Patch != nil {
+		t.Errorf("reinvocation without changes should admit pod without patch: %s", string(respReview.Response.Patch))
+	}
+
+	// reinvocation after labels are changed by another webhook
+	mutatedPod.Labels["pod-template-hash"] = "bbbbbb"
+	respReview, err = doMutate(mutatedPod)
+	if err != nil {
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+	remutatedPod, err := applyPatchDocument(mutatedPod, respReview.Response.Patch)
+	if err != nil {
+		t.Fatalf("failed to apply patch: %v", err)
+	}
+	recomputedExpressions := []metav1.LabelSelectorRequirement{
+		{Key: "pod-template-hash", Operator: metav1.LabelSelectorOpIn, Values: []string{"bbbbbb"}},
+	}
+	terms := remutatedPod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(terms) != 2 {
+		t.Fatalf("injected terms should be replaced, not duplicated: %#v", terms)
+	}
+	if terms[0].LabelSelector.MatchLabels["app"] != "redis" || len(terms[0].LabelSelector.MatchExpressions) != 0 {
+		t.Errorf("term written by user should be kept: %#v", terms[0])
+	}
+	if !reflect.DeepEqual(terms[1].LabelSelector.MatchExpressions, recomputedExpressions) {
+		t.Errorf("injected term should be recomputed: %#v", terms[1])
+	}
+	constraints := remutatedPod.Spec.TopologySpreadConstraints
+	if len(constraints) != 1 {
+		t.Fatalf("injected constraints should be replaced, not duplicated: %#v", constraints)
+	}
+	if !reflect.DeepEqual(constraints[0].LabelSelector.MatchExpressions, recomputedExpressions) {
+		t.Errorf("injected constraint should be recomputed: %#v", constraints[0])
+	}
+
+	// reinvocation after the replacement
+	respReview, err = doMutate(remutatedPod)
+	if err != nil {
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+	if respReview.Response.Patch != nil {
+		t.Errorf("reinvocation without changes should admit pod without patch: %s", string(respReview.Response.Patch))
 	}
-	return pod.Spec.Affinity.PodAffinity != nil
 }
 
-func hardAffinityFieldNonNil(pod *corev1.Pod) bool {
-	if !podAffinityFieldNonNil(pod) {
-		return false
+func TestMutateReinvocationUnknownFields(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx", "pod-template-hash": "aaaaaa"}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}]`,
+	}
+	pod.Spec.Affinity = &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{
+				LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis"}},
+				TopologyKey:   "kubernetes.io/hostname",
+			}},
+		},
+	}
+	respReview, err := doMutate(pod)
+	if err != nil {
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+	mutatedPod, err := applyPatchDocument(pod, respReview.Response.Patch)
+	if err != nil {
+		t.Fatalf("failed to apply patch: %v", err)
+	}
+
+	// labels and annotations are changed by another webhook, so that the list is replaced as a whole,
+	// and the term written by user has native matchLabelKeys which corev1.Pod of the library does not know
+	mutatedPod.Labels["pod-template-hash"] = "bbbbbb"
+	mutatedPod.Annotations[config.AnnotationKey(annotationNamePodAntiAffinityHard)] = `[
+		{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]},
+		{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "topology.kubernetes.io/zone", "matchLabelKeys": ["pod-template-hash"]}
+	]`
+	reqReview, err := newPodReview(mutatedPod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	podObj := make(map[string]interface{})
+	err = json.Unmarshal(reqReview.Request.Object.Raw, &podObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := podObj["spec"].(map[string]interface{})
+	terms := spec["affinity"].(map[string]interface{})["podAntiAffinity"].(map[string]interface{})["requiredDuringSchedulingIgnoredDuringExecution"].([]interface{})
+	terms[0].(map[string]interface{})["matchLabelKeys"] = []interface{}{"tier"}
+	rawPod, err := json.Marshal(podObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqReview.Request.Object.Raw = rawPod
+	reqBody, err := json.Marshal(reqReview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := doRequest(http.MethodPost, reqBody)
+	var respReview2 admissionv1.AdmissionReview
+	err = json.Unmarshal(recorder.Body.Bytes(), &respReview2)
+	if err != nil {
+		t.Fatalf("failed to decode response: %v; body: %s", err, recorder.Body.String())
+	}
+	if !respReview2.Response.Allowed || respReview2.Response.Patch == nil {
+		t.Fatalf("injected terms should be replaced: %#v", respReview2.Response)
+	}
+
+	patchObj, err := jsonpatch.DecodePatch(respReview2.Response.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := patchObj.Apply(rawPod)
+	if err != nil {
+		t.Fatalf("failed to apply patch: %v", err)
+	}
+	var patchedPod struct {
+		Spec struct {
+			Affinity struct {
+				PodAntiAffinity struct {
+					RequiredDuringSchedulingIgnoredDuringExecution []kep3633.PodAffinityTerm `json:"requiredDuringSchedulingIgnoredDuringExecution"`
+				} `json:"podAntiAffinity"`
+			} `json:"affinity"`
+		} `json:"spec"`
+	}
+	err = json.Unmarshal(patched, &patchedPod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchedTerms := patchedPod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(patchedTerms) != 3 {
+		t.Fatalf("injected terms should be replaced, not duplicated: %s", string(patched))
+	}
+	if !reflect.DeepEqual(patchedTerms[0].MatchLabelKeys, []string{"tier"}) {
+		t.Errorf("fields unknown to the library should be kept: %s", string(patched))
+	}
+	if !reflect.DeepEqual(patchedTerms[1].LabelSelector.MatchExpressions, []metav1.LabelSelectorRequirement{
+		{Key: "pod-template-hash", Operator: metav1.LabelSelectorOpIn, Values: []string{"bbbbbb"}},
+	}) {
+		t.Errorf("injected term should be recomputed: %#v", patchedTerms[1])
 	}
-	return pod.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil
 }
 
-func softAffinityFieldNonNil(pod *corev1.Pod) bool {
-	if !podAffinityFieldNonNil(pod) {
-		return false
+func TestMutateAuditAnnotations(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx", "pod-template-hash": "abcdef"}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard):       `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"], "mismatchLabelKeys": ["tenant"]}, {"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "topology.kubernetes.io/zone", "matchLabelKeys": ["pod-template-hash"]}]`,
+		config.AnnotationKey(annotationNameTopologySpreadConstraints): `[{"maxSkew": 1, "topologyKey": "topology.kubernetes.io/zone", "whenUnsatisfiable": "DoNotSchedule", "labelSelector": {"matchLabels": {"app": "nginx"}}}]`,
+	}
+
+	respReview, err := doMutate(pod)
+	if err != nil {
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+	expected := map[string]string{
+		"sources":        config.AnnotationKey(annotationNamePodAntiAffinityHard) + "," + config.AnnotationKey(annotationNameTopologySpreadConstraints),
+		"injectedTerms":  annotationNamePodAntiAffinityHard + "=2," + annotationNameTopologySpreadConstraints + "=1",
+		"resolvedLabels": "pod-template-hash=abcdef",
+	}
+	if !reflect.DeepEqual(respReview.Response.AuditAnnotations, expected) {
+		t.Errorf("unexpected audit annotations: %v", respReview.Response.AuditAnnotations)
+	}
+
+	// no audit annotations without patch
+	mutatedPod, err := applyPatchDocument(pod, respReview.Response.Patch)
+	if err != nil {
+		t.Fatalf("failed to apply patch: %v", err)
+	}
+	respReview, err = doMutate(mutatedPod)
+	if err != nil {
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+	if respReview.Response.AuditAnnotations != nil {
+		t.Errorf("audit annotations should not be set without patch: %v", respReview.Response.AuditAnnotations)
 	}
-	return pod.Spec.Affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution != nil
 }
 
-func podAntiAffinityFieldNonNil(pod *corev1.Pod) bool {
-	if !affinityFieldNonNil(pod) {
-		return false
+func TestReadiness(t *testing.T) {
+	defer ready.Store(ready.Load())
+
+	for _, isReady := range []bool{true, false} {
+		ready.Store(isReady)
+		recorder := httptest.NewRecorder()
+		readiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		expectedStatusCode := http.StatusOK
+		if !isReady {
+			expectedStatusCode = http.StatusServiceUnavailable
+		}
+		if recorder.Code != expectedStatusCode {
+			t.Errorf("unexpected status code: ready: %t, expected: %d, actual: %d", isReady, expectedStatusCode, recorder.Code)
+		}
 	}
-	return pod.Spec.Affinity.PodAntiAffinity != nil
 }
 
-func hardAntiAffinityFieldNonNil(pod *corev1.Pod) bool {
-	if !podAntiAffinityFieldNonNil(pod) {
-		return false
+type testDrainCase struct {
+	HandlerDuration time.Duration
+	ShutdownTimeout time.Duration
+	ExpectedClean   bool
+}
+
+func TestDrain(t *testing.T) {
+	defer ready.Store(ready.Load())
+
+	testCases := []testDrainCase{
+		{
+			HandlerDuration: 200 * time.Millisecond,
+			ShutdownTimeout: 5 * time.Second,
+			ExpectedClean:   true,
+		},
+		{
+			HandlerDuration: 2 * time.Second,
+			ShutdownTimeout: 50 * time.Millisecond,
+			ExpectedClean:   false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		ready.Store(true)
+		started := make(chan struct{})
+		server := &serverWrapper{
+			Server: http.Server{
+				Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+					close(started)
+					time.Sleep(testCase.HandlerDuration)
+					resp.WriteHeader(http.StatusOK)
+				}),
+			},
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("failed to listen", err)
+		}
+		go func() {
+			_ = server.Serve(listener)
+		}()
+
+		requestErr := make(chan error, 1)
+		go func() {
+			resp, err := http.Get("http://" + listener.Addr().String() + "/")
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+			requestErr <- err
+		}()
+		<-started
+
+		err = drain(server, 0, testCase.ShutdownTimeout)
+		if ready.Load() {
+			t.Error("readiness should fail while draining")
+		}
+		if testCase.ExpectedClean {
+			if err != nil {
+				t.Error("drain should finish cleanly", err)
+			}
+			if err := <-requestErr; err != nil {
+				t.Error("in-flight request should complete", err)
+			}
+		} else {
+			if err == nil {
+				t.Error("drain should report deadline exceeded")
+			}
+			_ = server.Close()
+		}
 	}
-	return pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil
 }
 
-func softAntiAffinityFieldNonNil(pod *corev1.Pod) bool {
-	if !podAntiAffinityFieldNonNil(pod) {
-		return false
+func TestHandleServerError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	handleServerError(recorder, fmt.Errorf("unexpected"), "failed to marshal JSON patch", logger)
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Error("unexpected status code", recorder.Code)
+	}
+	var body errorBody
+	err := json.Unmarshal(recorder.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal("failed to decode error body", err)
+	}
+	if body.Error != "unexpected" || body.Message != "failed to marshal JSON patch" {
+		t.Error("unexpected error body", body)
 	}
-	return pod.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution != nil
 }
 
-func applyPatch(pod *corev1.Pod, patch []map[string]interface{}) (*corev1.Pod, error) {
+func TestMutateDisabledMutator(t *testing.T) {
+	defer func(gates featureGates) { config.FeatureGates = gates }(config.FeatureGates)
+	config.FeatureGates = featureGates{"TopologySpreadConstraints": false}
 
-	patchDoc, err := json.Marshal(patch)
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx"}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNameTopologySpreadConstraints): `broken`,
+	}
+
+	respReview, err := doMutate(pod)
 	if err != nil {
-		return nil, fmt.Errorf("error while encoding patch object into JSONPatch document: %w", err)
+		t.Fatalf("failed to call mutate: %v", err)
+	}
+	if !respReview.Response.Allowed || respReview.Response.Patch != nil {
+		t.Errorf("annotation of disabled mutator should be ignored: %#v", respReview.Response)
 	}
+}
+
+//
+// utilities
+//
+
+func applyPatchDocument(pod *corev1.Pod, patchDoc []byte) (*corev1.Pod, error) {
 
 	patchObj, err := jsonpatch.DecodePatch(patchDoc)
 	if err != nil {
@@ -526,3 +903,68 @@ func prepareBasicPod() *corev1.Pod {
 		},
 	}
 }
+
+func doMutate(pod *corev1.Pod) (*admissionv1.AdmissionReview, error) {
+	return doMutatePath("/", pod)
+}
+
+func doMutatePath(path string, pod *corev1.Pod) (*admissionv1.AdmissionReview, error) {
+	reqReview, err := newPodReview(pod)
+	if err != nil {
+		return nil, err
+	}
+	reqBody, err := json.Marshal(reqReview)
+	if err != nil {
+		return nil, fmt.Errorf("error while encoding AdmissionReview into JSON: %w", err)
+	}
+
+	recorder := doRequestPath(http.MethodPost, path, reqBody)
+	if recorder.Code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d; body: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var respReview admissionv1.AdmissionReview
+	err = json.Unmarshal(recorder.Body.Bytes(), &respReview)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding AdmissionReview from JSON: %w", err)
+	}
+	if respReview.Response != nil && respReview.Response.UID != reqReview.Request.UID {
+		return nil, fmt.Errorf("response UID %q does not match request UID %q", respReview.Response.UID, reqReview.Request.UID)
+	}
+
+	return &respReview, nil
+}
+
+func newPodReview(pod *corev1.Pod) (*admissionv1.AdmissionReview, error) {
+	podJSON, err := json.Marshal(pod)
+	if err != nil {
+		return nil, fmt.Errorf("error while encoding pod into JSON: %w", err)
+	}
+
+	return &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID(uuid.New().String()),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  podsv1GVR,
+			Namespace: pod.Namespace,
+			Operation: admissionv1.Create,
+			UserInfo:  authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:replicaset-controller"},
+			Object:    runtime.RawExtension{Raw: podJSON},
+		},
+	}, nil
+}
+
+func doRequest(method string, reqBody []byte) *httptest.ResponseRecorder {
+	return doRequestPath(method, "/", reqBody)
+}
+
+func doRequestPath(method, path string, reqBody []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(reqBody))
+	recorder := httptest.NewRecorder()
+	mutate(recorder, req)
+	return recorder
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// stdinName is the file name which means stdin.
+const stdinName = "-"
+
+// podTemplatePaths maps kinds of objects to the path to their pod template, i.e. the object with metadata and spec of pods.
+// Pods are templates of themselves.
+var podTemplatePaths = map[string][]string{
+	"Pod":         {},
+	"PodTemplate": {"template"},
+	"ReplicaSet":  {"spec", "template"},
+	"Deployment":  {"spec", "template"},
+	"StatefulSet": {"spec", "template"},
+	"DaemonSet":   {"spec", "template"},
+	"Job":         {"spec", "template"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template"},
+}
+
+// manifest is a Kubernetes object read from a YAML or JSON document.
+type manifest struct {
+	// Source is the file name the object is read from, or "-" for stdin.
+	Source string
+	// Index is the index of the document in Source.
+	Index  int
+	Object map[string]interface{}
+}
+
+func (m *manifest) Kind() string {
+	kind, _ := m.Object["kind"].(string)
+	return kind
+}
+
+func (m *manifest) Name() string {
+	metadata, _ := m.Object["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	return name
+}
+
+// String identifies m in messages, e.g. "deploy.yaml#1 Deployment/nginx".
+func (m *manifest) String() string {
+	return fmt.Sprintf("%s#%d %s/%s", m.Source, m.Index, m.Kind(), m.Name())
+}
+
+// podTemplatePointer returns the JSON pointer to the pod template of m, and whether m has one.
+func (m *manifest) podTemplatePointer() (string, bool) {
+	path, ok := podTemplatePaths[m.Kind()]
+	if !ok {
+		return "", false
+	}
+	if len(path) == 0 {
+		return "", true
+	}
+	return "/" + strings.Join(path, "/"), true
+}
+
+// podTemplate returns the pod template of m as Pod, or nil if m does not have one.
+// Errors do not name m; callers are expected to.
+func (m *manifest) podTemplate() (*corev1.Pod, error) {
+	templateBytes, err := m.podTemplateJSON()
+	if err != nil || templateBytes == nil {
+		return nil, err
+	}
+	pod := &corev1.Pod{}
+	err = json.Unmarshal(templateBytes, pod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode pod template: %w", err)
+	}
+	return pod, nil
+}
+
+// podTemplateJSON returns the metadata and spec of the pod template of m as JSON, including fields unknown to Pod,
+// or nil if m does not have one.
+func (m *manifest) podTemplateJSON() ([]byte, error) {
+	path, ok := podTemplatePaths[m.Kind()]
+	if !ok {
+		return nil, nil
+	}
+	template := m.Object
+	for _, field := range path {
+		template, _ = template[field].(map[string]interface{})
+	}
+	if template == nil {
+		return nil, fmt.Errorf("pod template not found at .%s", strings.Join(path, "."))
+	}
+	podObj := make(map[string]interface{}, 2)
+	for _, field := range []string{"metadata", "spec"} {
+		if value, ok := template[field]; ok && value != nil {
+			podObj[field] = value
+		}
+	}
+	return json.Marshal(podObj)
+}
+
+// readManifestFiles reads manifests from files named by paths, or from stdin if paths are empty.
+func readManifestFiles(paths []string, stdin io.Reader) ([]*manifest, error) {
+	if len(paths) == 0 {
+		paths = []string{stdinName}
+	}
+	manifests := make([]*manifest, 0)
+	for _, path := range paths {
+		var read []*manifest
+		var err error
+		if path == stdinName {
+			read, err = readManifests(path, stdin)
+		} else {
+			read, err = readManifestFile(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, read...)
+	}
+	return manifests, nil
+}
+
+func readManifestFile(path string) ([]*manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readManifests(path, f)
+}
+
+// readManifests reads objects in multi-document YAML or JSON from r. Empty documents are skipped.
+func readManifests(source string, r io.Reader) ([]*manifest, error) {
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	manifests := make([]*manifest, 0)
+	for index := 0; ; index++ {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return manifests, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s#%d: failed to read document: %w", source, index, err)
+		}
+		jsonBytes, err := yaml.YAMLToJSON(doc)
+		if err != nil {
+			return nil, fmt.Errorf("%s#%d: failed to parse document: %w", source, index, err)
+		}
+		if bytes.Equal(bytes.TrimSpace(jsonBytes), []byte("null")) {
+			continue
+		}
+		obj := make(map[string]interface{})
+		err = json.Unmarshal(jsonBytes, &obj)
+		if err != nil {
+			return nil, fmt.Errorf("%s#%d: document is not an object: %w", source, index, err)
+		}
+		manifests = append(manifests, &manifest{Source: source, Index: index, Object: obj})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	admissionv1 "k8s.io/api/admission/v1"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+const (
+	metricsNamespace = "kep3633alt"
+
+	admissionResultAllowed = "allowed"
+	admissionResultPatched = "patched"
+	admissionResultDenied  = "denied"
+	admissionResultError   = "error"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	admissionRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_requests_total",
+		Help:      "Number of admission requests by operation and result (allowed, patched, denied or error).",
+	}, []string{"operation", "result"})
+
+	mutateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mutate_duration_seconds",
+		Help:      "Latency of handling admission requests.",
+		Buckets:   []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	})
+
+	injectedTermsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "injected_terms_total",
+		Help:      "Number of terms injected into pods by kind (annotation name without prefix).",
+	}, []string{"kind"})
+
+	missingLabelKeysTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "missing_label_keys_total",
+		Help:      "Number of matchLabelKeys/mismatchLabelKeys entries skipped because the pod does not have the label.",
+	}, []string{"kind", "field"})
+
+	annotationParseFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "annotation_parse_failures_total",
+		Help:      "Number of annotations which could not be parsed by kind (annotation name without prefix).",
+	}, []string{"kind"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		admissionRequestsTotal,
+		mutateDuration,
+		injectedTermsTotal,
+		missingLabelKeysTotal,
+		annotationParseFailuresTotal,
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// registerCertificateExpiry exposes the expiry of the certificate served by watcher.
+func registerCertificateExpiry(watcher *certWatcher) {
+	metricsRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tls_certificate_expiry_timestamp_seconds",
+		Help:      "Expiry of the currently served TLS certificate in unix time.",
+	}, func() float64 {
+		return float64(watcher.NotAfter().Unix())
+	}))
+}
+
+func observeMissingLabelKeys(kind string, missingKeys []kep3633.MissingLabelKey) {
+	for _, k := range missingKeys {
+		missingLabelKeysTotal.WithLabelValues(kind, k.Field).Inc()
+	}
+}
+
+func admissionResult(reviewResponse *admissionv1.AdmissionResponse) string {
+	if !reviewResponse.Allowed {
+		return admissionResultDenied
+	}
+	if reviewResponse.Patch != nil {
+		return admissionResultPatched
+	}
+	return admissionResultAllowed
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func TestMetrics(t *testing.T) {
+	patchedBefore := testutil.ToFloat64(admissionRequestsTotal.WithLabelValues("CREATE", admissionResultPatched))
+	injectedBefore := testutil.ToFloat64(injectedTermsTotal.WithLabelValues(annotationNamePodAntiAffinityHard))
+	missingBefore := testutil.ToFloat64(missingLabelKeysTotal.WithLabelValues(annotationNamePodAntiAffinityHard, "mismatchLabelKeys"))
+	parseFailuresBefore := testutil.ToFloat64(annotationParseFailuresTotal.WithLabelValues(annotationNameTopologySpreadConstraints))
+
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{
+		"app":               "nginx",
+		"pod-template-hash": "abcdef",
+	}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"], "mismatchLabelKeys": ["tenant"]}]`,
+	}
+	_, err := doMutate(pod)
+	if err != nil {
+		t.Fatal("failed to call mutate", err)
+	}
+
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNameTopologySpreadConstraints): `{`,
+	}
+	_, err = doMutate(pod)
+	if err != nil {
+		t.Fatal("failed to call mutate", err)
+	}
+
+	if v := testutil.ToFloat64(admissionRequestsTotal.WithLabelValues("CREATE", admissionResultPatched)) - patchedBefore; v != 1 {
+		t.Error("unexpected patched requests", v)
+	}
+	if v := testutil.ToFloat64(injectedTermsTotal.WithLabelValues(annotationNamePodAntiAffinityHard)) - injectedBefore; v != 1 {
+		t.Error("unexpected injected terms", v)
+	}
+	if v := testutil.ToFloat64(missingLabelKeysTotal.WithLabelValues(annotationNamePodAntiAffinityHard, "mismatchLabelKeys")) - missingBefore; v != 1 {
+		t.Error("unexpected missing label keys", v)
+	}
+	if v := testutil.ToFloat64(annotationParseFailuresTotal.WithLabelValues(annotationNameTopologySpreadConstraints)) - parseFailuresBefore; v != 1 {
+		t.Error("unexpected annotation parse failures", v)
+	}
+
+	recorder := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatal("unexpected status code", recorder.Code)
+	}
+	for _, name := range []string{
+		"kep3633alt_admission_requests_total",
+		"kep3633alt_mutate_duration_seconds_bucket",
+		"kep3633alt_injected_terms_total",
+		"kep3633alt_missing_label_keys_total",
+		"kep3633alt_annotation_parse_failures_total",
+	} {
+		if !strings.Contains(recorder.Body.String(), name) {
+			t.Error("metric not exposed", name)
+		}
+	}
+}
+
+func TestMetricsDryRun(t *testing.T) {
+	patchedBefore := testutil.ToFloat64(admissionRequestsTotal.WithLabelValues("CREATE", admissionResultPatched))
+	injectedBefore := testutil.ToFloat64(injectedTermsTotal.WithLabelValues(annotationNamePodAntiAffinityHard))
+	missingBefore := testutil.ToFloat64(missingLabelKeysTotal.WithLabelValues(annotationNamePodAntiAffinityHard, "mismatchLabelKeys"))
+
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx"}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "mismatchLabelKeys": ["tenant"]}]`,
+	}
+	reqReview, err := newPodReview(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dryRun := true
+	reqReview.Request.DryRun = &dryRun
+	reqBody, err := json.Marshal(reqReview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := doRequest(http.MethodPost, reqBody)
+	if recorder.Code != http.StatusOK {
+		t.Fatal("unexpected status code", recorder.Code)
+	}
+	var respReview admissionv1.AdmissionReview
+	err = json.Unmarshal(recorder.Body.Bytes(), &respReview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respReview.Response == nil || respReview.Response.Patch == nil || respReview.Response.AuditAnnotations == nil {
+		t.Errorf("dry-run request should be patched the same: %s", recorder.Body.String())
+	}
+
+	if v := testutil.ToFloat64(admissionRequestsTotal.WithLabelValues("CREATE", admissionResultPatched)) - patchedBefore; v != 1 {
+		t.Error("unexpected patched requests", v)
+	}
+	if v := testutil.ToFloat64(injectedTermsTotal.WithLabelValues(annotationNamePodAntiAffinityHard)) - injectedBefore; v != 0 {
+		t.Error("injected terms should not be counted on dry-run", v)
+	}
+	if v := testutil.ToFloat64(missingLabelKeysTotal.WithLabelValues(annotationNamePodAntiAffinityHard, "mismatchLabelKeys")) - missingBefore; v != 0 {
+		t.Error("missing label keys should not be counted on dry-run", v)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+// runMigrateToNative rewrites annotations of pod templates in manifests into native matchLabelKeys and mismatchLabelKeys,
+// for clusters which have come to support KEP-3633 natively. It is the reverse of runConvert.
+// Annotations with terms which cannot be expressed natively are reported and left unchanged.
+func runMigrateToNative(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("migrate-to-native", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: kep3633alt migrate-to-native [flags] [FILE...]")
+		fmt.Fprintln(stderr, "Move terms in annotations of Pods, PodTemplates and workloads read from FILEs (or stdin) into spec with native matchLabelKeys/mismatchLabelKeys.")
+		flags.PrintDefaults()
+	}
+	annotationPrefix := flags.String("annotation-prefix", kep3633.DefaultAnnotationPrefix, "Prefix of annotations to read")
+	inPlace := flags.Bool("in-place", false, "Rewrite FILEs instead of writing to stdout")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *inPlace && flags.NArg() == 0 {
+		fmt.Fprintln(stderr, "-in-place requires FILEs")
+		return 2
+	}
+
+	return rewriteYAMLFiles(flags.Args(), *inPlace, stdin, stdout, stderr, func(d *yamlDocument) (int, error) {
+		return migrateDocument(d, *annotationPrefix, stderr)
+	})
+}
+
+// migrateDocument moves terms in annotations of the pod template of d into spec, and returns the number of moved terms.
+// Each refused annotation is reported to stderr, and an error is returned if any is refused.
+func migrateDocument(d *yamlDocument, annotationPrefix string, stderr io.Writer) (int, error) {
+	template := d.podTemplate()
+	if template == nil {
+		return 0, nil
+	}
+	annotations := mappingLookup(template, "metadata", "annotations")
+	if annotations == nil || annotations.Kind != yaml.MappingNode {
+		return 0, nil
+	}
+	opts := kep3633.Options{AnnotationPrefix: annotationPrefix}
+
+	// Terms injected by the webhook are already in spec, so moving the source annotations would duplicate them.
+	injectedKey := opts.AnnotationKey(kep3633.AnnotationNameInjected)
+	if mappingValue(annotations, injectedKey) != nil {
+		return 0, fmt.Errorf("pod template has already been expanded (annotation %s); migrate the manifest it was created from", injectedKey)
+	}
+
+	moved := 0
+	refused := 0
+	for _, l := range termLists {
+		annotationKey := opts.AnnotationKey(l.annotationName)
+		annotation := mappingValue(annotations, annotationKey)
+		if annotation == nil {
+			continue
+		}
+		terms, err := nativeTerms(l.annotationName, scalarValue(annotation))
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: refused annotation %s: %v\n", d, annotationKey, err)
+			refused++
+			continue
+		}
+
+		spec := ensureMapping(template, "spec")
+		parent := ensureMapping(spec, l.path[:len(l.path)-1]...)
+		list := mappingValue(parent, l.path[len(l.path)-1])
+		if list == nil || list.Kind != yaml.SequenceNode {
+			list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			setMappingValue(parent, l.path[len(l.path)-1], list)
+		}
+		list.Content = append(list.Content, terms...)
+		removeMappingKey(annotations, annotationKey)
+		moved += len(terms)
+		fmt.Fprintf(stderr, "%s: moved %d terms from annotation %s\n", d, len(terms), annotationKey)
+	}
+
+	if moved > 0 && refused == 0 {
+		// Annotations the webhook writes describe expansion of annotations which no longer exist.
+		for _, name := range []string{kep3633.AnnotationNameMissingLabelKeys, kep3633.AnnotationNameStatus} {
+			removeMappingKey(annotations, opts.AnnotationKey(name))
+		}
+		if mappingValue(annotations, opts.AnnotationKey(kep3633.AnnotationNameStrictLabelKeys)) != nil {
+			fmt.Fprintf(stderr, "%s: warning: annotation %s has no native equivalent; label keys missing from pod labels are ignored natively\n",
+				d, opts.AnnotationKey(kep3633.AnnotationNameStrictLabelKeys))
+		}
+		pruneEmpty(template, "metadata", "annotations")
+	}
+	if refused > 0 {
+		return moved, fmt.Errorf("%d annotations cannot be expressed natively and are left unchanged", refused)
+	}
+	return moved, nil
+}
+
+// nativeTerms validates value of the annotation named annotationName as native terms,
+// and returns them as block style YAML nodes.
+func nativeTerms(annotationName, value string) ([]*yaml.Node, error) {
+	// Fields unknown to the webhook are unknown to the API server too (e.g. mismatchLabelKeys of topologySpreadConstraints),
+	// and label keys the API server would reject must not be written into spec.
+	err := kep3633.ValidateAnnotation(annotationName, value)
+	if err != nil {
+		return nil, err
+	}
+	node := &yaml.Node{}
+	err = yaml.Unmarshal([]byte(value), node)
+	if err != nil {
+		return nil, err
+	}
+	list := resolveAlias(node)
+	if list.Kind == yaml.DocumentNode && len(list.Content) > 0 {
+		list = list.Content[0]
+	}
+	if list.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("annotation value is not a list")
+	}
+	for _, term := range list.Content {
+		resetNodeStyle(term)
+	}
+	return list.Content, nil
+}
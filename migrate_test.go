@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+const migrateTestDeployment = `# nginx deployment
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx
+spec:
+  selector:
+    matchLabels:
+      app: nginx
+  template:
+    metadata:
+      labels:
+        app: nginx
+      annotations:
+        kep-3633-alt.10h.in/podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution: |
+          [
+            {
+              "labelSelector": {"matchLabels": {"app": "nginx"}},
+              "topologyKey": "topology.kubernetes.io/zone",
+              "matchLabelKeys": ["pod-template-hash"]
+            }
+          ]
+        kep-3633-alt.10h.in/topologySpreadConstraints: '[{"maxSkew": 1, "topologyKey": "kubernetes.io/hostname", "whenUnsatisfiable": "DoNotSchedule", "labelSelector": {"matchLabels": {"app": "nginx"}}, "matchLabelKeys": ["pod-template-hash"]}]'
+        kep-3633-alt.10h.in/status: '{"sources":[]}'
+    spec:
+      # scheduling
+      affinity:
+        podAntiAffinity:
+          requiredDuringSchedulingIgnoredDuringExecution:
+            - labelSelector:
+                matchLabels:
+                  app: nginx
+              topologyKey: kubernetes.io/hostname
+      containers:
+        - name: nginx # main container
+          image: nginx
+`
+
+// migratedTemplate decodes the pod template of the deployment in doc.
+// Native label keys of pod affinity are newer than corev1, so terms are decoded as the types of kep3633.
+func migratedTemplate(t *testing.T, doc []byte) (annotations map[string]string, hardTerms []kep3633.PodAffinityTerm, constraints []corev1.TopologySpreadConstraint) {
+	t.Helper()
+	deployment := struct {
+		Spec struct {
+			Template struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+				Spec struct {
+					Affinity struct {
+						PodAntiAffinity struct {
+							RequiredDuringSchedulingIgnoredDuringExecution []kep3633.PodAffinityTerm `json:"requiredDuringSchedulingIgnoredDuringExecution"`
+						} `json:"podAntiAffinity"`
+					} `json:"affinity"`
+					TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}{}
+	err := yaml.Unmarshal(doc, &deployment)
+	if err != nil {
+		t.Fatalf("failed to decode migrated deployment: %v", err)
+	}
+	template := deployment.Spec.Template
+	return template.Metadata.Annotations, template.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, template.Spec.TopologySpreadConstraints
+}
+
+func TestMigrateToNative(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runMigrateToNative(nil, strings.NewReader(migrateTestDeployment), stdout, stderr)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	for _, comment := range []string{"# nginx deployment", "# scheduling", "# main container"} {
+		if !strings.Contains(stdout.String(), comment) {
+			t.Errorf("comment %q should be preserved: %s", comment, stdout.String())
+		}
+	}
+	if strings.Contains(stdout.String(), "{") {
+		t.Errorf("terms should be written in block style: %s", stdout.String())
+	}
+
+	annotations, hardTerms, constraints := migratedTemplate(t, stdout.Bytes())
+	if len(annotations) != 0 {
+		t.Errorf("annotations should be removed: %v", annotations)
+	}
+	if len(hardTerms) != 2 || hardTerms[0].TopologyKey != "kubernetes.io/hostname" ||
+		hardTerms[1].TopologyKey != "topology.kubernetes.io/zone" || len(hardTerms[1].MatchLabelKeys) != 1 || hardTerms[1].MatchLabelKeys[0] != "pod-template-hash" {
+		t.Errorf("terms should be appended to spec: %#v", hardTerms)
+	}
+	if len(constraints) != 1 || constraints[0].WhenUnsatisfiable != corev1.DoNotSchedule || len(constraints[0].MatchLabelKeys) != 1 {
+		t.Errorf("constraints should be added to spec: %#v", constraints)
+	}
+}
+
+func TestMigrateToNativeRefused(t *testing.T) {
+	pod := `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  labels:
+    app: web
+    tenant: a
+  annotations:
+    kep-3633-alt.10h.in/podAffinity.requiredDuringSchedulingIgnoredDuringExecution: '[{"labelSelector": {"matchLabels": {"app": "web"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["tenant"]}]'
+    kep-3633-alt.10h.in/podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution: '[{"labelSelector": {"matchLabels": {"app": "web"}}, "topologyKey": "kubernetes.io/hostname", "matchLableKeys": ["tenant"]}]'
+    kep-3633-alt.10h.in/topologySpreadConstraints: '[{"maxSkew": 1, "topologyKey": "kubernetes.io/hostname", "whenUnsatisfiable": "DoNotSchedule", "labelSelector": {"matchLabels": {"app": "web"}}, "mismatchLabelKeys": ["tenant"]}]'
+spec:
+  containers:
+    - name: web
+      image: nginx
+`
+	path := filepath.Join(t.TempDir(), "pod.yaml")
+	err := os.WriteFile(path, []byte(pod), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runMigrateToNative([]string{"-in-place", path}, nil, stdout, stderr)
+	if code != 1 {
+		t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	for _, report := range []string{
+		"refused annotation kep-3633-alt.10h.in/podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution: json: unknown field \"matchLableKeys\"",
+		"refused annotation kep-3633-alt.10h.in/topologySpreadConstraints: json: unknown field \"mismatchLabelKeys\"",
+		"2 annotations cannot be expressed natively",
+	} {
+		if !strings.Contains(stderr.String(), report) {
+			t.Errorf("%q should be reported: %s", report, stderr.String())
+		}
+	}
+
+	migrated, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			Affinity struct {
+				PodAffinity struct {
+					RequiredDuringSchedulingIgnoredDuringExecution []kep3633.PodAffinityTerm `json:"requiredDuringSchedulingIgnoredDuringExecution"`
+				} `json:"podAffinity"`
+			} `json:"affinity"`
+		} `json:"spec"`
+	}{}
+	err = yaml.Unmarshal(migrated, &obj)
+	if err != nil {
+		t.Fatalf("failed to decode migrated pod: %v", err)
+	}
+	if terms := obj.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution; len(terms) != 1 || terms[0].MatchLabelKeys[0] != "tenant" {
+		t.Errorf("terms expressible natively should be migrated: %#v", terms)
+	}
+	if len(obj.Metadata.Annotations) != 2 {
+		t.Errorf("refused annotations should be left unchanged: %v", obj.Metadata.Annotations)
+	}
+}
+
+func TestMigrateToNativeExpanded(t *testing.T) {
+	pod := `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  annotations:
+    kep-3633-alt.10h.in/topologySpreadConstraints: '[{"maxSkew": 1, "topologyKey": "kubernetes.io/hostname", "whenUnsatisfiable": "DoNotSchedule", "matchLabelKeys": ["app"]}]'
+    kep-3633-alt.10h.in/injected: '{}'
+`
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runMigrateToNative(nil, strings.NewReader(pod), stdout, stderr)
+	if code != 1 || !strings.Contains(stderr.String(), "already been expanded") {
+		t.Errorf("expanded pods should be refused: %d: %s", code, stderr.String())
+	}
+	out := map[string]interface{}{}
+	err := yaml.Unmarshal(stdout.Bytes(), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := out["spec"]; ok {
+		t.Errorf("expanded pods should be left unchanged: %v", out)
+	}
+}
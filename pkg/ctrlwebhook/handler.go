@@ -0,0 +1,106 @@
+// Package ctrlwebhook adapts kep3633.Expander to controller-runtime, so that the KEP-3633 polyfill can be mounted
+// in an existing manager instead of running a separate Deployment:
+//
+//	decoder := admission.NewDecoder(mgr.GetScheme())
+//	mgr.GetWebhookServer().Register(ctrlwebhook.Path, &webhook.Admission{
+//		Handler: ctrlwebhook.NewHandler(kep3633.NewExpander(kep3633.Options{}), decoder),
+//	})
+package ctrlwebhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+// Path is the conventional path to register Handler at.
+const Path = "/mutate-kep3633"
+
+var podsv1GVR = metav1.GroupVersionResource{
+	Group:    "",
+	Version:  "v1",
+	Resource: "pods",
+}
+
+// Handler implements admission.Handler which expands annotations of pods on creation.
+//
+// The decision on pods is kep3633.Expander.Admit, shared with the standalone webhook: invalid annotations deny the pod
+// (or admit it with a warning and the error in the status annotation, with WarnOnUserError), and missing label keys are reported as warnings
+// (or deny the pod, with StrictLabelKeys or the strictLabelKeys annotation).
+// Metrics and events of the standalone webhook are not recorded.
+type Handler struct {
+	Expander *kep3633.Expander
+	Decoder  *admission.Decoder
+	// StrictLabelKeys denies pods with label keys missing in their labels regardless of the pod annotation.
+	StrictLabelKeys bool
+	// WarnOnUserError admits pods whose annotation cannot be applied unchanged with a warning, instead of denying them.
+	WarnOnUserError bool
+}
+
+var _ admission.Handler = &Handler{}
+
+// NewHandler returns Handler expanding pods decoded by decoder with expander.
+func NewHandler(expander *kep3633.Expander, decoder *admission.Decoder) *Handler {
+	return &Handler{
+		Expander: expander,
+		Decoder:  decoder,
+	}
+}
+
+// Handle implements admission.Handler.
+func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	dryRun := req.DryRun != nil && *req.DryRun
+	logger := log.FromContext(ctx).WithValues("uid", req.UID, "namespace", req.Namespace, "user", req.UserInfo.Username, "dryRun", dryRun)
+
+	if req.Operation != admissionv1.Create {
+		return admission.Errored(http.StatusMethodNotAllowed, fmt.Errorf("operation %s is not supported; accept only CREATE", req.Operation))
+	}
+	if req.Resource != podsv1GVR || req.SubResource != "" {
+		return admission.Errored(http.StatusBadRequest, fmt.Errorf("resource %s is not supported; accept only core/v1/pods", req.Resource.String()))
+	}
+
+	pod := &corev1.Pod{}
+	err := h.Decoder.Decode(req, pod)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, fmt.Errorf("failed to decode request.object as core/v1/pods: %w", err))
+	}
+	name := pod.Name
+	if name == "" && pod.GenerateName != "" {
+		name = pod.GenerateName + "*"
+	}
+	logger = logger.WithValues("pod", name)
+
+	a, err := h.Expander.Admit(req.Object.Raw, pod, kep3633.AdmissionOptions{
+		StrictLabelKeys: h.StrictLabelKeys,
+		WarnOnUserError: h.WarnOnUserError,
+	}, logger)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if a.Denied != nil {
+		status := a.Denied.Status()
+		return admission.Response{
+			AdmissionResponse: admissionv1.AdmissionResponse{
+				Allowed: false,
+				Result:  &status,
+			},
+		}
+	}
+
+	resp := admission.Allowed("").WithWarnings(a.Warnings...)
+	resp.AuditAnnotations = a.AuditAnnotations
+	if a.Patch != nil {
+		patchType := admissionv1.PatchTypeJSONPatch
+		resp.PatchType = &patchType
+		resp.Patch = a.Patch
+	}
+	return resp
+}
@@ -0,0 +1,168 @@
+package ctrlwebhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v5"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+type testHandleCase struct {
+	Name             string
+	Annotations      map[string]string
+	Operation        admissionv1.Operation
+	StrictLabelKeys  bool
+	WarnOnUserError  bool
+	ExpectedAllowed  bool
+	ExpectedCode     int32
+	ExpectedPatched  bool
+	ExpectedInjected int
+	ExpectedWarnings int
+}
+
+func TestHandle(t *testing.T) {
+	antiAffinityKey := kep3633.DefaultAnnotationPrefix + "/" + kep3633.AnnotationNamePodAntiAffinityHard
+	validTerms := `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}]`
+	missingTerms := `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["missing"]}]`
+
+	testCases := []testHandleCase{
+		{
+			Name:            "without annotations",
+			ExpectedAllowed: true,
+		},
+		{
+			Name:             "terms are injected",
+			Annotations:      map[string]string{antiAffinityKey: validTerms},
+			ExpectedAllowed:  true,
+			ExpectedPatched:  true,
+			ExpectedInjected: 1,
+		},
+		{
+			Name:            "broken annotation is denied",
+			Annotations:     map[string]string{antiAffinityKey: `{`},
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectedAllowed: false,
+		},
+		{
+			Name:             "broken annotation is warned",
+			Annotations:      map[string]string{antiAffinityKey: `{`},
+			WarnOnUserError:  true,
+			ExpectedAllowed:  true,
+			ExpectedPatched:  true,
+			ExpectedInjected: 0,
+			ExpectedWarnings: 1,
+		},
+		{
+			Name:             "missing label key is warned",
+			Annotations:      map[string]string{antiAffinityKey: missingTerms},
+			ExpectedAllowed:  true,
+			ExpectedPatched:  true,
+			ExpectedInjected: 1,
+			ExpectedWarnings: 1,
+		},
+		{
+			Name:            "missing label key is denied in strict mode",
+			Annotations:     map[string]string{antiAffinityKey: missingTerms},
+			StrictLabelKeys: true,
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectedAllowed: false,
+		},
+		{
+			Name:            "update is not supported",
+			Annotations:     map[string]string{antiAffinityKey: validTerms},
+			Operation:       admissionv1.Update,
+			ExpectedCode:    http.StatusMethodNotAllowed,
+			ExpectedAllowed: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		handler := NewHandler(kep3633.NewExpander(kep3633.Options{}), admission.NewDecoder(scheme.Scheme))
+		handler.StrictLabelKeys = testCase.StrictLabelKeys
+		handler.WarnOnUserError = testCase.WarnOnUserError
+
+		pod := &corev1.Pod{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "nginx",
+				Namespace:   "default",
+				Labels:      map[string]string{"app": "nginx", "pod-template-hash": "abcdef"},
+				Annotations: testCase.Annotations,
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx"}}},
+		}
+		podBytes, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		operation := testCase.Operation
+		if operation == "" {
+			operation = admissionv1.Create
+		}
+		req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			UID:       "uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  podsv1GVR,
+			Namespace: "default",
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: podBytes},
+		}}
+
+		resp := handler.Handle(context.Background(), req)
+		if resp.Allowed != testCase.ExpectedAllowed {
+			t.Errorf("%s: unexpected allowed: %#v", testCase.Name, resp.Result)
+			continue
+		}
+		if testCase.ExpectedCode != 0 && (resp.Result == nil || resp.Result.Code != testCase.ExpectedCode) {
+			t.Errorf("%s: unexpected result: %#v", testCase.Name, resp.Result)
+		}
+		if len(resp.Warnings) != testCase.ExpectedWarnings {
+			t.Errorf("%s: unexpected warnings: %s", testCase.Name, strings.Join(resp.Warnings, "; "))
+		}
+		if testCase.ExpectedPatched != (resp.Patch != nil) {
+			t.Errorf("%s: unexpected patch: %s", testCase.Name, string(resp.Patch))
+			continue
+		}
+		if !testCase.ExpectedPatched {
+			continue
+		}
+
+		patch, err := jsonpatch.DecodePatch(resp.Patch)
+		if err != nil {
+			t.Errorf("%s: failed to decode patch: %v", testCase.Name, err)
+			continue
+		}
+		patchedBytes, err := patch.Apply(podBytes)
+		if err != nil {
+			t.Errorf("%s: failed to apply patch: %v", testCase.Name, err)
+			continue
+		}
+		patched := &corev1.Pod{}
+		err = json.Unmarshal(patchedBytes, patched)
+		if err != nil {
+			t.Errorf("%s: failed to decode patched pod: %v", testCase.Name, err)
+			continue
+		}
+		injected := 0
+		if patched.Spec.Affinity != nil && patched.Spec.Affinity.PodAntiAffinity != nil {
+			injected = len(patched.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+		}
+		if injected != testCase.ExpectedInjected {
+			t.Errorf("%s: unexpected injected terms: %#v", testCase.Name, patched.Spec.Affinity)
+		}
+		if _, exists := patched.Annotations[kep3633.DefaultAnnotationPrefix+"/"+kep3633.AnnotationNameStatus]; !exists {
+			t.Errorf("%s: status should be recorded: %v", testCase.Name, patched.Annotations)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package kep3633
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Keys of Admission.AuditAnnotations.
+// The API server prefixes them with the webhook name, e.g. "kep3633alt.kubernetes.10h.in/injectedTerms".
+const (
+	AuditAnnotationSources        = "sources"
+	AuditAnnotationInjectedTerms  = "injectedTerms"
+	AuditAnnotationResolvedLabels = "resolvedLabels"
+)
+
+// AdmissionOptions configures Expander.Admit.
+type AdmissionOptions struct {
+	// StrictLabelKeys denies pods with label keys missing in their labels regardless of the pod annotation.
+	StrictLabelKeys bool
+	// WarnOnUserError admits pods whose annotation cannot be applied with a warning and the error in the status annotation,
+	// instead of denying them.
+	WarnOnUserError bool
+}
+
+// Admission is the decision on a pod created through an admission request,
+// shared by the standalone webhook and package ctrlwebhook so that they respond the same.
+type Admission struct {
+	// Allowed reports whether the pod is admitted; Denied is the reason otherwise.
+	Allowed bool
+	Denied  *apierrors.StatusError
+	// Patch is JSON patch relative to the pod as sent in the request, or nil if the pod is admitted unchanged.
+	Patch []byte
+	// Warnings are to be shown to the user.
+	Warnings []string
+	// AuditAnnotations summarize terms injected by Patch for cluster auditors; nil if none are injected.
+	AuditAnnotations map[string]string
+	// Result is the expansion, or nil if AnnotationError is set.
+	Result *Result
+	// AnnotationError is the annotation which could not be applied, if any.
+	AnnotationError *AnnotationError
+	// FailureRecorded reports whether AnnotationError is already recorded in the status annotation,
+	// i.e. the pod was admitted with the same error before and is reinvoked.
+	FailureRecorded bool
+}
+
+// Admit decides on pod decoded from raw, the object of a CREATE request of pods:
+// invalid annotations deny the pod (or admit it with a warning and the error in the status annotation, with WarnOnUserError),
+// and missing label keys are warned (or deny the pod, with StrictLabelKeys or the strictLabelKeys annotation).
+// logger is expected to carry the request. Returned error means internal failure.
+func (e *Expander) Admit(raw []byte, pod *corev1.Pod, opts AdmissionOptions, logger logr.Logger) (*Admission, error) {
+	result, err := e.ExpandResult(pod)
+	var annotationErr *AnnotationError
+	if errors.As(err, &annotationErr) {
+		logger.Info("failed to apply annotation", "mutator", annotationErr.Mutator, "annotation", annotationErr.Key, "error", annotationErr.Err.Error())
+		return e.admitUserError(raw, pod, annotationErr, opts, logger), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range result.Changes {
+		if len(change.Duplicates) > 0 {
+			logger.Info("skip terms equal to ones in pod spec", "duplicates", DuplicateTermMessages(change.Duplicates))
+		}
+	}
+
+	a := &Admission{Result: result}
+	if len(result.MissingLabelKeys) > 0 && (opts.StrictLabelKeys || pod.Annotations[e.AnnotationKey(AnnotationNameStrictLabelKeys)] == "true") {
+		logger.Info("deny pod with missing label keys in strict mode", "missingLabelKeys", result.MissingLabelKeys)
+		a.Denied = apierrors.NewBadRequest(fmt.Sprintf("label keys not found in pod labels (strict mode): %s", strings.Join(MissingLabelKeyMessages(result.MissingLabelKeys), "; ")))
+		return a, nil
+	}
+
+	a.Allowed = true
+	if len(result.Warnings) > 0 {
+		a.Warnings = WarningMessages(result.Warnings)
+	}
+	if result.UpToDate {
+		logger.V(1).Info("admit pod already mutated", "hash", result.Hash)
+		return a, nil
+	}
+	if !result.Modified {
+		return a, nil
+	}
+	if result.PreviousHash != "" {
+		logger.V(1).Info("replace terms injected by previous invocation", "previousHash", result.PreviousHash, "hash", result.Hash)
+	}
+
+	a.Patch, err = CreateJSONPatchFromRaw(raw, pod, result.Pod)
+	if err != nil {
+		// fail closed; admitting the pod unmodified would silently drop the terms
+		logger.Error(err, "failed to create JSON patch")
+		return &Admission{Result: result, Denied: apierrors.NewInternalError(err)}, nil
+	}
+	a.AuditAnnotations = e.auditAnnotations(result)
+	return a, nil
+}
+
+// admitUserError decides on pod whose annotation could not be applied.
+// Admitted pods are not modified except that the error is recorded in the status annotation.
+func (e *Expander) admitUserError(raw []byte, pod *corev1.Pod, annotationErr *AnnotationError, opts AdmissionOptions, logger logr.Logger) *Admission {
+	a := &Admission{AnnotationError: annotationErr}
+	if !opts.WarnOnUserError {
+		a.Denied = apierrors.NewBadRequest(annotationErr.Error())
+		return a
+	}
+
+	a.Allowed = true
+	a.Warnings = []string{annotationErr.Error() + "; pod admitted; terms not applied"}
+	result, err := e.FailureResult(pod, annotationErr)
+	if err == nil {
+		a.FailureRecorded = !result.Modified
+		if result.Modified {
+			a.Patch, err = CreateJSONPatchFromRaw(raw, pod, result.Pod)
+		}
+	}
+	if err != nil {
+		// the status is informational; admit the pod as configured
+		logger.Error(err, "failed to record error in status annotation")
+		a.Patch = nil
+	}
+	return a
+}
+
+// auditAnnotations summarizes terms injected by result for cluster auditors:
+// source annotation keys, the number of injected terms per kind and label key/value pairs resolved.
+// Values are comma separated and sorted, so that they are stable across reinvocations.
+func (e *Expander) auditAnnotations(result *Result) map[string]string {
+	sources := make([]string, 0, len(result.Changes))
+	injectedTerms := make([]string, 0, len(result.Changes))
+	resolvedKeys := make([]ResolvedLabelKey, 0)
+	for kind, change := range result.Changes {
+		if len(change.Injected) == 0 {
+			continue
+		}
+		sources = append(sources, e.AnnotationKey(kind))
+		injectedTerms = append(injectedTerms, fmt.Sprintf("%s=%d", kind, len(change.Injected)))
+		resolvedKeys = append(resolvedKeys, change.ResolvedLabelKeys...)
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	annotations := map[string]string{
+		AuditAnnotationSources:       joinSorted(sources),
+		AuditAnnotationInjectedTerms: joinSorted(injectedTerms),
+	}
+	if labels := ResolvedLabelPairs(resolvedKeys); len(labels) > 0 {
+		annotations[AuditAnnotationResolvedLabels] = strings.Join(labels, ",")
+	}
+	return annotations
+}
+
+// ResolvedLabelPairs returns sorted key=value pairs of resolvedKeys without duplicates.
+func ResolvedLabelPairs(resolvedKeys []ResolvedLabelKey) []string {
+	set := make(map[string]struct{}, len(resolvedKeys))
+	for _, k := range resolvedKeys {
+		set[k.Key+"="+k.Value] = struct{}{}
+	}
+	pairs := make([]string, 0, len(set))
+	for pair := range set {
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+func joinSorted(values []string) string {
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
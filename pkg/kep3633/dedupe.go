@@ -0,0 +1,250 @@
+package kep3633
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DuplicateTerm describes a term from an annotation which is semantically equal to a term already in the pod spec,
+// and therefore was not injected.
+type DuplicateTerm struct {
+	// Annotation is the annotation name (without prefix) the term comes from.
+	Annotation string
+	// AnnotationKey is the annotation key the term comes from.
+	AnnotationKey string
+	// Index is the index of the term in the annotation.
+	Index int
+	// Path is the JSON pointer to the list of the equal term in the pod spec.
+	Path string
+	// PathIndex is the index of the equal term in the list.
+	PathIndex int
+	// Merged is true when the term was merged into the equal one instead of skipped.
+	Merged bool
+}
+
+// Message describes d to be shown to the user.
+func (d DuplicateTerm) Message() string {
+	action := "skipped"
+	if d.Merged {
+		action = "merged"
+	}
+	field := strings.ReplaceAll(strings.TrimPrefix(d.Path, "/"), "/", ".")
+	return fmt.Sprintf("%s term %s[%d]: equal to %s[%d]", action, d.AnnotationKey, d.Index, field, d.PathIndex)
+}
+
+// DuplicateTermMessages returns messages of duplicates.
+func DuplicateTermMessages(duplicates []DuplicateTerm) []string {
+	messages := make([]string, 0, len(duplicates))
+	for _, d := range duplicates {
+		messages = append(messages, d.Message())
+	}
+	return messages
+}
+
+// withoutDuplicates returns terms from annotationName except the ones listed in duplicates.
+func withoutDuplicates[T any](terms []T, duplicates []DuplicateTerm, annotationName string) []T {
+	skipped := make(map[int]bool)
+	for _, d := range duplicates {
+		if d.Annotation == annotationName {
+			skipped[d.Index] = true
+		}
+	}
+	if len(skipped) == 0 {
+		return terms
+	}
+	filtered := make([]T, 0, len(terms))
+	for idx, term := range terms {
+		if !skipped[idx] {
+			filtered = append(filtered, term)
+		}
+	}
+	return filtered
+}
+
+// dedupePodAffinityTerms returns appending terms which are not equal to any of existing ones.
+// Equal terms need no merge, since PodAffinityTerm has nothing left to merge.
+func dedupePodAffinityTerms(existing, appending []corev1.PodAffinityTerm, annotationName, path string) ([]corev1.PodAffinityTerm, []DuplicateTerm) {
+	filtered := make([]corev1.PodAffinityTerm, 0, len(appending))
+	duplicates := make([]DuplicateTerm, 0)
+	for idx, a := range appending {
+		found := -1
+		for j, e := range existing {
+			if samePodAffinityTerm(e, a) {
+				found = j
+				break
+			}
+		}
+		if found < 0 {
+			filtered = append(filtered, a)
+			continue
+		}
+		duplicates = append(duplicates, DuplicateTerm{
+			Annotation: annotationName,
+			Index:      idx,
+			Path:       path,
+			PathIndex:  found,
+		})
+	}
+	return filtered, duplicates
+}
+
+// dedupeWeightedPodAffinityTerms returns appending terms which are not equal to any of existing ones.
+// With merge, the greater weight of equal terms is set to the existing one in place.
+func dedupeWeightedPodAffinityTerms(existing, appending []corev1.WeightedPodAffinityTerm, annotationName, path string, merge bool) ([]corev1.WeightedPodAffinityTerm, []DuplicateTerm) {
+	filtered := make([]corev1.WeightedPodAffinityTerm, 0, len(appending))
+	duplicates := make([]DuplicateTerm, 0)
+	for idx, a := range appending {
+		found := -1
+		for j, e := range existing {
+			if samePodAffinityTerm(e.PodAffinityTerm, a.PodAffinityTerm) {
+				found = j
+				break
+			}
+		}
+		if found < 0 {
+			filtered = append(filtered, a)
+			continue
+		}
+		d := DuplicateTerm{
+			Annotation: annotationName,
+			Index:      idx,
+			Path:       path,
+			PathIndex:  found,
+		}
+		if merge && a.Weight > existing[found].Weight {
+			d.Merged = true
+			existing[found].Weight = a.Weight
+		}
+		duplicates = append(duplicates, d)
+	}
+	return filtered, duplicates
+}
+
+// dedupeTopologySpreadConstraints returns appending constraints which are not equal to any of existing ones.
+// Without merge, existing constraints are left untouched: an equal constraint is appended if it is stricter
+// and whenUnsatisfiable differs, and skipped otherwise, since the API server rejects constraints
+// with the same topologyKey and whenUnsatisfiable.
+// With merge, the stricter maxSkew and whenUnsatisfiable of equal constraints are set to the existing one in place.
+func dedupeTopologySpreadConstraints(existing, appending []corev1.TopologySpreadConstraint, annotationName, path string, merge bool) ([]corev1.TopologySpreadConstraint, []DuplicateTerm) {
+	filtered := make([]corev1.TopologySpreadConstraint, 0, len(appending))
+	duplicates := make([]DuplicateTerm, 0)
+	for idx, a := range appending {
+		found := -1
+		for j, e := range existing {
+			if sameTopologySpreadConstraint(e, a) {
+				found = j
+				break
+			}
+		}
+		if found < 0 {
+			filtered = append(filtered, a)
+			continue
+		}
+		if !merge && !atLeastAsStrictTopologySpreadConstraint(existing[found], a) && a.WhenUnsatisfiable != existing[found].WhenUnsatisfiable {
+			filtered = append(filtered, a)
+			continue
+		}
+		d := DuplicateTerm{
+			Annotation: annotationName,
+			Index:      idx,
+			Path:       path,
+			PathIndex:  found,
+		}
+		if merge {
+			if a.MaxSkew < existing[found].MaxSkew {
+				existing[found].MaxSkew = a.MaxSkew
+				d.Merged = true
+			}
+			if a.WhenUnsatisfiable == corev1.DoNotSchedule && existing[found].WhenUnsatisfiable != corev1.DoNotSchedule {
+				existing[found].WhenUnsatisfiable = corev1.DoNotSchedule
+				d.Merged = true
+			}
+		}
+		duplicates = append(duplicates, d)
+	}
+	return filtered, duplicates
+}
+
+// samePodAffinityTerm reports whether a and b select the same pods in the same topology.
+func samePodAffinityTerm(a, b corev1.PodAffinityTerm) bool {
+	return a.TopologyKey == b.TopologyKey &&
+		sameStringSet(a.Namespaces, b.Namespaces) &&
+		sameLabelSelector(a.NamespaceSelector, b.NamespaceSelector) &&
+		sameLabelSelector(a.LabelSelector, b.LabelSelector)
+}
+
+// sameTopologySpreadConstraint reports whether a and b spread the same pods over the same domains,
+// regardless of maxSkew and whenUnsatisfiable.
+func sameTopologySpreadConstraint(a, b corev1.TopologySpreadConstraint) bool {
+	return a.TopologyKey == b.TopologyKey &&
+		sameLabelSelector(a.LabelSelector, b.LabelSelector) &&
+		reflect.DeepEqual(a.MinDomains, b.MinDomains) &&
+		reflect.DeepEqual(a.NodeAffinityPolicy, b.NodeAffinityPolicy) &&
+		reflect.DeepEqual(a.NodeTaintsPolicy, b.NodeTaintsPolicy)
+}
+
+// atLeastAsStrictTopologySpreadConstraint reports whether a, the same constraint as b, allows no placement b does not.
+func atLeastAsStrictTopologySpreadConstraint(a, b corev1.TopologySpreadConstraint) bool {
+	return a.MaxSkew <= b.MaxSkew &&
+		(a.WhenUnsatisfiable == corev1.DoNotSchedule || b.WhenUnsatisfiable != corev1.DoNotSchedule)
+}
+
+// sameLabelSelector reports whether a and b are equal after normalization.
+// nil and empty selectors differ, since they select nothing and everything respectively.
+func sameLabelSelector(a, b *metav1.LabelSelector) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return sameStrings(normalizeLabelSelector(a), normalizeLabelSelector(b))
+}
+
+// normalizeLabelSelector returns requirements of selector in a canonical form;
+// matchLabels are treated as In requirements, and requirements and values are sorted and deduplicated.
+func normalizeLabelSelector(selector *metav1.LabelSelector) []string {
+	requirements := make([]string, 0, len(selector.MatchLabels)+len(selector.MatchExpressions))
+	for key, value := range selector.MatchLabels {
+		requirements = append(requirements, normalizeRequirement(key, metav1.LabelSelectorOpIn, []string{value}))
+	}
+	for _, expr := range selector.MatchExpressions {
+		requirements = append(requirements, normalizeRequirement(expr.Key, expr.Operator, expr.Values))
+	}
+	return sortedUnique(requirements)
+}
+
+func normalizeRequirement(key string, operator metav1.LabelSelectorOperator, values []string) string {
+	return fmt.Sprintf("%s %s (%s)", key, operator, strings.Join(sortedUnique(values), ","))
+}
+
+func sameStringSet(a, b []string) bool {
+	return sameStrings(sortedUnique(a), sortedUnique(b))
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedUnique(values []string) []string {
+	sorted := append(make([]string, 0, len(values)), values...)
+	sort.Strings(sorted)
+	unique := make([]string, 0, len(sorted))
+	for idx, v := range sorted {
+		if idx > 0 && sorted[idx-1] == v {
+			continue
+		}
+		unique = append(unique, v)
+	}
+	return unique
+}
@@ -0,0 +1,267 @@
+package kep3633
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v5"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// CreateJSONPatch returns RFC 6902 JSON patch which turns original into mutated.
+//
+// The patch is applied back to original before returned, and an error is returned unless it reproduces mutated,
+// so that a broken patch never reaches the API server.
+//
+// Fields unknown to corev1.Pod are not considered, so they may be lost or left on shifted list items;
+// use CreateJSONPatchFromRaw with the JSON original is decoded from, e.g. in admission requests.
+func CreateJSONPatch(original, mutated *corev1.Pod) ([]byte, error) {
+	originalBytes, err := json.Marshal(original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal original pod: %w", err)
+	}
+	return CreateJSONPatchFromRaw(originalBytes, original, mutated)
+}
+
+// CreateJSONPatchFromRaw returns RFC 6902 JSON patch which turns originalRaw, the JSON original is decoded from,
+// into mutated.
+//
+// The patch is created against originalRaw rather than original re-encoded, so that fields unknown to corev1.Pod
+// (e.g. ones added by newer Kubernetes versions) are kept: unchanged values and list items are taken from originalRaw,
+// and items changed in place keep the fields of the original item at the same index.
+// The patch is applied back to originalRaw before returned, and an error is returned unless the result
+// decodes into mutated.
+func CreateJSONPatchFromRaw(originalRaw []byte, original, mutated *corev1.Pod) ([]byte, error) {
+	typedOriginalBytes, err := json.Marshal(original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal original pod: %w", err)
+	}
+	mutatedBytes, err := json.Marshal(mutated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal mutated pod: %w", err)
+	}
+
+	var rawDoc, typedOriginalDoc, typedMutatedDoc interface{}
+	err = json.Unmarshal(originalRaw, &rawDoc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal original pod: %w", err)
+	}
+	err = json.Unmarshal(typedOriginalBytes, &typedOriginalDoc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal original pod: %w", err)
+	}
+	err = json.Unmarshal(mutatedBytes, &typedMutatedDoc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal mutated pod: %w", err)
+	}
+
+	mutatedDoc := applyTypedChange(rawDoc, typedOriginalDoc, typedMutatedDoc)
+	patch := diffJSON("", rawDoc, mutatedDoc)
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON patch: %w", err)
+	}
+	mutatedRawBytes, err := json.Marshal(mutatedDoc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal mutated pod: %w", err)
+	}
+
+	err = verifyJSONPatch(originalRaw, mutatedRawBytes, patchBytes)
+	if err != nil {
+		return nil, err
+	}
+	// mutatedDoc is built from originalRaw; it must still decode into mutated
+	mutatedRawPod := &corev1.Pod{}
+	err = json.Unmarshal(mutatedRawBytes, mutatedRawPod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal patched pod: %w", err)
+	}
+	decodedBytes, err := json.Marshal(mutatedRawPod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal patched pod: %w", err)
+	}
+	if !jsonpatch.Equal(decodedBytes, mutatedBytes) {
+		return nil, fmt.Errorf("created JSON patch does not reproduce mutated pod: %s", string(patchBytes))
+	}
+	return patchBytes, nil
+}
+
+// applyTypedChange returns raw changed as typedOriginal, the typed encoding of raw, is changed into typedMutated.
+// Values equal in typedOriginal and typedMutated are taken from raw, as well as list items of typedMutated
+// equal to ones of typedOriginal, so that fields only raw has survive.
+func applyTypedChange(raw, typedOriginal, typedMutated interface{}) interface{} {
+	if reflect.DeepEqual(typedOriginal, typedMutated) {
+		return raw
+	}
+
+	switch mutatedValue := typedMutated.(type) {
+	case map[string]interface{}:
+		rawValue, ok := raw.(map[string]interface{})
+		originalValue, ok2 := typedOriginal.(map[string]interface{})
+		if !ok || !ok2 {
+			break
+		}
+		result := make(map[string]interface{}, len(rawValue))
+		for key, value := range rawValue {
+			_, inOriginal := originalValue[key]
+			_, inMutated := mutatedValue[key]
+			// keep fields only raw has; drop fields removed by the mutation
+			if !inOriginal || inMutated {
+				result[key] = value
+			}
+		}
+		for key, value := range mutatedValue {
+			originalChild, inOriginal := originalValue[key]
+			rawChild, inRaw := rawValue[key]
+			switch {
+			case inOriginal && inRaw:
+				result[key] = applyTypedChange(rawChild, originalChild, value)
+			case inOriginal && reflect.DeepEqual(originalChild, value):
+				// omitted in raw, e.g. a null value of the typed encoding
+			default:
+				result[key] = value
+			}
+		}
+		return result
+	case []interface{}:
+		rawValue, ok := raw.([]interface{})
+		originalValue, ok2 := typedOriginal.([]interface{})
+		if !ok || !ok2 || len(rawValue) != len(originalValue) {
+			break
+		}
+		// items equal to original ones are taken from raw first, so that shifted items keep their own fields;
+		// other items are the original items at the same index changed in place, if any
+		result := make([]interface{}, len(mutatedValue))
+		matched := make([]bool, len(mutatedValue))
+		used := make([]bool, len(originalValue))
+		for idx, item := range mutatedValue {
+			for j := range originalValue {
+				if !used[j] && reflect.DeepEqual(originalValue[j], item) {
+					used[j] = true
+					matched[idx] = true
+					result[idx] = rawValue[j]
+					break
+				}
+			}
+		}
+		for idx, item := range mutatedValue {
+			switch {
+			case matched[idx]:
+			case idx < len(originalValue) && !used[idx]:
+				used[idx] = true
+				result[idx] = applyTypedChange(rawValue[idx], originalValue[idx], item)
+			default:
+				result[idx] = item
+			}
+		}
+		return result
+	}
+	return typedMutated
+}
+
+// verifyJSONPatch returns an error unless patch turns original into mutated.
+func verifyJSONPatch(original, mutated, patch []byte) error {
+	patchObj, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return fmt.Errorf("failed to decode created JSON patch: %w", err)
+	}
+	patched, err := patchObj.Apply(original)
+	if err != nil {
+		return fmt.Errorf("failed to apply created JSON patch: %w", err)
+	}
+	if !jsonpatch.Equal(patched, mutated) {
+		return fmt.Errorf("created JSON patch does not reproduce mutated pod: %s", string(patch))
+	}
+	return nil
+}
+
+// diffJSON returns JSON patch operations which turn a into b, both at path.
+//
+// Objects are compared key by key. Arrays are compared index by index,
+// then extended by appending or shrunk by removing from the end.
+func diffJSON(path string, a, b interface{}) []map[string]interface{} {
+	patch := make([]map[string]interface{}, 0)
+	if reflect.DeepEqual(a, b) {
+		return patch
+	}
+
+	switch aValue := a.(type) {
+	case map[string]interface{}:
+		bValue, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, key := range sortedKeys(aValue) {
+			if _, exists := bValue[key]; !exists {
+				patch = append(patch, map[string]interface{}{
+					"op":   "remove",
+					"path": path + "/" + escapeJSONPointer(key),
+				})
+			}
+		}
+		for _, key := range sortedKeys(bValue) {
+			childPath := path + "/" + escapeJSONPointer(key)
+			aChild, exists := aValue[key]
+			if !exists {
+				patch = append(patch, map[string]interface{}{
+					"op":    "add",
+					"path":  childPath,
+					"value": bValue[key],
+				})
+				continue
+			}
+			patch = append(patch, diffJSON(childPath, aChild, bValue[key])...)
+		}
+		return patch
+	case []interface{}:
+		bValue, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		common := len(aValue)
+		if len(bValue) < common {
+			common = len(bValue)
+		}
+		for idx := 0; idx < common; idx++ {
+			patch = append(patch, diffJSON(path+"/"+strconv.Itoa(idx), aValue[idx], bValue[idx])...)
+		}
+		for idx := len(aValue) - 1; idx >= common; idx-- {
+			patch = append(patch, map[string]interface{}{
+				"op":   "remove",
+				"path": path + "/" + strconv.Itoa(idx),
+			})
+		}
+		for _, item := range bValue[common:] {
+			patch = append(patch, map[string]interface{}{
+				"op":    "add",
+				"path":  path + "/-",
+				"value": item,
+			})
+		}
+		return patch
+	}
+
+	return append(patch, map[string]interface{}{
+		"op":    "replace",
+		"path":  path,
+		"value": b,
+	})
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapeJSONPointer escapes s as a reference token of JSON Pointer (RFC 6901).
+func escapeJSONPointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
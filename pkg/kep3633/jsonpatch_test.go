@@ -0,0 +1,297 @@
+package kep3633
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v5"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type testCreateJSONPatchCase struct {
+	Name        string
+	Prepare     func(pod *corev1.Pod)
+	Mutate      func(pod *corev1.Pod)
+	ExpectedOps []string
+}
+
+func TestCreateJSONPatch(t *testing.T) {
+	term := corev1.PodAffinityTerm{
+		LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}},
+		TopologyKey:   "kubernetes.io/hostname",
+	}
+	withTerm := func(pod *corev1.Pod) {
+		pod.Spec.Affinity = &corev1.Affinity{
+			PodAntiAffinity: &corev1.PodAntiAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{term},
+			},
+		}
+	}
+
+	testCases := []testCreateJSONPatchCase{
+		{
+			Name:        "no change",
+			Mutate:      func(pod *corev1.Pod) {},
+			ExpectedOps: []string{},
+		},
+		{
+			Name:        "new field is added at once",
+			Mutate:      withTerm,
+			ExpectedOps: []string{"add /spec/affinity"},
+		},
+		{
+			Name:    "appended item is added to the end",
+			Prepare: withTerm,
+			Mutate: func(pod *corev1.Pod) {
+				pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = append(pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, term, term)
+			},
+			ExpectedOps: []string{
+				"add /spec/affinity/podAntiAffinity/requiredDuringSchedulingIgnoredDuringExecution/-",
+				"add /spec/affinity/podAntiAffinity/requiredDuringSchedulingIgnoredDuringExecution/-",
+			},
+		},
+		{
+			Name:    "changed value is replaced",
+			Prepare: withTerm,
+			Mutate: func(pod *corev1.Pod) {
+				pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution[0].TopologyKey = "topology.kubernetes.io/zone"
+			},
+			ExpectedOps: []string{"replace /spec/affinity/podAntiAffinity/requiredDuringSchedulingIgnoredDuringExecution/0/topologyKey"},
+		},
+		{
+			Name: "shrunk list is removed from the end",
+			Mutate: func(pod *corev1.Pod) {
+				withTerm(pod)
+				pod.Spec.Containers = pod.Spec.Containers[1:]
+			},
+			ExpectedOps: []string{"add /spec/affinity", "remove /spec/containers/0"},
+		},
+		{
+			Name: "added annotation key is escaped",
+			Prepare: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{"example.com/c": ""}
+			},
+			Mutate: func(pod *corev1.Pod) {
+				pod.Annotations["example.com/a~b"] = "{}"
+			},
+			ExpectedOps: []string{"add /metadata/annotations/example.com~1a~0b"},
+		},
+		{
+			Name: "removed annotation key is escaped",
+			Prepare: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{"example.com/a~b": "", "example.com/c": ""}
+			},
+			Mutate: func(pod *corev1.Pod) {
+				delete(pod.Annotations, "example.com/a~b")
+			},
+			ExpectedOps: []string{"remove /metadata/annotations/example.com~1a~0b"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		pod := prepareBasicPod()
+		if testCase.Prepare != nil {
+			testCase.Prepare(pod)
+		}
+		mutatedPod := pod.DeepCopy()
+		testCase.Mutate(mutatedPod)
+
+		patchDoc, err := CreateJSONPatch(pod, mutatedPod)
+		if err != nil {
+			t.Errorf("%s: failed to create JSON patch: %v", testCase.Name, err)
+			continue
+		}
+		var patch []map[string]interface{}
+		err = json.Unmarshal(patchDoc, &patch)
+		if err != nil {
+			t.Errorf("%s: failed to decode JSON patch: %v", testCase.Name, err)
+			continue
+		}
+		if len(patch) != len(testCase.ExpectedOps) {
+			t.Errorf("%s: unexpected JSON patch: %s", testCase.Name, string(patchDoc))
+			continue
+		}
+		for idx, expected := range testCase.ExpectedOps {
+			actual := patch[idx]["op"].(string) + " " + patch[idx]["path"].(string)
+			if actual != expected {
+				t.Errorf("%s: unexpected operation[%d]: expected: %s, actual: %s", testCase.Name, idx, expected, actual)
+			}
+		}
+
+		patchedPod, err := applyPatchDocument(pod, patchDoc)
+		if err != nil {
+			t.Errorf("%s: failed to apply JSON patch: %v", testCase.Name, err)
+			continue
+		}
+		patchDoc, err = CreateJSONPatch(mutatedPod, patchedPod)
+		if err != nil || string(patchDoc) != "[]" {
+			t.Errorf("%s: patched pod should be equal to mutated pod: %s, %v", testCase.Name, string(patchDoc), err)
+		}
+	}
+}
+
+func TestVerifyJSONPatch(t *testing.T) {
+	original := []byte(`{"metadata":{"name":"nginx"}}`)
+	mutated := []byte(`{"metadata":{"name":"nginx","labels":{"app":"nginx"}}}`)
+
+	err := verifyJSONPatch(original, mutated, []byte(`[{"op":"add","path":"/metadata/labels","value":{"app":"nginx"}}]`))
+	if err != nil {
+		t.Error("valid patch should be verified", err)
+	}
+	err = verifyJSONPatch(original, mutated, []byte(`[{"op":"add","path":"/metadata/labels","value":{"app":"redis"}}]`))
+	if err == nil {
+		t.Error("patch not reproducing mutated object should be rejected")
+	}
+	err = verifyJSONPatch(original, mutated, []byte(`[{"op":"remove","path":"/spec"}]`))
+	if err == nil {
+		t.Error("patch failing to apply should be rejected")
+	}
+}
+
+func TestCreateJSONPatchFromRaw(t *testing.T) {
+	// matchLabelKeys of affinity terms and spec.futureField are unknown to corev1.Pod
+	originalRaw := []byte(`{
+		"metadata": {"name": "nginx", "labels": {"app": "nginx"}},
+		"spec": {
+			"futureField": {"enabled": true},
+			"containers": [{"name": "nginx", "image": "nginx"}],
+			"affinity": {"podAntiAffinity": {"requiredDuringSchedulingIgnoredDuringExecution": [
+				{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]},
+				{"labelSelector": {"matchLabels": {"app": "old"}}, "topologyKey": "kubernetes.io/hostname"}
+			]}}
+		}
+	}`)
+	original := &corev1.Pod{}
+	err := json.Unmarshal(originalRaw, original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replace the second term with two, like strip and replace on reinvocation, so that the list changes its length
+	mutated := original.DeepCopy()
+	terms := mutated.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	mutated.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = []corev1.PodAffinityTerm{
+		terms[0],
+		{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "new"}}, TopologyKey: "kubernetes.io/hostname"},
+		{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "new"}}, TopologyKey: "topology.kubernetes.io/zone"},
+	}
+	mutated.Annotations = map[string]string{"example.com/mutated": "true"}
+
+	patchDoc, err := CreateJSONPatchFromRaw(originalRaw, original, mutated)
+	if err != nil {
+		t.Fatalf("failed to create JSON patch: %v", err)
+	}
+	patchObj, err := jsonpatch.DecodePatch(patchDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := patchObj.Apply(originalRaw)
+	if err != nil {
+		t.Fatalf("failed to apply JSON patch: %v", err)
+	}
+
+	var patchedDoc struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+		Spec     struct {
+			FutureField map[string]interface{} `json:"futureField"`
+			Affinity    struct {
+				PodAntiAffinity struct {
+					RequiredDuringSchedulingIgnoredDuringExecution []PodAffinityTerm `json:"requiredDuringSchedulingIgnoredDuringExecution"`
+				} `json:"podAntiAffinity"`
+			} `json:"affinity"`
+		} `json:"spec"`
+	}
+	err = json.Unmarshal(patched, &patchedDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patchedDoc.Spec.FutureField["enabled"] != true {
+		t.Errorf("unknown field should be kept: %s", string(patched))
+	}
+	patchedTerms := patchedDoc.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(patchedTerms) != 3 || len(patchedTerms[0].MatchLabelKeys) != 1 || patchedTerms[2].TopologyKey != "topology.kubernetes.io/zone" {
+		t.Errorf("unknown fields of untouched terms should be kept: %s", string(patched))
+	}
+	if patchedDoc.Metadata.Annotations["example.com/mutated"] != "true" {
+		t.Errorf("annotations should be added: %s", string(patched))
+	}
+	if strings.Contains(string(patchDoc), "creationTimestamp") {
+		t.Errorf("fields omitted in raw should not be added: %s", string(patchDoc))
+	}
+}
+
+func TestCreateJSONPatchFromRawMergeAndAppend(t *testing.T) {
+	// the existing term has futureField unknown to corev1.Pod; merge raises its weight and another term is appended
+	expander := NewExpander(Options{DuplicateTermPolicy: DuplicateTermPolicyMerge})
+	originalRaw := []byte(`{
+		"metadata": {
+			"name": "nginx",
+			"labels": {"app": "nginx"},
+			"annotations": {"` + expander.AnnotationKey(AnnotationNamePodAntiAffinitySoft) + `": "[{\"weight\": 100, \"podAffinityTerm\": {\"labelSelector\": {\"matchLabels\": {\"app\": \"nginx\"}}, \"topologyKey\": \"kubernetes.io/hostname\"}}, {\"weight\": 10, \"podAffinityTerm\": {\"labelSelector\": {\"matchLabels\": {\"app\": \"nginx\"}}, \"topologyKey\": \"topology.kubernetes.io/zone\"}}]"}
+		},
+		"spec": {
+			"containers": [{"name": "nginx", "image": "nginx"}],
+			"affinity": {"podAntiAffinity": {"preferredDuringSchedulingIgnoredDuringExecution": [
+				{"weight": 1, "podAffinityTerm": {"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname"}, "futureField": true}
+			]}}
+		}
+	}`)
+	original := &corev1.Pod{}
+	err := json.Unmarshal(originalRaw, original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := expander.ExpandResult(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patchDoc, err := CreateJSONPatchFromRaw(originalRaw, original, result.Pod)
+	if err != nil {
+		t.Fatalf("failed to create JSON patch: %v", err)
+	}
+	var patch []map[string]interface{}
+	err = json.Unmarshal(patchDoc, &patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	termsPath := "/spec/affinity/podAntiAffinity/preferredDuringSchedulingIgnoredDuringExecution"
+	termOps := make([]string, 0)
+	for _, op := range patch {
+		if path := op["path"].(string); strings.HasPrefix(path, termsPath) {
+			termOps = append(termOps, op["op"].(string)+" "+path)
+		}
+	}
+	expectedOps := []string{"replace " + termsPath + "/0/weight", "add " + termsPath + "/-"}
+	if strings.Join(termOps, ", ") != strings.Join(expectedOps, ", ") {
+		t.Errorf("unexpected operations on terms: expected: %v, actual: %v", expectedOps, termOps)
+	}
+
+	patchObj, err := jsonpatch.DecodePatch(patchDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := patchObj.Apply(originalRaw)
+	if err != nil {
+		t.Fatalf("failed to apply JSON patch: %v", err)
+	}
+	var patchedDoc struct {
+		Spec struct {
+			Affinity struct {
+				PodAntiAffinity struct {
+					PreferredDuringSchedulingIgnoredDuringExecution []map[string]interface{} `json:"preferredDuringSchedulingIgnoredDuringExecution"`
+				} `json:"podAntiAffinity"`
+			} `json:"affinity"`
+		} `json:"spec"`
+	}
+	err = json.Unmarshal(patched, &patchedDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	terms := patchedDoc.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+	if len(terms) != 2 || terms[0]["weight"] != float64(100) || terms[0]["futureField"] != true {
+		t.Errorf("merged term should keep unknown fields: %s", string(patched))
+	}
+}
@@ -0,0 +1,260 @@
+// Package kep3633 expands pod annotations describing KEP-3633 matchLabelKeys and mismatchLabelKeys into pod spec.
+//
+// Terms of podAffinity, podAntiAffinity and topologySpreadConstraints are written in annotations
+// (e.g. "kep-3633-alt.10h.in/podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution") as JSON,
+// and Expand appends them to the spec with label keys resolved to requirements on the pod labels.
+// The webhook applies it on pod creation; controllers rendering pod templates can apply the same semantics
+// before objects reach the API server.
+package kep3633
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultAnnotationPrefix is the prefix of annotation keys unless configured otherwise.
+	DefaultAnnotationPrefix = "kep-3633-alt.10h.in"
+
+	AnnotationNamePodAffinitySoft           = "podAffinity.preferredDuringSchedulingIgnoredDuringExecution"
+	AnnotationNamePodAffinityHard           = "podAffinity.requiredDuringSchedulingIgnoredDuringExecution"
+	AnnotationNamePodAntiAffinitySoft       = "podAntiAffinity.preferredDuringSchedulingIgnoredDuringExecution"
+	AnnotationNamePodAntiAffinityHard       = "podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution"
+	AnnotationNameTopologySpreadConstraints = "topologySpreadConstraints"
+	// AnnotationNameMissingLabelKeys is written by Expand with label keys not found in pod labels.
+	AnnotationNameMissingLabelKeys = "missingLabelKeys"
+	// AnnotationNameInjected is written by Expand with the provenance of injected terms.
+	AnnotationNameInjected = "injected"
+	// AnnotationNameStatus is written by Expand with Status describing what it did for each source annotation.
+	AnnotationNameStatus = "status"
+	// AnnotationNameStrictLabelKeys set to "true" asks admission webhooks to deny the pod with missing label keys.
+	AnnotationNameStrictLabelKeys = "strictLabelKeys"
+
+	fieldNameMatchLabelKeys    = "matchLabelKeys"
+	fieldNameMismatchLabelKeys = "mismatchLabelKeys"
+)
+
+// DuplicateTermPolicy tells how to handle terms equal to ones already in pod spec.
+type DuplicateTermPolicy string
+
+const (
+	// DuplicateTermPolicySkip skips equal terms.
+	DuplicateTermPolicySkip DuplicateTermPolicy = "skip"
+	// DuplicateTermPolicyMerge merges weight, maxSkew and whenUnsatisfiable of equal terms into the existing ones.
+	DuplicateTermPolicyMerge DuplicateTermPolicy = "merge"
+)
+
+// Options configures Expander. Zero values mean defaults.
+type Options struct {
+	// AnnotationPrefix is the prefix of annotation keys; DefaultAnnotationPrefix if empty.
+	AnnotationPrefix string
+	// DuplicateTermPolicy is DuplicateTermPolicySkip if empty.
+	DuplicateTermPolicy DuplicateTermPolicy
+	// FeatureGates enables or disables mutators by name; mutators not listed are enabled.
+	FeatureGates map[string]bool
+	// Logger receives diagnostics not worth a Warning; discarded if not set.
+	Logger logr.Logger
+}
+
+// AnnotationKey returns the annotation key of name under the configured prefix.
+func (o *Options) AnnotationKey(name string) string {
+	return o.AnnotationPrefix + "/" + name
+}
+
+// Expander expands annotations of pods according to its Options.
+type Expander struct {
+	opts Options
+}
+
+// NewExpander returns Expander with opts, defaulting unset ones.
+func NewExpander(opts Options) *Expander {
+	if opts.AnnotationPrefix == "" {
+		opts.AnnotationPrefix = DefaultAnnotationPrefix
+	}
+	if opts.DuplicateTermPolicy == "" {
+		opts.DuplicateTermPolicy = DuplicateTermPolicySkip
+	}
+	if opts.Logger.GetSink() == nil {
+		opts.Logger = logr.Discard()
+	}
+	return &Expander{opts: opts}
+}
+
+// AnnotationKey returns the annotation key of name under the configured prefix.
+func (e *Expander) AnnotationKey(name string) string {
+	return e.opts.AnnotationKey(name)
+}
+
+// Expand expands pod with default Options. See Expander.Expand.
+func Expand(pod *corev1.Pod) (*corev1.Pod, []Warning, error) {
+	return NewExpander(Options{}).Expand(pod)
+}
+
+// Expand returns a copy of pod with terms in its annotations appended to the spec, and warnings to be shown to the user.
+// pod itself is not modified. Error is *AnnotationError when an annotation is invalid.
+func (e *Expander) Expand(pod *corev1.Pod) (*corev1.Pod, []Warning, error) {
+	result, err := e.ExpandResult(pod)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result.Pod, result.Warnings, nil
+}
+
+// Result describes what Expander.ExpandResult did to a pod.
+type Result struct {
+	// Pod is the expanded copy of the pod.
+	Pod *corev1.Pod
+	// Modified reports whether Pod was rewritten from the annotations, so that a patch is to be created.
+	Modified bool
+	// UpToDate reports whether the pod was already expanded from the same annotations, labels and options,
+	// so that nothing is changed.
+	UpToDate bool
+	// Hash is the hash of annotations, labels and options the terms are computed from.
+	Hash string
+	// PreviousHash is Hash recorded by the previous expansion, or empty if the pod has not been expanded.
+	PreviousHash string
+	// Changes maps annotation name (without prefix) to the change made from it.
+	Changes map[string]*Change
+	// MissingLabelKeys are label keys not found in pod labels, of all annotations.
+	MissingLabelKeys []MissingLabelKey
+	// Warnings are to be shown to the user.
+	Warnings []Warning
+	// Status is recorded in the status annotation of Pod.
+	Status *Status
+}
+
+// Warning is a problem found in expansion which does not prevent it.
+type Warning struct {
+	// Annotation is the key of the annotation the warning is about.
+	Annotation string
+	// Message describes the problem, including the annotation key.
+	Message string
+}
+
+func (w Warning) String() string {
+	return w.Message
+}
+
+// WarningMessages returns messages of warnings.
+func WarningMessages(warnings []Warning) []string {
+	messages := make([]string, 0, len(warnings))
+	for _, w := range warnings {
+		messages = append(messages, w.Message)
+	}
+	return messages
+}
+
+// AnnotationError is returned when an annotation cannot be applied, e.g. broken JSON or invalid label keys.
+type AnnotationError struct {
+	// Mutator is the name of the mutator which failed.
+	Mutator string
+	// Annotation is the annotation name (without prefix).
+	Annotation string
+	// Key is the annotation key.
+	Key string
+	Err error
+}
+
+func (e *AnnotationError) Error() string {
+	return fmt.Sprintf("failed to apply annotation %q: %v", e.Key, e.Err)
+}
+
+func (e *AnnotationError) Unwrap() error {
+	return e.Err
+}
+
+// ExpandResult is Expand which returns the details of the expansion.
+//
+// On re-expansion (e.g. webhook reinvocation), terms injected by the previous expansion are already in the pod.
+// They are replaced with the recomputed ones, or kept as they are when nothing they depend on has changed.
+func (e *Expander) ExpandResult(pod *corev1.Pod) (*Result, error) {
+	labels := pod.GetLabels()
+	annotations := pod.GetAnnotations()
+	enabled := e.enabledMutators()
+
+	prov := e.readProvenance(annotations)
+	mutatedPod := pod.DeepCopy()
+	err := stripInjectedTerms(mutatedPod, prov)
+	if err != nil {
+		return nil, fmt.Errorf("failed to strip injected terms: %w", err)
+	}
+
+	result := &Result{
+		Pod:              mutatedPod,
+		Changes:          make(map[string]*Change, len(enabled)),
+		MissingLabelKeys: make([]MissingLabelKey, 0),
+		Warnings:         make([]Warning, 0),
+		Status:           &Status{Sources: make([]SourceStatus, 0)},
+	}
+	if prov != nil {
+		result.PreviousHash = prov.Hash
+	}
+
+	needPatch := prov != nil
+	for _, m := range enabled {
+		change, warnings, err := m.Mutate(mutatedPod, labels, annotations, &e.opts)
+		if err != nil {
+			return nil, &AnnotationError{
+				Mutator:    m.Name(),
+				Annotation: m.AnnotationName(),
+				Key:        e.opts.AnnotationKey(m.AnnotationName()),
+				Err:        err,
+			}
+		}
+		if change == nil {
+			continue
+		}
+		needPatch = true
+		result.Changes[m.AnnotationName()] = change
+		result.Status.Sources = append(result.Status.Sources, newSourceStatus(mutatedPod, e.opts.AnnotationKey(m.AnnotationName()), m.AnnotationName(), change))
+		result.MissingLabelKeys = append(result.MissingLabelKeys, change.MissingLabelKeys...)
+		result.Warnings = append(result.Warnings, warnings...)
+	}
+
+	result.Hash, err = e.sourceHash(annotations, labels, annotationNames(enabled))
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash sources of terms: %w", err)
+	}
+	if prov != nil && prov.Hash == result.Hash {
+		present, err := injectedTermsPresent(pod, prov)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find injected terms: %w", err)
+		}
+		if present {
+			result.Pod = pod.DeepCopy()
+			result.UpToDate = true
+			return result, nil
+		}
+	}
+	if !needPatch {
+		return result, nil
+	}
+
+	newProv, err := newProvenance(result.Hash, result.Changes)
+	if err != nil {
+		return nil, err
+	}
+	provBytes, err := json.Marshal(newProv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal provenance: %w", err)
+	}
+	mutatedPod.Annotations[e.opts.AnnotationKey(AnnotationNameInjected)] = string(provBytes)
+
+	delete(mutatedPod.Annotations, e.opts.AnnotationKey(AnnotationNameMissingLabelKeys))
+	if len(result.MissingLabelKeys) > 0 {
+		missingKeysBytes, err := json.Marshal(result.MissingLabelKeys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal missing label keys: %w", err)
+		}
+		mutatedPod.Annotations[e.opts.AnnotationKey(AnnotationNameMissingLabelKeys)] = string(missingKeysBytes)
+	}
+	_, err = e.writeStatus(mutatedPod, result.Status)
+	if err != nil {
+		return nil, err
+	}
+	result.Modified = true
+	return result, nil
+}
@@ -0,0 +1,281 @@
+package kep3633
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v5"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExpand(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx", "pod-template-hash": "abcdef"}
+	pod.Annotations = map[string]string{
+		DefaultAnnotationPrefix + "/" + AnnotationNamePodAntiAffinityHard: `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash", "missing"]}]`,
+	}
+	original := pod.DeepCopy()
+
+	expanded, warnings, err := Expand(pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !sameJSON(t, pod, original) {
+		t.Error("pod should not be modified")
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, `"missing"`) {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+	if !hardAntiAffinityFieldNonNil(expanded) || len(expanded.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution) != 1 {
+		t.Fatalf("unexpected podAntiAffinity: %#v", expanded.Spec.Affinity)
+	}
+	assertMatchExpressions(t, "podAntiAffinity", expanded.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution[0].LabelSelector, []metav1.LabelSelectorRequirement{
+		{Key: "pod-template-hash", Operator: metav1.LabelSelectorOpIn, Values: []string{"abcdef"}},
+	})
+	if _, exists := expanded.Annotations[DefaultAnnotationPrefix+"/"+AnnotationNameInjected]; !exists {
+		t.Error("provenance should be recorded")
+	}
+
+	// expanding the result again changes nothing
+	result, err := NewExpander(Options{}).ExpandResult(expanded)
+	if err != nil {
+		t.Fatalf("unexpected error on re-expansion: %v", err)
+	}
+	if !result.UpToDate || result.Modified || !sameJSON(t, result.Pod, expanded) {
+		t.Errorf("re-expansion should change nothing: %#v", result)
+	}
+}
+
+func TestExpandOptionsChanged(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx"}
+	pod.Annotations = map[string]string{
+		DefaultAnnotationPrefix + "/" + AnnotationNamePodAntiAffinityHard: `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname"}]`,
+	}
+	expanded, _, err := Expand(pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// terms are recomputed after the duplicate term policy is changed
+	result, err := NewExpander(Options{DuplicateTermPolicy: DuplicateTermPolicyMerge}).ExpandResult(expanded)
+	if err != nil {
+		t.Fatalf("unexpected error on re-expansion: %v", err)
+	}
+	if result.UpToDate || result.PreviousHash == "" || result.PreviousHash == result.Hash {
+		t.Errorf("re-expansion with another duplicate term policy should recompute terms: %#v", result)
+	}
+
+	// stripping the last injected term removes affinity created by the injection
+	result, err = NewExpander(Options{FeatureGates: map[string]bool{"PodAntiAffinityRequired": false}}).ExpandResult(expanded)
+	if err != nil {
+		t.Fatalf("unexpected error on re-expansion: %v", err)
+	}
+	if result.UpToDate || result.Pod.Spec.Affinity != nil {
+		t.Errorf("injected terms of disabled mutator should be stripped with empty affinity: %#v", result.Pod.Spec.Affinity)
+	}
+}
+
+func TestExpandAnnotationError(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Annotations = map[string]string{
+		"example.com/" + AnnotationNameTopologySpreadConstraints: `broken`,
+	}
+
+	_, _, err := NewExpander(Options{AnnotationPrefix: "example.com"}).Expand(pod)
+	var annotationErr *AnnotationError
+	if !errors.As(err, &annotationErr) {
+		t.Fatalf("AnnotationError should be returned: %v", err)
+	}
+	if annotationErr.Mutator != "TopologySpreadConstraints" || annotationErr.Key != "example.com/"+AnnotationNameTopologySpreadConstraints {
+		t.Errorf("unexpected error: %#v", annotationErr)
+	}
+
+	_, _, err = NewExpander(Options{AnnotationPrefix: "example.com", FeatureGates: map[string]bool{"TopologySpreadConstraints": false}}).Expand(pod)
+	if err != nil {
+		t.Errorf("annotation of disabled mutator should be ignored: %v", err)
+	}
+}
+
+func TestPodAffinityTermDeepCopy(t *testing.T) {
+	term := &WeightedPodAffinityTerm{
+		WeightedPodAffinityTerm: corev1.WeightedPodAffinityTerm{Weight: 10},
+		PodAffinityTerm: PodAffinityTerm{
+			PodAffinityTerm: corev1.PodAffinityTerm{
+				LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}},
+				TopologyKey:   "kubernetes.io/hostname",
+			},
+			MatchLabelKeys:    []string{"pod-template-hash"},
+			MismatchLabelKeys: []string{"tenant"},
+		},
+	}
+
+	copied := term.DeepCopy()
+	copied.PodAffinityTerm.LabelSelector.MatchLabels["app"] = "changed"
+	copied.PodAffinityTerm.MatchLabelKeys[0] = "changed"
+	copied.PodAffinityTerm.MismatchLabelKeys[0] = "changed"
+	if term.PodAffinityTerm.LabelSelector.MatchLabels["app"] != "nginx" || term.PodAffinityTerm.MatchLabelKeys[0] != "pod-template-hash" || term.PodAffinityTerm.MismatchLabelKeys[0] != "tenant" {
+		t.Errorf("copy should not share memory with the original: %#v", term)
+	}
+}
+
+// sameJSON reports whether a and b are encoded into the same JSON.
+func sameJSON(t *testing.T, a, b *corev1.Pod) bool {
+	t.Helper()
+	aBytes, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bBytes, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jsonpatch.Equal(aBytes, bBytes)
+}
+
+//
+// utilities
+//
+
+func topologySpreadConstraintsNonNil(pod *corev1.Pod) bool {
+	return pod.Spec.TopologySpreadConstraints != nil
+}
+
+func affinityFieldNonNil(pod *corev1.Pod) bool {
+	return pod.Spec.Affinity != nil
+}
+
+func podAffinityFieldNonNil(pod *corev1.Pod) bool {
+	if !affinityFieldNonNil(pod) {
+		return false
+	}
+	return pod.Spec.Affinity.PodAffinity != nil
+}
+
+func hardAffinityFieldNonNil(pod *corev1.Pod) bool {
+	if !podAffinityFieldNonNil(pod) {
+		return false
+	}
+	return pod.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil
+}
+
+func softAffinityFieldNonNil(pod *corev1.Pod) bool {
+	if !podAffinityFieldNonNil(pod) {
+		return false
+	}
+	return pod.Spec.Affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution != nil
+}
+
+func podAntiAffinityFieldNonNil(pod *corev1.Pod) bool {
+	if !affinityFieldNonNil(pod) {
+		return false
+	}
+	return pod.Spec.Affinity.PodAntiAffinity != nil
+}
+
+func hardAntiAffinityFieldNonNil(pod *corev1.Pod) bool {
+	if !podAntiAffinityFieldNonNil(pod) {
+		return false
+	}
+	return pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil
+}
+
+func softAntiAffinityFieldNonNil(pod *corev1.Pod) bool {
+	if !podAntiAffinityFieldNonNil(pod) {
+		return false
+	}
+	return pod.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution != nil
+}
+
+func assertMatchExpressions(t *testing.T, name string, labelSelector *metav1.LabelSelector, expected []metav1.LabelSelectorRequirement) {
+	t.Helper()
+	if labelSelector == nil {
+		t.Errorf("%s: labelSelector should not be nil", name)
+		return
+	}
+	if labelSelector.MatchLabels["app"] != "nginx" {
+		t.Errorf("%s: matchLabels should be kept: %v", name, labelSelector.MatchLabels)
+	}
+	actual := labelSelector.MatchExpressions
+	if len(actual) != len(expected) {
+		t.Errorf("%s: unexpected matchExpressions: expected: %v, actual: %v", name, expected, actual)
+		return
+	}
+	for idx := range expected {
+		if actual[idx].Key != expected[idx].Key || actual[idx].Operator != expected[idx].Operator || strings.Join(actual[idx].Values, ",") != strings.Join(expected[idx].Values, ",") {
+			t.Errorf("%s: unexpected matchExpressions[%d]: expected: %v, actual: %v", name, idx, expected[idx], actual[idx])
+		}
+	}
+}
+
+// patchMutation applies mutate to a copy of pod, and returns pod patched with JSON patch created from the copy.
+func patchMutation(pod *corev1.Pod, mutate func(mutatedPod *corev1.Pod)) (*corev1.Pod, error) {
+	mutatedPod := pod.DeepCopy()
+	mutate(mutatedPod)
+
+	patchDoc, err := CreateJSONPatch(pod, mutatedPod)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating JSONPatch: %w", err)
+	}
+
+	return applyPatchDocument(pod, patchDoc)
+}
+
+func applyPatchDocument(pod *corev1.Pod, patchDoc []byte) (*corev1.Pod, error) {
+
+	patchObj, err := jsonpatch.DecodePatch(patchDoc)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding JSONPatch into patch object: %w", err)
+	}
+
+	podJSON, err := json.Marshal(pod)
+	if err != nil {
+		return nil, fmt.Errorf("error while encoding pod into JSON: %w", err)
+	}
+
+	patchedPodJSON, err := patchObj.Apply(podJSON)
+	if err != nil {
+		return nil, fmt.Errorf("error while applying patch: %w", err)
+	}
+
+	var patchedPod corev1.Pod
+	err = json.Unmarshal(patchedPodJSON, &patchedPod)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding patched Pod from JSON: %w", err)
+	}
+
+	return &patchedPod, nil
+
+}
+
+func prepareBasicPod() *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Pod",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nginx-00000000-0000",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "nginx",
+					Image: "nginx:mainline-alpine",
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "web",
+							ContainerPort: 80,
+							Protocol:      corev1.ProtocolTCP,
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,249 @@
+package kep3633
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// MissingLabelKey is a key in matchLabelKeys or mismatchLabelKeys which is skipped because the pod does not have the label.
+type MissingLabelKey struct {
+	// Annotation is the annotation key the label key is found in.
+	Annotation string `json:"annotation"`
+	Field      string `json:"field"`
+	Key        string `json:"key"`
+}
+
+// Message describes k to be shown to the user.
+func (k MissingLabelKey) Message() string {
+	return fmt.Sprintf("%s: %s %q is not found in pod labels and skipped", k.Annotation, k.Field, k.Key)
+}
+
+// ResolvedLabelKey is a key in matchLabelKeys or mismatchLabelKeys which is resolved to the value of the pod label.
+type ResolvedLabelKey struct {
+	// Annotation is the annotation key the label key is found in.
+	Annotation string `json:"annotation"`
+	Field      string `json:"field"`
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+}
+
+// MissingLabelKeyMessages returns messages of missingKeys.
+func MissingLabelKeyMessages(missingKeys []MissingLabelKey) []string {
+	msgs := make([]string, 0, len(missingKeys))
+	for _, k := range missingKeys {
+		msgs = append(msgs, k.Message())
+	}
+	return msgs
+}
+
+func createHardAffinitiesAppending(source string, labels map[string]string) ([]corev1.PodAffinityTerm, []ResolvedLabelKey, []MissingLabelKey, error) {
+	var hardAffinities []PodAffinityTerm
+	err := json.Unmarshal(([]byte)(source), &hardAffinities)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	errs := validatePodAffinityTerms(hardAffinities)
+	if len(errs) > 0 {
+		return nil, nil, nil, errs.ToAggregate()
+	}
+	hardAffinitiesAppending := make([]corev1.PodAffinityTerm, 0, len(hardAffinities))
+	resolvedKeys := make([]ResolvedLabelKey, 0)
+	missingKeys := make([]MissingLabelKey, 0)
+	for _, kep3633term := range hardAffinities {
+		term := *(kep3633term.PodAffinityTerm.DeepCopy())
+		labelSelector := term.LabelSelector
+		if labelSelector == nil {
+			// validated to have neither matchLabelKeys nor mismatchLabelKeys
+			hardAffinitiesAppending = append(hardAffinitiesAppending, term)
+			continue
+		}
+		resolved, missing := applyLabelKeys(labelSelector, kep3633term.MatchLabelKeys, kep3633term.MismatchLabelKeys, labels)
+		resolvedKeys = append(resolvedKeys, resolved...)
+		missingKeys = append(missingKeys, missing...)
+		hardAffinitiesAppending = append(hardAffinitiesAppending, term)
+	}
+	return hardAffinitiesAppending, resolvedKeys, missingKeys, nil
+}
+
+func createSoftAffinitiesAppending(source string, labels map[string]string) ([]corev1.WeightedPodAffinityTerm, []ResolvedLabelKey, []MissingLabelKey, error) {
+	var softAffinities []WeightedPodAffinityTerm
+	err := json.Unmarshal(([]byte)(source), &softAffinities)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	errs := validateWeightedPodAffinityTerms(softAffinities)
+	if len(errs) > 0 {
+		return nil, nil, nil, errs.ToAggregate()
+	}
+	softAffinitiesAppending := make([]corev1.WeightedPodAffinityTerm, 0, len(softAffinities))
+	resolvedKeys := make([]ResolvedLabelKey, 0)
+	missingKeys := make([]MissingLabelKey, 0)
+	for _, kep3633WeightedTerm := range softAffinities {
+		weightedTerm := *(kep3633WeightedTerm.WeightedPodAffinityTerm.DeepCopy())
+		weightedTerm.PodAffinityTerm = *(kep3633WeightedTerm.PodAffinityTerm.PodAffinityTerm.DeepCopy())
+		labelSelector := weightedTerm.PodAffinityTerm.LabelSelector
+		if labelSelector == nil {
+			// validated to have neither matchLabelKeys nor mismatchLabelKeys
+			softAffinitiesAppending = append(softAffinitiesAppending, weightedTerm)
+			continue
+		}
+		resolved, missing := applyLabelKeys(labelSelector, kep3633WeightedTerm.PodAffinityTerm.MatchLabelKeys, kep3633WeightedTerm.PodAffinityTerm.MismatchLabelKeys, labels)
+		resolvedKeys = append(resolvedKeys, resolved...)
+		missingKeys = append(missingKeys, missing...)
+		softAffinitiesAppending = append(softAffinitiesAppending, weightedTerm)
+	}
+	return softAffinitiesAppending, resolvedKeys, missingKeys, nil
+}
+
+func createTopologySpreadConstraintsAppending(source string, labels map[string]string) ([]corev1.TopologySpreadConstraint, []ResolvedLabelKey, []MissingLabelKey, error) {
+	var constraints []corev1.TopologySpreadConstraint
+	err := json.Unmarshal(([]byte)(source), &constraints)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	errs := validateTopologySpreadConstraints(constraints)
+	if len(errs) > 0 {
+		return nil, nil, nil, errs.ToAggregate()
+	}
+	resolvedKeys := make([]ResolvedLabelKey, 0)
+	missingKeys := make([]MissingLabelKey, 0)
+
+	constraintsAppending := make([]corev1.TopologySpreadConstraint, 0, len(constraints))
+	for _, constraint := range constraints {
+		constraintAppending := *constraint.DeepCopy()
+		constraintAppending.MatchLabelKeys = nil
+		labelSelector := constraintAppending.LabelSelector
+		if labelSelector == nil {
+			// validated not to have matchLabelKeys
+			constraintsAppending = append(constraintsAppending, constraintAppending)
+			continue
+		}
+		resolved, missing := applyLabelKeys(labelSelector, constraint.MatchLabelKeys, nil, labels)
+		resolvedKeys = append(resolvedKeys, resolved...)
+		missingKeys = append(missingKeys, missing...)
+		constraintsAppending = append(constraintsAppending, constraintAppending)
+	}
+	return constraintsAppending, resolvedKeys, missingKeys, nil
+}
+
+// ValidateLabelKeys validates matchLabelKeys and mismatchLabelKeys of a term according to KEP-3633:
+// they must not be set without labelSelector, each key must be a valid label key,
+// and must appear neither in both lists nor in labelSelector.
+func ValidateLabelKeys(labelSelector *metav1.LabelSelector, matchLabelKeys, mismatchLabelKeys []string, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if labelSelector == nil {
+		if len(matchLabelKeys) > 0 {
+			errs = append(errs, field.Forbidden(fldPath.Child(fieldNameMatchLabelKeys), "must not be specified when labelSelector is not set"))
+		}
+		if len(mismatchLabelKeys) > 0 {
+			errs = append(errs, field.Forbidden(fldPath.Child(fieldNameMismatchLabelKeys), "must not be specified when labelSelector is not set"))
+		}
+		return errs
+	}
+
+	selectorKeys := make(map[string]bool, len(labelSelector.MatchLabels)+len(labelSelector.MatchExpressions))
+	for k := range labelSelector.MatchLabels {
+		selectorKeys[k] = true
+	}
+	for _, requirement := range labelSelector.MatchExpressions {
+		selectorKeys[requirement.Key] = true
+	}
+	matchKeys := make(map[string]bool, len(matchLabelKeys))
+	for _, k := range matchLabelKeys {
+		matchKeys[k] = true
+	}
+
+	for _, fieldName := range []string{fieldNameMatchLabelKeys, fieldNameMismatchLabelKeys} {
+		keys := matchLabelKeys
+		if fieldName == fieldNameMismatchLabelKeys {
+			keys = mismatchLabelKeys
+		}
+		for idx, k := range keys {
+			keyPath := fldPath.Child(fieldName).Index(idx)
+			for _, msg := range validation.IsQualifiedName(k) {
+				errs = append(errs, field.Invalid(keyPath, k, msg))
+			}
+			if selectorKeys[k] {
+				errs = append(errs, field.Invalid(keyPath, k, "exists in both "+fieldName+" and labelSelector"))
+			}
+			if fieldName == fieldNameMismatchLabelKeys && matchKeys[k] {
+				errs = append(errs, field.Invalid(keyPath, k, "exists in both matchLabelKeys and mismatchLabelKeys"))
+			}
+		}
+	}
+	return errs
+}
+
+// MatchLabelKeyToRequirement returns the requirement that the label matchLabelKey has the value in labels,
+// or nil if labels do not have it.
+func MatchLabelKeyToRequirement(matchLabelKey string, labels map[string]string) *metav1.LabelSelectorRequirement {
+	v, exists := labels[matchLabelKey]
+	if exists {
+		return &metav1.LabelSelectorRequirement{
+			Key:      matchLabelKey,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   []string{v},
+		}
+	} else {
+		// In KEP 3243, matchLabelKeys introduced, clearly describes:
+		// "If the key does not exist, the element won't be ignored"
+		// (I think "won't be ignored" must be wrong and "won't be appended")
+		// https://docs.google.com/document/d/12F1YXsvy4SmumPiL3LHMLnuMHvyMqSzDqF-L9J37ZfA/edit?usp=sharing
+		return nil
+	}
+}
+
+// MismatchLabelKeyToRequirement returns the requirement that the label matchLabelKey does not have the value in labels,
+// or nil if labels do not have it.
+func MismatchLabelKeyToRequirement(matchLabelKey string, labels map[string]string) *metav1.LabelSelectorRequirement {
+	v, exists := labels[matchLabelKey]
+	if exists {
+		return &metav1.LabelSelectorRequirement{
+			Key:      matchLabelKey,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   []string{v},
+		}
+	} else {
+		// In KEP 3243, matchLabelKeys introduced, clearly describes:
+		// "If the key does not exist, the element won't be ignored"
+		// (I think "won't be ignored" must be wrong and "won't be appended")
+		// https://docs.google.com/document/d/12F1YXsvy4SmumPiL3LHMLnuMHvyMqSzDqF-L9J37ZfA/edit?usp=sharing
+		return nil
+	}
+}
+
+// applyLabelKeys appends requirements built from matchLabelKeys and mismatchLabelKeys to labelSelector in place,
+// and returns keys resolved with labels and keys not found in labels.
+func applyLabelKeys(labelSelector *metav1.LabelSelector, matchLabelKeys, mismatchLabelKeys []string, labels map[string]string) ([]ResolvedLabelKey, []MissingLabelKey) {
+	resolvedKeys := make([]ResolvedLabelKey, 0)
+	missingKeys := make([]MissingLabelKey, 0)
+	matchExp := labelSelector.MatchExpressions
+	if matchExp == nil {
+		matchExp = make([]metav1.LabelSelectorRequirement, 0, len(matchLabelKeys)+len(mismatchLabelKeys))
+	}
+	for _, k := range matchLabelKeys {
+		requirement := MatchLabelKeyToRequirement(k, labels)
+		if requirement != nil {
+			matchExp = append(matchExp, *requirement)
+			resolvedKeys = append(resolvedKeys, ResolvedLabelKey{Field: fieldNameMatchLabelKeys, Key: k, Value: labels[k]})
+		} else {
+			missingKeys = append(missingKeys, MissingLabelKey{Field: fieldNameMatchLabelKeys, Key: k})
+		}
+	}
+	for _, k := range mismatchLabelKeys {
+		requirement := MismatchLabelKeyToRequirement(k, labels)
+		if requirement != nil {
+			matchExp = append(matchExp, *requirement)
+			resolvedKeys = append(resolvedKeys, ResolvedLabelKey{Field: fieldNameMismatchLabelKeys, Key: k, Value: labels[k]})
+		} else {
+			missingKeys = append(missingKeys, MissingLabelKey{Field: fieldNameMismatchLabelKeys, Key: k})
+		}
+	}
+	labelSelector.MatchExpressions = matchExp
+	return resolvedKeys, missingKeys
+}
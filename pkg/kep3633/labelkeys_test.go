@@ -0,0 +1,194 @@
+package kep3633
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+type testMatchLabelKeyToRequirementCase struct {
+	MatchLabelKey       string
+	Labels              map[string]string
+	IsExpectedResultNil bool
+	ExpectedKeyValue    string
+}
+
+func TestMatchLabelKeyToRequirement(t *testing.T) {
+	testCases := make([]testMatchLabelKeyToRequirementCase, 0)
+
+	// case 1 no matching label key
+	testCases = append(testCases, testMatchLabelKeyToRequirementCase{
+		MatchLabelKey: uuid.New().String(),
+		Labels: map[string]string{
+			uuid.New().String(): uuid.New().String(),
+			uuid.New().String(): uuid.New().String(),
+			uuid.New().String(): uuid.New().String(),
+		},
+		IsExpectedResultNil: true,
+	})
+
+	// case 2 there are matching label key
+	expectedKey1 := uuid.New().String()
+	expectedValue1 := uuid.New().String()
+	testCases = append(testCases, testMatchLabelKeyToRequirementCase{
+		MatchLabelKey: expectedKey1,
+		Labels: map[string]string{
+			expectedKey1:        expectedValue1,
+			uuid.New().String(): uuid.New().String(),
+			uuid.New().String(): uuid.New().String(),
+		},
+		IsExpectedResultNil: false,
+		ExpectedKeyValue:    expectedValue1,
+	})
+
+	// TEST
+	for _, testCase := range testCases {
+		result := MatchLabelKeyToRequirement(testCase.MatchLabelKey, testCase.Labels)
+
+		if testCase.IsExpectedResultNil {
+			if result != nil {
+				t.Error("result should be nil, but not", result)
+			}
+			continue
+		}
+
+		if result.Key != testCase.MatchLabelKey {
+			t.Error("returned requirements has unexpected key: ", result.Key)
+		}
+		if result.Operator != metav1.LabelSelectorOpIn {
+			t.Error("returned requirements has unexpected operator: ", result.Operator)
+		}
+		if result.Values == nil || len(result.Values) != 1 || result.Values[0] != testCase.ExpectedKeyValue {
+			t.Error("returned requirements has unexpected values: ", result.Values)
+		}
+
+	}
+}
+
+func TestMismatchLabelKeyToRequirement(t *testing.T) {
+	testCases := make([]testMatchLabelKeyToRequirementCase, 0)
+
+	// case 1 no matching label key
+	testCases = append(testCases, testMatchLabelKeyToRequirementCase{
+		MatchLabelKey: uuid.New().String(),
+		Labels: map[string]string{
+			uuid.New().String(): uuid.New().String(),
+			uuid.New().String(): uuid.New().String(),
+			uuid.New().String(): uuid.New().String(),
+		},
+		IsExpectedResultNil: true,
+	})
+
+	// case 2 there are matching label key
+	expectedKey1 := uuid.New().String()
+	expectedValue1 := uuid.New().String()
+	testCases = append(testCases, testMatchLabelKeyToRequirementCase{
+		MatchLabelKey: expectedKey1,
+		Labels: map[string]string{
+			expectedKey1:        expectedValue1,
+			uuid.New().String(): uuid.New().String(),
+			uuid.New().String(): uuid.New().String(),
+		},
+		IsExpectedResultNil: false,
+		ExpectedKeyValue:    expectedValue1,
+	})
+
+	// TEST
+	for _, testCase := range testCases {
+		result := MismatchLabelKeyToRequirement(testCase.MatchLabelKey, testCase.Labels)
+
+		if testCase.IsExpectedResultNil {
+			if result != nil {
+				t.Error("result should be nil, but not", result)
+			}
+			continue
+		}
+
+		if result.Key != testCase.MatchLabelKey {
+			t.Error("returned requirements has unexpected key: ", result.Key)
+		}
+		if result.Operator != metav1.LabelSelectorOpNotIn {
+			t.Error("returned requirements has unexpected operator: ", result.Operator)
+		}
+		if result.Values == nil || len(result.Values) != 1 || result.Values[0] != testCase.ExpectedKeyValue {
+			t.Error("returned requirements has unexpected values: ", result.Values)
+		}
+
+	}
+}
+
+type testValidateLabelKeysCase struct {
+	Name              string
+	LabelSelector     *metav1.LabelSelector
+	MatchLabelKeys    []string
+	MismatchLabelKeys []string
+	ExpectedErrors    []string
+}
+
+func TestValidateLabelKeys(t *testing.T) {
+	testCases := []testValidateLabelKeysCase{
+		{
+			Name:              "valid",
+			LabelSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}},
+			MatchLabelKeys:    []string{"pod-template-hash"},
+			MismatchLabelKeys: []string{"example.com/tenant"},
+			ExpectedErrors:    []string{},
+		},
+		{
+			Name:           "nil selector without keys",
+			LabelSelector:  nil,
+			ExpectedErrors: []string{},
+		},
+		{
+			Name:              "nil selector",
+			LabelSelector:     nil,
+			MatchLabelKeys:    []string{"pod-template-hash"},
+			MismatchLabelKeys: []string{"tenant"},
+			ExpectedErrors:    []string{"terms[0].matchLabelKeys: Forbidden", "terms[0].mismatchLabelKeys: Forbidden"},
+		},
+		{
+			Name:              "same key in both lists",
+			LabelSelector:     &metav1.LabelSelector{},
+			MatchLabelKeys:    []string{"tenant"},
+			MismatchLabelKeys: []string{"tenant"},
+			ExpectedErrors:    []string{"terms[0].mismatchLabelKeys[0]: Invalid value: \"tenant\": exists in both matchLabelKeys and mismatchLabelKeys"},
+		},
+		{
+			Name: "key in labelSelector",
+			LabelSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "nginx"},
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "tenant", Operator: metav1.LabelSelectorOpExists},
+				},
+			},
+			MatchLabelKeys:    []string{"app"},
+			MismatchLabelKeys: []string{"tenant"},
+			ExpectedErrors: []string{
+				"terms[0].matchLabelKeys[0]: Invalid value: \"app\": exists in both matchLabelKeys and labelSelector",
+				"terms[0].mismatchLabelKeys[0]: Invalid value: \"tenant\": exists in both mismatchLabelKeys and labelSelector",
+			},
+		},
+		{
+			Name:           "invalid key",
+			LabelSelector:  &metav1.LabelSelector{},
+			MatchLabelKeys: []string{"pod template hash"},
+			ExpectedErrors: []string{"terms[0].matchLabelKeys[0]: Invalid value: \"pod template hash\""},
+		},
+	}
+
+	for _, testCase := range testCases {
+		errs := ValidateLabelKeys(testCase.LabelSelector, testCase.MatchLabelKeys, testCase.MismatchLabelKeys, field.NewPath("terms").Index(0))
+		if len(errs) != len(testCase.ExpectedErrors) {
+			t.Errorf("%s: unexpected errors: %v", testCase.Name, errs)
+			continue
+		}
+		for idx, expected := range testCase.ExpectedErrors {
+			if !strings.HasPrefix(errs[idx].Error(), expected) {
+				t.Errorf("%s: unexpected error: expected: %s, actual: %s", testCase.Name, expected, errs[idx].Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package kep3633
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Mutator applies one kind of annotation to pods.
+//
+// Mutators are registered in mutators and applied in order by Expander.
+// Each can be disabled by the feature gate of its Name.
+type Mutator interface {
+	// Name returns the feature gate name of the mutator.
+	Name() string
+	// AnnotationName returns the name (without prefix) of the annotation the mutator applies.
+	AnnotationName() string
+	// Mutate applies the annotation found in annotations to pod in place, resolving label keys with labels.
+	// It returns nil Change when the annotation is not set, and warnings to be shown to the user.
+	Mutate(pod *corev1.Pod, labels, annotations map[string]string, opts *Options) (*Change, []Warning, error)
+}
+
+// Change describes what a Mutator did to a pod.
+type Change struct {
+	// Injected are terms appended to the pod.
+	Injected []interface{}
+	// Duplicates are terms skipped (or merged) since equal ones are already in the pod.
+	Duplicates []DuplicateTerm
+	// ResolvedLabelKeys are label keys resolved to values of pod labels.
+	ResolvedLabelKeys []ResolvedLabelKey
+	// MissingLabelKeys are label keys not found in pod labels.
+	MissingLabelKeys []MissingLabelKey
+}
+
+var mutators = []Mutator{
+	podAffinityTermsMutator{name: "PodAffinityRequired", annotationName: AnnotationNamePodAffinityHard},
+	weightedPodAffinityTermsMutator{name: "PodAffinityPreferred", annotationName: AnnotationNamePodAffinitySoft},
+	podAffinityTermsMutator{name: "PodAntiAffinityRequired", annotationName: AnnotationNamePodAntiAffinityHard, anti: true},
+	weightedPodAffinityTermsMutator{name: "PodAntiAffinityPreferred", annotationName: AnnotationNamePodAntiAffinitySoft, anti: true},
+	topologySpreadConstraintsMutator{name: "TopologySpreadConstraints", annotationName: AnnotationNameTopologySpreadConstraints},
+}
+
+// Mutators returns all registered mutators in the order they are applied.
+func Mutators() []Mutator {
+	return append(make([]Mutator, 0, len(mutators)), mutators...)
+}
+
+// MutatorNames returns feature gate names of all registered mutators.
+func MutatorNames() []string {
+	names := make([]string, 0, len(mutators))
+	for _, m := range mutators {
+		names = append(names, m.Name())
+	}
+	return names
+}
+
+// AnnotationNames returns annotation names (without prefix) applied by all registered mutators.
+func AnnotationNames() []string {
+	return annotationNames(mutators)
+}
+
+// enabledMutators returns mutators enabled by the feature gates in options.
+func (e *Expander) enabledMutators() []Mutator {
+	enabled := make([]Mutator, 0, len(mutators))
+	for _, m := range mutators {
+		if gate, set := e.opts.FeatureGates[m.Name()]; !set || gate {
+			enabled = append(enabled, m)
+		}
+	}
+	return enabled
+}
+
+func annotationNames(ms []Mutator) []string {
+	names := make([]string, 0, len(ms))
+	for _, m := range ms {
+		names = append(names, m.AnnotationName())
+	}
+	return names
+}
+
+// newChange returns Change and warnings of terms injected from annotationName.
+func newChange[T any](opts *Options, annotationName string, injected []T, resolvedKeys []ResolvedLabelKey, missingKeys []MissingLabelKey, duplicates []DuplicateTerm) (*Change, []Warning) {
+	annotationKey := opts.AnnotationKey(annotationName)
+	change := &Change{
+		Injected:          make([]interface{}, 0, len(injected)),
+		Duplicates:        make([]DuplicateTerm, 0, len(duplicates)),
+		ResolvedLabelKeys: make([]ResolvedLabelKey, 0, len(resolvedKeys)),
+		MissingLabelKeys:  make([]MissingLabelKey, 0, len(missingKeys)),
+	}
+	for _, term := range injected {
+		change.Injected = append(change.Injected, term)
+	}
+	for _, k := range resolvedKeys {
+		k.Annotation = annotationKey
+		change.ResolvedLabelKeys = append(change.ResolvedLabelKeys, k)
+	}
+	warnings := make([]Warning, 0, len(missingKeys)+len(duplicates))
+	for _, k := range missingKeys {
+		k.Annotation = annotationKey
+		change.MissingLabelKeys = append(change.MissingLabelKeys, k)
+		warnings = append(warnings, Warning{Annotation: annotationKey, Message: k.Message()})
+	}
+	for _, d := range duplicates {
+		d.AnnotationKey = annotationKey
+		change.Duplicates = append(change.Duplicates, d)
+		warnings = append(warnings, Warning{Annotation: annotationKey, Message: d.Message()})
+	}
+	return change, warnings
+}
+
+// podAffinityTermsMutator applies requiredDuringSchedulingIgnoredDuringExecution of podAffinity (or podAntiAffinity).
+type podAffinityTermsMutator struct {
+	name           string
+	annotationName string
+	anti           bool
+}
+
+func (m podAffinityTermsMutator) Name() string {
+	return m.name
+}
+
+func (m podAffinityTermsMutator) AnnotationName() string {
+	return m.annotationName
+}
+
+func (m podAffinityTermsMutator) Mutate(pod *corev1.Pod, labels, annotations map[string]string, opts *Options) (*Change, []Warning, error) {
+	source, exists := annotations[opts.AnnotationKey(m.annotationName)]
+	if !exists {
+		return nil, nil, nil
+	}
+	terms, resolvedKeys, missingKeys, err := createHardAffinitiesAppending(source, labels)
+	if err != nil {
+		return nil, nil, err
+	}
+	duplicates := appendPodAffinityTerms(pod, m.anti, terms)
+	terms = withoutDuplicates(terms, duplicates, m.annotationName)
+	change, warnings := newChange(opts, m.annotationName, terms, resolvedKeys, missingKeys, duplicates)
+	return change, warnings, nil
+}
+
+// weightedPodAffinityTermsMutator applies preferredDuringSchedulingIgnoredDuringExecution of podAffinity (or podAntiAffinity).
+type weightedPodAffinityTermsMutator struct {
+	name           string
+	annotationName string
+	anti           bool
+}
+
+func (m weightedPodAffinityTermsMutator) Name() string {
+	return m.name
+}
+
+func (m weightedPodAffinityTermsMutator) AnnotationName() string {
+	return m.annotationName
+}
+
+func (m weightedPodAffinityTermsMutator) Mutate(pod *corev1.Pod, labels, annotations map[string]string, opts *Options) (*Change, []Warning, error) {
+	source, exists := annotations[opts.AnnotationKey(m.annotationName)]
+	if !exists {
+		return nil, nil, nil
+	}
+	terms, resolvedKeys, missingKeys, err := createSoftAffinitiesAppending(source, labels)
+	if err != nil {
+		return nil, nil, err
+	}
+	duplicates := appendWeightedPodAffinityTerms(pod, m.anti, terms, opts.DuplicateTermPolicy == DuplicateTermPolicyMerge)
+	terms = withoutDuplicates(terms, duplicates, m.annotationName)
+	change, warnings := newChange(opts, m.annotationName, terms, resolvedKeys, missingKeys, duplicates)
+	return change, warnings, nil
+}
+
+// topologySpreadConstraintsMutator applies topologySpreadConstraints.
+type topologySpreadConstraintsMutator struct {
+	name           string
+	annotationName string
+}
+
+func (m topologySpreadConstraintsMutator) Name() string {
+	return m.name
+}
+
+func (m topologySpreadConstraintsMutator) AnnotationName() string {
+	return m.annotationName
+}
+
+func (m topologySpreadConstraintsMutator) Mutate(pod *corev1.Pod, labels, annotations map[string]string, opts *Options) (*Change, []Warning, error) {
+	source, exists := annotations[opts.AnnotationKey(m.annotationName)]
+	if !exists {
+		return nil, nil, nil
+	}
+	constraints, resolvedKeys, missingKeys, err := createTopologySpreadConstraintsAppending(source, labels)
+	if err != nil {
+		return nil, nil, err
+	}
+	duplicates := appendTopologySpreadConstraints(pod, constraints, opts.DuplicateTermPolicy == DuplicateTermPolicyMerge)
+	constraints = withoutDuplicates(constraints, duplicates, m.annotationName)
+	change, warnings := newChange(opts, m.annotationName, constraints, resolvedKeys, missingKeys, duplicates)
+	return change, warnings, nil
+}
+
+// appendPodAffinityTerms appends required terms to podAffinity (or podAntiAffinity) of pod.
+// Terms semantically equal to ones already in pod are skipped and returned as duplicates.
+func appendPodAffinityTerms(pod *corev1.Pod, anti bool, appending []corev1.PodAffinityTerm) []DuplicateTerm {
+	if len(appending) == 0 {
+		return make([]DuplicateTerm, 0)
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	var terms *[]corev1.PodAffinityTerm
+	var annotationName, path string
+	if anti {
+		if pod.Spec.Affinity.PodAntiAffinity == nil {
+			pod.Spec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+		}
+		terms = &pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+		annotationName = AnnotationNamePodAntiAffinityHard
+		path = "/spec/affinity/podAntiAffinity/requiredDuringSchedulingIgnoredDuringExecution"
+	} else {
+		if pod.Spec.Affinity.PodAffinity == nil {
+			pod.Spec.Affinity.PodAffinity = &corev1.PodAffinity{}
+		}
+		terms = &pod.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+		annotationName = AnnotationNamePodAffinityHard
+		path = "/spec/affinity/podAffinity/requiredDuringSchedulingIgnoredDuringExecution"
+	}
+	appending, duplicates := dedupePodAffinityTerms(*terms, appending, annotationName, path)
+	*terms = append(*terms, appending...)
+	return duplicates
+}
+
+// appendWeightedPodAffinityTerms appends preferred terms to podAffinity (or podAntiAffinity) of pod.
+// Terms semantically equal to ones already in pod are skipped (or merged, if merge is true)
+// and returned as duplicates.
+func appendWeightedPodAffinityTerms(pod *corev1.Pod, anti bool, appending []corev1.WeightedPodAffinityTerm, merge bool) []DuplicateTerm {
+	if len(appending) == 0 {
+		return make([]DuplicateTerm, 0)
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	var terms *[]corev1.WeightedPodAffinityTerm
+	var annotationName, path string
+	if anti {
+		if pod.Spec.Affinity.PodAntiAffinity == nil {
+			pod.Spec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+		}
+		terms = &pod.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+		annotationName = AnnotationNamePodAntiAffinitySoft
+		path = "/spec/affinity/podAntiAffinity/preferredDuringSchedulingIgnoredDuringExecution"
+	} else {
+		if pod.Spec.Affinity.PodAffinity == nil {
+			pod.Spec.Affinity.PodAffinity = &corev1.PodAffinity{}
+		}
+		terms = &pod.Spec.Affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+		annotationName = AnnotationNamePodAffinitySoft
+		path = "/spec/affinity/podAffinity/preferredDuringSchedulingIgnoredDuringExecution"
+	}
+	appending, duplicates := dedupeWeightedPodAffinityTerms(*terms, appending, annotationName, path, merge)
+	*terms = append(*terms, appending...)
+	return duplicates
+}
+
+// appendTopologySpreadConstraints appends constraints to pod.
+// Constraints semantically equal to ones already in pod are skipped (or merged, if merge is true)
+// and returned as duplicates.
+func appendTopologySpreadConstraints(pod *corev1.Pod, appending []corev1.TopologySpreadConstraint, merge bool) []DuplicateTerm {
+	appending, duplicates := dedupeTopologySpreadConstraints(pod.Spec.TopologySpreadConstraints, appending, AnnotationNameTopologySpreadConstraints, "/spec/topologySpreadConstraints", merge)
+	pod.Spec.TopologySpreadConstraints = append(pod.Spec.TopologySpreadConstraints, appending...)
+	return duplicates
+}
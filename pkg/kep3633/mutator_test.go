@@ -0,0 +1,760 @@
+package kep3633
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// testScaleIndex = 1 for normal tests. testScaleIndex = 2 make tests heavy.
+	testScaleIndex = 1
+)
+
+type testMutatorCase struct {
+	Name             string
+	Source           string
+	Prepare          func(pod *corev1.Pod)
+	ExpectedNil      bool
+	ExpectedErr      bool
+	ExpectedInjected int
+	ExpectedWarnings int
+	Check            func(t *testing.T, name string, pod *corev1.Pod)
+}
+
+func TestPodAffinityTermsMutator(t *testing.T) {
+	for _, m := range []podAffinityTermsMutator{
+		mutatorByName(t, "PodAffinityRequired").(podAffinityTermsMutator),
+		mutatorByName(t, "PodAntiAffinityRequired").(podAffinityTermsMutator),
+	} {
+		terms := func(pod *corev1.Pod) []corev1.PodAffinityTerm {
+			if pod.Spec.Affinity == nil {
+				return nil
+			}
+			if m.anti {
+				if pod.Spec.Affinity.PodAntiAffinity == nil {
+					return nil
+				}
+				return pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+			}
+			if pod.Spec.Affinity.PodAffinity == nil {
+				return nil
+			}
+			return pod.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+		}
+		runMutatorTestCases(t, m, []testMutatorCase{
+			{
+				Name:        "without annotation",
+				ExpectedNil: true,
+			},
+			{
+				Name:             "label keys are applied",
+				Source:           `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"], "mismatchLabelKeys": ["tenant"]}]`,
+				ExpectedInjected: 1,
+				ExpectedWarnings: 1,
+				Check: func(t *testing.T, name string, pod *corev1.Pod) {
+					if len(terms(pod)) != 1 {
+						t.Fatalf("%s: unexpected terms: %#v", name, terms(pod))
+					}
+					assertMatchExpressions(t, name, terms(pod)[0].LabelSelector, []metav1.LabelSelectorRequirement{
+						{Key: "pod-template-hash", Operator: metav1.LabelSelectorOpIn, Values: []string{"abcdef"}},
+					})
+				},
+			},
+			{
+				Name:   "equal term is skipped",
+				Source: `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname"}]`,
+				Prepare: func(pod *corev1.Pod) {
+					term := corev1.PodAffinityTerm{
+						LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}},
+						TopologyKey:   "kubernetes.io/hostname",
+					}
+					if m.anti {
+						pod.Spec.Affinity = &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{term}}}
+					} else {
+						pod.Spec.Affinity = &corev1.Affinity{PodAffinity: &corev1.PodAffinity{RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{term}}}
+					}
+				},
+				ExpectedInjected: 0,
+				ExpectedWarnings: 1,
+				Check: func(t *testing.T, name string, pod *corev1.Pod) {
+					if len(terms(pod)) != 1 {
+						t.Errorf("%s: unexpected terms: %#v", name, terms(pod))
+					}
+				},
+			},
+			{
+				Name:        "broken annotation",
+				Source:      `{`,
+				ExpectedErr: true,
+			},
+		})
+	}
+}
+
+func TestWeightedPodAffinityTermsMutator(t *testing.T) {
+	for _, m := range []weightedPodAffinityTermsMutator{
+		mutatorByName(t, "PodAffinityPreferred").(weightedPodAffinityTermsMutator),
+		mutatorByName(t, "PodAntiAffinityPreferred").(weightedPodAffinityTermsMutator),
+	} {
+		terms := func(pod *corev1.Pod) []corev1.WeightedPodAffinityTerm {
+			if pod.Spec.Affinity == nil {
+				return nil
+			}
+			if m.anti {
+				if pod.Spec.Affinity.PodAntiAffinity == nil {
+					return nil
+				}
+				return pod.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+			}
+			if pod.Spec.Affinity.PodAffinity == nil {
+				return nil
+			}
+			return pod.Spec.Affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+		}
+		runMutatorTestCases(t, m, []testMutatorCase{
+			{
+				Name:        "without annotation",
+				ExpectedNil: true,
+			},
+			{
+				Name:             "label keys are applied",
+				Source:           `[{"weight": 10, "podAffinityTerm": {"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}}]`,
+				ExpectedInjected: 1,
+				Check: func(t *testing.T, name string, pod *corev1.Pod) {
+					if len(terms(pod)) != 1 || terms(pod)[0].Weight != 10 {
+						t.Fatalf("%s: unexpected terms: %#v", name, terms(pod))
+					}
+					assertMatchExpressions(t, name, terms(pod)[0].PodAffinityTerm.LabelSelector, []metav1.LabelSelectorRequirement{
+						{Key: "pod-template-hash", Operator: metav1.LabelSelectorOpIn, Values: []string{"abcdef"}},
+					})
+				},
+			},
+			{
+				Name:        "invalid label keys",
+				Source:      `[{"weight": 10, "podAffinityTerm": {"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["app"]}}]`,
+				ExpectedErr: true,
+			},
+		})
+	}
+}
+
+func TestTopologySpreadConstraintsMutator(t *testing.T) {
+	m := mutatorByName(t, "TopologySpreadConstraints")
+	runMutatorTestCases(t, m, []testMutatorCase{
+		{
+			Name:        "without annotation",
+			ExpectedNil: true,
+		},
+		{
+			Name:             "label keys are applied",
+			Source:           `[{"maxSkew": 1, "topologyKey": "topology.kubernetes.io/zone", "whenUnsatisfiable": "DoNotSchedule", "labelSelector": {"matchLabels": {"app": "nginx"}}, "matchLabelKeys": ["pod-template-hash", "missing"]}]`,
+			ExpectedInjected: 1,
+			ExpectedWarnings: 1,
+			Check: func(t *testing.T, name string, pod *corev1.Pod) {
+				constraints := pod.Spec.TopologySpreadConstraints
+				if len(constraints) != 1 {
+					t.Fatalf("%s: unexpected constraints: %#v", name, constraints)
+				}
+				if constraints[0].MatchLabelKeys != nil {
+					t.Errorf("%s: matchLabelKeys should be removed: %v", name, constraints[0].MatchLabelKeys)
+				}
+				assertMatchExpressions(t, name, constraints[0].LabelSelector, []metav1.LabelSelectorRequirement{
+					{Key: "pod-template-hash", Operator: metav1.LabelSelectorOpIn, Values: []string{"abcdef"}},
+				})
+			},
+		},
+		{
+			Name:        "broken annotation",
+			Source:      `[{"maxSkew": "one"}]`,
+			ExpectedErr: true,
+		},
+	})
+}
+
+func TestEnabledMutators(t *testing.T) {
+	e := NewExpander(Options{})
+	if len(e.enabledMutators()) != len(mutators) {
+		t.Error("all mutators should be enabled by default")
+	}
+
+	e = NewExpander(Options{FeatureGates: map[string]bool{"TopologySpreadConstraints": false, "PodAffinityRequired": true}})
+	for _, m := range e.enabledMutators() {
+		if m.Name() == "TopologySpreadConstraints" {
+			t.Error("disabled mutator should not be enabled")
+		}
+	}
+	if len(e.enabledMutators()) != len(mutators)-1 {
+		t.Error("unexpected enabled mutators", annotationNames(e.enabledMutators()))
+	}
+}
+
+type testCreateAffinityJSONPatchCase struct {
+	BeforeHardAffinities        []corev1.PodAffinityTerm
+	BeforeSoftAffinities        []corev1.WeightedPodAffinityTerm
+	BeforeHardAntiAffinities    []corev1.PodAffinityTerm
+	BeforeSoftAntiAffinities    []corev1.WeightedPodAffinityTerm
+	HardAffinitiesAppending     []corev1.PodAffinityTerm
+	SoftAffinitiesAppending     []corev1.WeightedPodAffinityTerm
+	HardAntiAffinitiesAppending []corev1.PodAffinityTerm
+	SoftAntiAffinitiesAppending []corev1.WeightedPodAffinityTerm
+}
+
+func TestCreateAffinityJSONPatch(t *testing.T) {
+	testCases := make([]testCreateAffinityJSONPatchCase, 0, 1<<(8*testScaleIndex))
+	for bits := 0; bits < (1 << (8 * testScaleIndex)); bits++ {
+		var size int
+		testCase := testCreateAffinityJSONPatchCase{}
+
+		mask := (1 << (testScaleIndex + 1)) - 1
+		size = (bits >> (0 * testScaleIndex)) & mask
+		testCase.BeforeHardAffinities = make([]corev1.PodAffinityTerm, size, size)
+		for idx := 0; idx < size; idx++ {
+			testCase.BeforeHardAffinities[idx] = corev1.PodAffinityTerm{
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"app": "nginx",
+					},
+				},
+				TopologyKey: fmt.Sprintf("topology.kubernetes.io/host%d", idx),
+			}
+		}
+		size = (bits >> (1 * testScaleIndex)) & mask
+		testCase.BeforeSoftAffinities = make([]corev1.WeightedPodAffinityTerm, size, size)
+		for idx := 0; idx < size; idx++ {
+			testCase.BeforeSoftAffinities[idx] = corev1.WeightedPodAffinityTerm{
+				Weight: 50,
+				PodAffinityTerm: corev1.PodAffinityTerm{
+					LabelSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							"app": "nginx",
+						},
+					},
+					TopologyKey: fmt.Sprintf("topology.kubernetes.io/host%d", idx),
+				},
+			}
+		}
+		size = (bits >> (2 * testScaleIndex)) & mask
+		testCase.BeforeHardAntiAffinities = make([]corev1.PodAffinityTerm, size, size)
+		for idx := 0; idx < size; idx++ {
+			testCase.BeforeHardAntiAffinities[idx] = corev1.PodAffinityTerm{
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"app": "nginx",
+					},
+				},
+				TopologyKey: fmt.Sprintf("topology.kubernetes.io/host%d", idx),
+			}
+		}
+		size = (bits >> (3 * testScaleIndex)) & mask
+		testCase.BeforeSoftAntiAffinities = make([]corev1.WeightedPodAffinityTerm, size, size)
+		for idx := 0; idx < size; idx++ {
+			testCase.BeforeSoftAntiAffinities[idx] = corev1.WeightedPodAffinityTerm{
+				Weight: 50,
+				PodAffinityTerm: corev1.PodAffinityTerm{
+					LabelSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							"app": "nginx",
+						},
+					},
+					TopologyKey: fmt.Sprintf("topology.kubernetes.io/host%d", idx),
+				},
+			}
+		}
+		size = (bits >> (4 * testScaleIndex)) & mask
+		testCase.HardAffinitiesAppending = make([]corev1.PodAffinityTerm, size, size)
+		for idx := 0; idx < size; idx++ {
+			testCase.HardAffinitiesAppending[idx] = corev1.PodAffinityTerm{
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"app": "nginx",
+					},
+				},
+				TopologyKey: fmt.Sprintf("topology.kubernetes.io/zone%d", idx),
+			}
+		}
+		size = (bits >> (5 * testScaleIndex)) & mask
+		testCase.SoftAffinitiesAppending = make([]corev1.WeightedPodAffinityTerm, size, size)
+		for idx := 0; idx < size; idx++ {
+			testCase.SoftAffinitiesAppending[idx] = corev1.WeightedPodAffinityTerm{
+				Weight: 50,
+				PodAffinityTerm: corev1.PodAffinityTerm{
+					LabelSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							"app": "nginx",
+						},
+					},
+					TopologyKey: fmt.Sprintf("topology.kubernetes.io/zone%d", idx),
+				},
+			}
+		}
+		size = (bits >> (6 * testScaleIndex)) & mask
+		testCase.HardAntiAffinitiesAppending = make([]corev1.PodAffinityTerm, size, size)
+		for idx := 0; idx < size; idx++ {
+			testCase.HardAntiAffinitiesAppending[idx] = corev1.PodAffinityTerm{
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"app": "nginx",
+					},
+				},
+				TopologyKey: fmt.Sprintf("topology.kubernetes.io/zone%d", idx),
+			}
+		}
+		size = (bits >> (7 * testScaleIndex)) & mask
+		testCase.SoftAntiAffinitiesAppending = make([]corev1.WeightedPodAffinityTerm, size, size)
+		for idx := 0; idx < size; idx++ {
+			testCase.SoftAntiAffinitiesAppending[idx] = corev1.WeightedPodAffinityTerm{
+				Weight: 50,
+				PodAffinityTerm: corev1.PodAffinityTerm{
+					LabelSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							"app": "nginx",
+						},
+					},
+					TopologyKey: fmt.Sprintf("topology.kubernetes.io/zone%d", idx),
+				},
+			}
+		}
+		testCases = append(testCases, testCase)
+	}
+
+	for _, testCase := range testCases {
+		pod := prepareBasicPod()
+		if len(testCase.BeforeHardAffinities) > 0 {
+			if pod.Spec.Affinity == nil {
+				pod.Spec.Affinity = &corev1.Affinity{}
+			}
+			if pod.Spec.Affinity.PodAffinity == nil {
+				pod.Spec.Affinity.PodAffinity = &corev1.PodAffinity{}
+			}
+			pod.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution = testCase.BeforeHardAffinities
+		}
+		if len(testCase.BeforeSoftAffinities) > 0 {
+			if pod.Spec.Affinity == nil {
+				pod.Spec.Affinity = &corev1.Affinity{}
+			}
+			if pod.Spec.Affinity.PodAffinity == nil {
+				pod.Spec.Affinity.PodAffinity = &corev1.PodAffinity{}
+			}
+			pod.Spec.Affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution = testCase.BeforeSoftAffinities
+		}
+		if len(testCase.BeforeHardAntiAffinities) > 0 {
+			if pod.Spec.Affinity == nil {
+				pod.Spec.Affinity = &corev1.Affinity{}
+			}
+			if pod.Spec.Affinity.PodAntiAffinity == nil {
+				pod.Spec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+			}
+			pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = testCase.BeforeHardAntiAffinities
+		}
+		if len(testCase.BeforeSoftAntiAffinities) > 0 {
+			if pod.Spec.Affinity == nil {
+				pod.Spec.Affinity = &corev1.Affinity{}
+			}
+			if pod.Spec.Affinity.PodAntiAffinity == nil {
+				pod.Spec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+			}
+			pod.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = testCase.BeforeSoftAntiAffinities
+		}
+
+		patchedPod, err := patchMutation(pod, func(mutatedPod *corev1.Pod) {
+			appendPodAffinityTerms(mutatedPod, false, testCase.HardAffinitiesAppending)
+			appendWeightedPodAffinityTerms(mutatedPod, false, testCase.SoftAffinitiesAppending, false)
+			appendPodAffinityTerms(mutatedPod, true, testCase.HardAntiAffinitiesAppending)
+			appendWeightedPodAffinityTerms(mutatedPod, true, testCase.SoftAntiAffinitiesAppending, false)
+		})
+		if err != nil {
+			t.Error("failed to patch pod with created JSONPatch", err)
+		}
+
+		if len(testCase.BeforeHardAffinities)+len(testCase.HardAffinitiesAppending) > 0 {
+			if !hardAffinityFieldNonNil(patchedPod) {
+				t.Error("/spec/affinity/podAffinity/requiredDuringSchedulingIgnoredDuringExecution field not found")
+			}
+			expectedLen := len(testCase.BeforeHardAffinities) + len(testCase.HardAffinitiesAppending)
+			actualLen := len(patchedPod.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+			if actualLen != expectedLen {
+				t.Errorf("unexpected pod affinity size: expected: %d, actual: %d", expectedLen, actualLen)
+			}
+		}
+		if len(testCase.BeforeSoftAffinities)+len(testCase.SoftAffinitiesAppending) > 0 {
+			if !softAffinityFieldNonNil(patchedPod) {
+				t.Error("/spec/affinity/podAffinity/preferredDuringSchedulingIgnoredDuringExecution field not found")
+			}
+			expectedLen := len(testCase.BeforeSoftAffinities) + len(testCase.SoftAffinitiesAppending)
+			actualLen := len(patchedPod.Spec.Affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+			if actualLen != expectedLen {
+				t.Errorf("unexpected pod affinity size: expected: %d, actual: %d", expectedLen, actualLen)
+			}
+		}
+		if len(testCase.BeforeHardAntiAffinities)+len(testCase.HardAntiAffinitiesAppending) > 0 {
+			if !hardAntiAffinityFieldNonNil(patchedPod) {
+				t.Error("/spec/affinity/podAntiAffinity/requiredDuringSchedulingIgnoredDuringExecution field not found")
+			}
+			expectedLen := len(testCase.BeforeHardAntiAffinities) + len(testCase.HardAntiAffinitiesAppending)
+			actualLen := len(patchedPod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+			if actualLen != expectedLen {
+				t.Errorf("unexpected pod affinity size: expected: %d, actual: %d", expectedLen, actualLen)
+			}
+		}
+		if len(testCase.BeforeSoftAntiAffinities)+len(testCase.SoftAntiAffinitiesAppending) > 0 {
+			if !softAntiAffinityFieldNonNil(patchedPod) {
+				t.Error("/spec/affinity/podAntiAffinity/preferredDuringSchedulingIgnoredDuringExecution field not found")
+			}
+			expectedLen := len(testCase.BeforeSoftAntiAffinities) + len(testCase.SoftAntiAffinitiesAppending)
+			actualLen := len(patchedPod.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+			if actualLen != expectedLen {
+				t.Errorf("unexpected pod affinity size: expected: %d, actual: %d", expectedLen, actualLen)
+			}
+		}
+	}
+}
+
+type testCreateTopologySpreadConstraintsJSONPatchCase struct {
+	BeforeTopologySpreadConstraints    []corev1.TopologySpreadConstraint
+	TopologySpreadconstraintsAppending []corev1.TopologySpreadConstraint
+}
+
+func TestCreateTopologySpreadConstrainsJSONPatch(t *testing.T) {
+	testCaseSize := 1 << 4
+	testCases := make([]testCreateTopologySpreadConstraintsJSONPatchCase, testCaseSize)
+	for bits := 0; bits < testCaseSize; bits++ {
+		testCase := testCreateTopologySpreadConstraintsJSONPatchCase{}
+		var size int
+		mask := (1 << (testScaleIndex + 1)) - 1
+		size = (bits >> (0 * testScaleIndex)) & mask
+		testCase.BeforeTopologySpreadConstraints = make([]corev1.TopologySpreadConstraint, size, size)
+		for idx := 0; idx < size; idx++ {
+			testCase.BeforeTopologySpreadConstraints[idx] = corev1.TopologySpreadConstraint{
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"app": "nginx",
+					},
+				},
+				TopologyKey: fmt.Sprintf("topology.kubernetes.io/host%d", idx),
+				MaxSkew:     1,
+			}
+		}
+		size = (bits >> (1 * testScaleIndex)) & mask
+		testCase.TopologySpreadconstraintsAppending = make([]corev1.TopologySpreadConstraint, size, size)
+		for idx := 0; idx < size; idx++ {
+			testCase.TopologySpreadconstraintsAppending[idx] = corev1.TopologySpreadConstraint{
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"app": "nginx",
+					},
+				},
+				TopologyKey: fmt.Sprintf("topology.kubernetes.io/zone%d", idx),
+				MaxSkew:     1,
+			}
+		}
+		testCases = append(testCases, testCase)
+	}
+
+	for _, testCase := range testCases {
+		pod := prepareBasicPod()
+		if len(testCase.BeforeTopologySpreadConstraints) > 0 {
+			pod.Spec.TopologySpreadConstraints = testCase.BeforeTopologySpreadConstraints
+		}
+
+		patchedPod, err := patchMutation(pod, func(mutatedPod *corev1.Pod) {
+			appendTopologySpreadConstraints(mutatedPod, testCase.TopologySpreadconstraintsAppending, false)
+		})
+		if err != nil {
+			t.Error("failed to patch pod with created JSONPatch", err)
+		}
+
+		if len(testCase.BeforeTopologySpreadConstraints)+len(testCase.TopologySpreadconstraintsAppending) > 0 {
+			if !topologySpreadConstraintsNonNil(patchedPod) {
+				t.Error("/spec/topologySpreadConstraints field not found")
+			}
+			expectedLen := len(testCase.BeforeTopologySpreadConstraints) + len(testCase.TopologySpreadconstraintsAppending)
+			actualLen := len(patchedPod.Spec.TopologySpreadConstraints)
+			if actualLen != expectedLen {
+				t.Errorf("unexpected pod topologySpreadConstraints size: expected: %d, actual: %d", expectedLen, actualLen)
+			}
+		}
+	}
+}
+
+type testCreateJSONPatchDuplicatesCase struct {
+	Name                    string
+	Policy                  DuplicateTermPolicy
+	Existing                corev1.WeightedPodAffinityTerm
+	Appending               corev1.WeightedPodAffinityTerm
+	ExpectedDuplicate       bool
+	ExpectedMerged          bool
+	ExpectedExistingWeight  int32
+	ExpectedPreferredLength int
+}
+
+func TestCreateJSONPatchDuplicates(t *testing.T) {
+	nginxTerm := func(weight int32, selector *metav1.LabelSelector, namespaces ...string) corev1.WeightedPodAffinityTerm {
+		return corev1.WeightedPodAffinityTerm{
+			Weight: weight,
+			PodAffinityTerm: corev1.PodAffinityTerm{
+				LabelSelector: selector,
+				Namespaces:    namespaces,
+				TopologyKey:   "kubernetes.io/hostname",
+			},
+		}
+	}
+	matchLabels := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx", "pod-template-hash": "abcdef"}}
+	matchExpressions := &metav1.LabelSelector{
+		MatchLabels: map[string]string{"app": "nginx"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "pod-template-hash", Operator: metav1.LabelSelectorOpIn, Values: []string{"abcdef", "abcdef"}},
+		},
+	}
+
+	testCases := []testCreateJSONPatchDuplicatesCase{
+		{
+			Name:                    "equal after normalization is skipped",
+			Policy:                  DuplicateTermPolicySkip,
+			Existing:                nginxTerm(10, matchLabels, "a", "b"),
+			Appending:               nginxTerm(50, matchExpressions, "b", "a"),
+			ExpectedDuplicate:       true,
+			ExpectedExistingWeight:  10,
+			ExpectedPreferredLength: 1,
+		},
+		{
+			Name:                    "equal term is merged",
+			Policy:                  DuplicateTermPolicyMerge,
+			Existing:                nginxTerm(10, matchLabels),
+			Appending:               nginxTerm(50, matchExpressions),
+			ExpectedDuplicate:       true,
+			ExpectedMerged:          true,
+			ExpectedExistingWeight:  50,
+			ExpectedPreferredLength: 1,
+		},
+		{
+			Name:                    "different namespaces are kept",
+			Policy:                  DuplicateTermPolicySkip,
+			Existing:                nginxTerm(10, matchLabels, "a"),
+			Appending:               nginxTerm(10, matchLabels, "b"),
+			ExpectedExistingWeight:  10,
+			ExpectedPreferredLength: 2,
+		},
+		{
+			Name:                    "nil and empty selectors differ",
+			Policy:                  DuplicateTermPolicySkip,
+			Existing:                nginxTerm(10, nil),
+			Appending:               nginxTerm(10, &metav1.LabelSelector{}),
+			ExpectedExistingWeight:  10,
+			ExpectedPreferredLength: 2,
+		},
+	}
+
+	for _, testCase := range testCases {
+		pod := prepareBasicPod()
+		pod.Spec.Affinity = &corev1.Affinity{
+			PodAntiAffinity: &corev1.PodAntiAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{testCase.Existing},
+			},
+		}
+
+		var duplicates []DuplicateTerm
+		patchedPod, err := patchMutation(pod, func(mutatedPod *corev1.Pod) {
+			duplicates = appendWeightedPodAffinityTerms(mutatedPod, true, []corev1.WeightedPodAffinityTerm{testCase.Appending}, testCase.Policy == DuplicateTermPolicyMerge)
+		})
+		if err != nil {
+			t.Errorf("%s: failed to apply patch: %v", testCase.Name, err)
+			continue
+		}
+		if testCase.ExpectedDuplicate != (len(duplicates) == 1) {
+			t.Errorf("%s: unexpected duplicates: %#v", testCase.Name, duplicates)
+			continue
+		}
+		if testCase.ExpectedDuplicate && duplicates[0].Merged != testCase.ExpectedMerged {
+			t.Errorf("%s: unexpected merged: %#v", testCase.Name, duplicates[0])
+		}
+		preferred := patchedPod.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+		if len(preferred) != testCase.ExpectedPreferredLength {
+			t.Errorf("%s: unexpected preferredDuringSchedulingIgnoredDuringExecution: %#v", testCase.Name, preferred)
+			continue
+		}
+		if preferred[0].Weight != testCase.ExpectedExistingWeight {
+			t.Errorf("%s: unexpected weight of existing term: %d", testCase.Name, preferred[0].Weight)
+		}
+	}
+}
+
+func TestCreateTopologySpreadConstraintsJSONPatchDuplicates(t *testing.T) {
+	constraint := func(maxSkew int32, whenUnsatisfiable corev1.UnsatisfiableConstraintAction) corev1.TopologySpreadConstraint {
+		return corev1.TopologySpreadConstraint{
+			MaxSkew:           maxSkew,
+			TopologyKey:       "topology.kubernetes.io/zone",
+			WhenUnsatisfiable: whenUnsatisfiable,
+			LabelSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}},
+		}
+	}
+	minDomains := int32(3)
+	withMinDomains := constraint(1, corev1.DoNotSchedule)
+	withMinDomains.MinDomains = &minDomains
+	honor := corev1.NodeInclusionPolicyHonor
+	withNodeTaintsPolicy := constraint(1, corev1.ScheduleAnyway)
+	withNodeTaintsPolicy.NodeTaintsPolicy = &honor
+
+	testCases := []struct {
+		Name      string
+		Existing  corev1.TopologySpreadConstraint
+		Appending corev1.TopologySpreadConstraint
+		Policy    DuplicateTermPolicy
+		// Expected are constraints of the patched pod.
+		Expected           []corev1.TopologySpreadConstraint
+		ExpectedDuplicates int
+		ExpectedMerged     bool
+	}{
+		{
+			Name:      "DoNotSchedule is appended next to ScheduleAnyway with skip",
+			Existing:  constraint(3, corev1.ScheduleAnyway),
+			Appending: constraint(1, corev1.DoNotSchedule),
+			Policy:    DuplicateTermPolicySkip,
+			Expected:  []corev1.TopologySpreadConstraint{constraint(3, corev1.ScheduleAnyway), constraint(1, corev1.DoNotSchedule)},
+		},
+		{
+			Name:               "DoNotSchedule is merged into ScheduleAnyway with merge",
+			Existing:           constraint(3, corev1.ScheduleAnyway),
+			Appending:          constraint(1, corev1.DoNotSchedule),
+			Policy:             DuplicateTermPolicyMerge,
+			Expected:           []corev1.TopologySpreadConstraint{constraint(1, corev1.DoNotSchedule)},
+			ExpectedDuplicates: 1,
+			ExpectedMerged:     true,
+		},
+		{
+			Name:               "looser constraint is skipped",
+			Existing:           constraint(1, corev1.DoNotSchedule),
+			Appending:          constraint(2, corev1.ScheduleAnyway),
+			Policy:             DuplicateTermPolicySkip,
+			Expected:           []corev1.TopologySpreadConstraint{constraint(1, corev1.DoNotSchedule)},
+			ExpectedDuplicates: 1,
+		},
+		{
+			Name:               "smaller maxSkew with the same whenUnsatisfiable is skipped with skip",
+			Existing:           constraint(3, corev1.DoNotSchedule),
+			Appending:          constraint(1, corev1.DoNotSchedule),
+			Policy:             DuplicateTermPolicySkip,
+			Expected:           []corev1.TopologySpreadConstraint{constraint(3, corev1.DoNotSchedule)},
+			ExpectedDuplicates: 1,
+		},
+		{
+			Name:               "smaller maxSkew with the same whenUnsatisfiable is merged with merge",
+			Existing:           constraint(3, corev1.DoNotSchedule),
+			Appending:          constraint(1, corev1.DoNotSchedule),
+			Policy:             DuplicateTermPolicyMerge,
+			Expected:           []corev1.TopologySpreadConstraint{constraint(1, corev1.DoNotSchedule)},
+			ExpectedDuplicates: 1,
+			ExpectedMerged:     true,
+		},
+		{
+			Name:      "DoNotSchedule with larger maxSkew is appended next to ScheduleAnyway with skip",
+			Existing:  constraint(1, corev1.ScheduleAnyway),
+			Appending: constraint(2, corev1.DoNotSchedule),
+			Policy:    DuplicateTermPolicySkip,
+			Expected:  []corev1.TopologySpreadConstraint{constraint(1, corev1.ScheduleAnyway), constraint(2, corev1.DoNotSchedule)},
+		},
+		{
+			Name:      "different minDomains is not a duplicate",
+			Existing:  constraint(1, corev1.ScheduleAnyway),
+			Appending: withMinDomains,
+			Policy:    DuplicateTermPolicyMerge,
+			Expected:  []corev1.TopologySpreadConstraint{constraint(1, corev1.ScheduleAnyway), withMinDomains},
+		},
+		{
+			Name:      "different nodeTaintsPolicy is not a duplicate",
+			Existing:  constraint(1, corev1.DoNotSchedule),
+			Appending: withNodeTaintsPolicy,
+			Policy:    DuplicateTermPolicySkip,
+			Expected:  []corev1.TopologySpreadConstraint{constraint(1, corev1.DoNotSchedule), withNodeTaintsPolicy},
+		},
+	}
+
+	for _, testCase := range testCases {
+		pod := prepareBasicPod()
+		pod.Spec.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{testCase.Existing}
+
+		var duplicates []DuplicateTerm
+		patchedPod, err := patchMutation(pod, func(mutatedPod *corev1.Pod) {
+			duplicates = appendTopologySpreadConstraints(mutatedPod, []corev1.TopologySpreadConstraint{testCase.Appending}, testCase.Policy == DuplicateTermPolicyMerge)
+		})
+		if err != nil {
+			t.Errorf("%s: failed to apply patch: %v", testCase.Name, err)
+			continue
+		}
+		if len(duplicates) != testCase.ExpectedDuplicates || (len(duplicates) > 0 && duplicates[0].Merged != testCase.ExpectedMerged) {
+			t.Errorf("%s: unexpected duplicates: %#v", testCase.Name, duplicates)
+		}
+		if !reflect.DeepEqual(patchedPod.Spec.TopologySpreadConstraints, testCase.Expected) {
+			t.Errorf("%s: unexpected topologySpreadConstraints: %#v", testCase.Name, patchedPod.Spec.TopologySpreadConstraints)
+		}
+		if testCase.Policy == DuplicateTermPolicySkip && !reflect.DeepEqual(patchedPod.Spec.TopologySpreadConstraints[0], testCase.Existing) {
+			t.Errorf("%s: constraint written by user must be left untouched with skip: %#v", testCase.Name, patchedPod.Spec.TopologySpreadConstraints[0])
+		}
+	}
+}
+
+// utilities
+
+func mutatorByName(t *testing.T, name string) Mutator {
+	t.Helper()
+	for _, m := range mutators {
+		if m.Name() == name {
+			return m
+		}
+	}
+	t.Fatalf("mutator %s is not registered", name)
+	return nil
+}
+
+func runMutatorTestCases(t *testing.T, m Mutator, testCases []testMutatorCase) {
+	t.Helper()
+	opts := &NewExpander(Options{}).opts
+	for _, testCase := range testCases {
+		name := m.Name() + ": " + testCase.Name
+		pod := prepareBasicPod()
+		pod.Labels = map[string]string{"app": "nginx", "pod-template-hash": "abcdef"}
+		annotations := map[string]string{}
+		if testCase.Source != "" {
+			annotations[opts.AnnotationKey(m.AnnotationName())] = testCase.Source
+		}
+		pod.Annotations = annotations
+		if testCase.Prepare != nil {
+			testCase.Prepare(pod)
+		}
+
+		change, warnings, err := m.Mutate(pod, pod.Labels, annotations, opts)
+		if testCase.ExpectedErr {
+			if err == nil {
+				t.Errorf("%s: error should be returned", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if testCase.ExpectedNil {
+			if change != nil {
+				t.Errorf("%s: change should be nil: %#v", name, change)
+			}
+			continue
+		}
+		if change == nil {
+			t.Errorf("%s: change should not be nil", name)
+			continue
+		}
+		if len(change.Injected) != testCase.ExpectedInjected {
+			t.Errorf("%s: unexpected injected terms: %#v", name, change.Injected)
+		}
+		if len(warnings) != testCase.ExpectedWarnings {
+			t.Errorf("%s: unexpected warnings: %s", name, strings.Join(WarningMessages(warnings), "; "))
+		}
+		if testCase.Check != nil {
+			testCase.Check(t, name, pod)
+		}
+	}
+}
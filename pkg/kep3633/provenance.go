@@ -0,0 +1,223 @@
+package kep3633
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const termHashLength = 16
+
+// provenance records which terms this webhook injected into the pod, so that reinvocation can replace only them.
+// It is stored as JSON in the annotation named AnnotationNameInjected.
+type provenance struct {
+	// Hash is the hash of source annotations, labels and options the terms are computed from.
+	Hash string `json:"hash"`
+	// Terms maps annotation name (without prefix) to hashes of terms injected from it.
+	Terms map[string][]string `json:"terms,omitempty"`
+}
+
+// readProvenance returns provenance recorded in annotations, or nil if not recorded or broken.
+func (e *Expander) readProvenance(annotations map[string]string) *provenance {
+	source, exists := annotations[e.opts.AnnotationKey(AnnotationNameInjected)]
+	if !exists {
+		return nil
+	}
+	prov := &provenance{}
+	err := json.Unmarshal(([]byte)(source), prov)
+	if err != nil {
+		e.opts.Logger.Info("ignore broken provenance annotation", "annotation", e.opts.AnnotationKey(AnnotationNameInjected), "error", err.Error())
+		return nil
+	}
+	return prov
+}
+
+// sourceHash returns the hash of inputs which determine injected terms:
+// source annotations, labels, and options changing the terms, i.e. the duplicate term policy and enabled mutators.
+func (e *Expander) sourceHash(annotations, labels map[string]string, annotationNames []string) (string, error) {
+	sources := make(map[string]string, len(annotationNames))
+	for _, name := range annotationNames {
+		if v, exists := annotations[e.opts.AnnotationKey(name)]; exists {
+			sources[name] = v
+		}
+	}
+	enabled := append(make([]string, 0, len(annotationNames)), annotationNames...)
+	sort.Strings(enabled)
+	// json.Marshal sorts map keys, so the result is stable
+	inputBytes, err := json.Marshal(map[string]interface{}{
+		"annotations": sources,
+		"labels":      labels,
+		"options": map[string]interface{}{
+			"duplicateTermPolicy": e.opts.DuplicateTermPolicy,
+			"enabled":             enabled,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(inputBytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func termHash(term interface{}) (string, error) {
+	termBytes, err := json.Marshal(term)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(termBytes)
+	return hex.EncodeToString(sum[:])[:termHashLength], nil
+}
+
+func termHashes[T any](terms []T) ([]string, error) {
+	hashes := make([]string, 0, len(terms))
+	for _, term := range terms {
+		h, err := termHash(term)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+// filterInjectedTerms returns terms without the ones whose hash is in hashes (each hash removes one term),
+// and the number of removed terms.
+func filterInjectedTerms[T any](terms []T, hashes []string) ([]T, int, error) {
+	remaining := make(map[string]int, len(hashes))
+	for _, h := range hashes {
+		remaining[h]++
+	}
+	filtered := make([]T, 0, len(terms))
+	removed := 0
+	for _, term := range terms {
+		h, err := termHash(term)
+		if err != nil {
+			return nil, 0, err
+		}
+		if remaining[h] > 0 {
+			remaining[h]--
+			removed++
+			continue
+		}
+		filtered = append(filtered, term)
+	}
+	return filtered, removed, nil
+}
+
+// stripList removes injected terms from *terms. When no terms are left, *terms is set to nil.
+func stripList[T any](terms *[]T, hashes []string) error {
+	if len(hashes) == 0 || len(*terms) == 0 {
+		return nil
+	}
+	filtered, removed, err := filterInjectedTerms(*terms, hashes)
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return nil
+	}
+	if len(filtered) == 0 {
+		*terms = nil
+		return nil
+	}
+	*terms = filtered
+	return nil
+}
+
+// stripInjectedTerms removes terms recorded in prov from pod.
+func stripInjectedTerms(pod *corev1.Pod, prov *provenance) error {
+	if prov == nil {
+		return nil
+	}
+
+	// podAffinity, podAntiAffinity and affinity left empty by stripping are removed, as injection creates them;
+	// empty ones written by the user are kept
+	emptied := false
+	if pod.Spec.Affinity != nil && pod.Spec.Affinity.PodAffinity != nil {
+		podAffinity := pod.Spec.Affinity.PodAffinity
+		before := len(podAffinity.RequiredDuringSchedulingIgnoredDuringExecution) + len(podAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+		err := stripList(&podAffinity.RequiredDuringSchedulingIgnoredDuringExecution, prov.Terms[AnnotationNamePodAffinityHard])
+		if err != nil {
+			return err
+		}
+		err = stripList(&podAffinity.PreferredDuringSchedulingIgnoredDuringExecution, prov.Terms[AnnotationNamePodAffinitySoft])
+		if err != nil {
+			return err
+		}
+		if before > 0 && len(podAffinity.RequiredDuringSchedulingIgnoredDuringExecution)+len(podAffinity.PreferredDuringSchedulingIgnoredDuringExecution) == 0 {
+			pod.Spec.Affinity.PodAffinity = nil
+			emptied = true
+		}
+	}
+	if pod.Spec.Affinity != nil && pod.Spec.Affinity.PodAntiAffinity != nil {
+		podAntiAffinity := pod.Spec.Affinity.PodAntiAffinity
+		before := len(podAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution) + len(podAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+		err := stripList(&podAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, prov.Terms[AnnotationNamePodAntiAffinityHard])
+		if err != nil {
+			return err
+		}
+		err = stripList(&podAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution, prov.Terms[AnnotationNamePodAntiAffinitySoft])
+		if err != nil {
+			return err
+		}
+		if before > 0 && len(podAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution)+len(podAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution) == 0 {
+			pod.Spec.Affinity.PodAntiAffinity = nil
+			emptied = true
+		}
+	}
+	if emptied && *pod.Spec.Affinity == (corev1.Affinity{}) {
+		pod.Spec.Affinity = nil
+	}
+	return stripList(&pod.Spec.TopologySpreadConstraints, prov.Terms[AnnotationNameTopologySpreadConstraints])
+}
+
+// injectedTermsPresent reports whether all terms recorded in prov are still in pod.
+func injectedTermsPresent(pod *corev1.Pod, prov *provenance) (bool, error) {
+	copied := pod.DeepCopy()
+	err := stripInjectedTerms(copied, prov)
+	if err != nil {
+		return false, err
+	}
+	removed := countTerms(pod) - countTerms(copied)
+	recorded := 0
+	for _, hashes := range prov.Terms {
+		recorded += len(hashes)
+	}
+	return removed == recorded, nil
+}
+
+func countTerms(pod *corev1.Pod) int {
+	count := len(pod.Spec.TopologySpreadConstraints)
+	if pod.Spec.Affinity != nil && pod.Spec.Affinity.PodAffinity != nil {
+		count += len(pod.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+		count += len(pod.Spec.Affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	}
+	if pod.Spec.Affinity != nil && pod.Spec.Affinity.PodAntiAffinity != nil {
+		count += len(pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+		count += len(pod.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	}
+	return count
+}
+
+// newProvenance builds provenance of terms injected by changes, keyed by annotation name.
+func newProvenance(hash string, changes map[string]*Change) (*provenance, error) {
+	prov := &provenance{
+		Hash:  hash,
+		Terms: make(map[string][]string, len(changes)),
+	}
+	for kind, change := range changes {
+		if len(change.Injected) == 0 {
+			continue
+		}
+		hashes, err := termHashes(change.Injected)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash terms: %w", err)
+		}
+		prov.Terms[kind] = hashes
+	}
+	return prov, nil
+}
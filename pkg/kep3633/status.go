@@ -0,0 +1,157 @@
+package kep3633
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Status records what the expansion did for each source annotation, so that users and tools can inspect
+// an existing pod long after admission. It is stored as JSON in the annotation named AnnotationNameStatus.
+type Status struct {
+	Sources []SourceStatus `json:"sources"`
+}
+
+// SourceStatus describes what the expansion did for a source annotation.
+type SourceStatus struct {
+	// Annotation is the annotation key.
+	Annotation string `json:"annotation"`
+	// Injected are locations of terms injected from the annotation in the pod spec.
+	Injected []StatusTerm `json:"injected,omitempty"`
+	// ResolvedLabelKeys are label keys resolved to values of pod labels.
+	ResolvedLabelKeys []StatusLabelKey `json:"resolvedLabelKeys,omitempty"`
+	// SkippedLabelKeys are label keys skipped since they are not found in pod labels.
+	SkippedLabelKeys []StatusLabelKey `json:"skippedLabelKeys,omitempty"`
+	// Error is the reason why the annotation could not be applied.
+	Error string `json:"error,omitempty"`
+}
+
+// StatusTerm is the location of an injected term.
+type StatusTerm struct {
+	// Path is the JSON pointer to the list the term is in, e.g. "/spec/topologySpreadConstraints".
+	Path string `json:"path"`
+	// Index is the index of the term in the list.
+	Index int `json:"index"`
+}
+
+// StatusLabelKey is a key in matchLabelKeys or mismatchLabelKeys.
+type StatusLabelKey struct {
+	Field string `json:"field"`
+	Key   string `json:"key"`
+	// Value is the value of the pod label the key is resolved to; empty if skipped.
+	Value string `json:"value,omitempty"`
+}
+
+// termListPaths maps annotation names (without prefix) to JSON pointers to the list of terms injected from them.
+var termListPaths = map[string]string{
+	AnnotationNamePodAffinityHard:           "/spec/affinity/podAffinity/requiredDuringSchedulingIgnoredDuringExecution",
+	AnnotationNamePodAffinitySoft:           "/spec/affinity/podAffinity/preferredDuringSchedulingIgnoredDuringExecution",
+	AnnotationNamePodAntiAffinityHard:       "/spec/affinity/podAntiAffinity/requiredDuringSchedulingIgnoredDuringExecution",
+	AnnotationNamePodAntiAffinitySoft:       "/spec/affinity/podAntiAffinity/preferredDuringSchedulingIgnoredDuringExecution",
+	AnnotationNameTopologySpreadConstraints: "/spec/topologySpreadConstraints",
+}
+
+// termListLength returns the number of terms in the list annotationName is injected into.
+func termListLength(pod *corev1.Pod, annotationName string) int {
+	if annotationName == AnnotationNameTopologySpreadConstraints {
+		return len(pod.Spec.TopologySpreadConstraints)
+	}
+	affinity := pod.Spec.Affinity
+	if affinity == nil {
+		return 0
+	}
+	switch annotationName {
+	case AnnotationNamePodAffinityHard:
+		if affinity.PodAffinity != nil {
+			return len(affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+		}
+	case AnnotationNamePodAffinitySoft:
+		if affinity.PodAffinity != nil {
+			return len(affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+		}
+	case AnnotationNamePodAntiAffinityHard:
+		if affinity.PodAntiAffinity != nil {
+			return len(affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+		}
+	case AnnotationNamePodAntiAffinitySoft:
+		if affinity.PodAntiAffinity != nil {
+			return len(affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+		}
+	}
+	return 0
+}
+
+// newSourceStatus returns SourceStatus of change applied to pod from annotationName.
+// Injected terms are at the end of their list, since each list is appended by a single mutator.
+func newSourceStatus(pod *corev1.Pod, annotationKey, annotationName string, change *Change) SourceStatus {
+	status := SourceStatus{
+		Annotation:        annotationKey,
+		Injected:          make([]StatusTerm, 0, len(change.Injected)),
+		ResolvedLabelKeys: make([]StatusLabelKey, 0, len(change.ResolvedLabelKeys)),
+		SkippedLabelKeys:  make([]StatusLabelKey, 0, len(change.MissingLabelKeys)),
+	}
+	first := termListLength(pod, annotationName) - len(change.Injected)
+	for idx := range change.Injected {
+		status.Injected = append(status.Injected, StatusTerm{Path: termListPaths[annotationName], Index: first + idx})
+	}
+	for _, k := range change.ResolvedLabelKeys {
+		status.ResolvedLabelKeys = append(status.ResolvedLabelKeys, StatusLabelKey{Field: k.Field, Key: k.Key, Value: k.Value})
+	}
+	for _, k := range change.MissingLabelKeys {
+		status.SkippedLabelKeys = append(status.SkippedLabelKeys, StatusLabelKey{Field: k.Field, Key: k.Key})
+	}
+	return status
+}
+
+// writeStatus sets status to the status annotation of pod, and reports whether the annotation is changed.
+func (e *Expander) writeStatus(pod *corev1.Pod, status *Status) (bool, error) {
+	statusBytes, err := json.Marshal(status)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal status: %w", err)
+	}
+	key := e.opts.AnnotationKey(AnnotationNameStatus)
+	if pod.Annotations[key] == string(statusBytes) {
+		return false, nil
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[key] = string(statusBytes)
+	return true, nil
+}
+
+// ReadStatus returns Status recorded in pod, or nil if not recorded.
+func (e *Expander) ReadStatus(pod *corev1.Pod) (*Status, error) {
+	source, exists := pod.Annotations[e.opts.AnnotationKey(AnnotationNameStatus)]
+	if !exists {
+		return nil, nil
+	}
+	status := &Status{}
+	err := json.Unmarshal(([]byte)(source), status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse annotation %q: %w", e.opts.AnnotationKey(AnnotationNameStatus), err)
+	}
+	return status, nil
+}
+
+// FailureResult returns Result of pod whose annotation could not be applied, as returned by ExpandResult.
+// Nothing is applied, but the error is recorded in the status annotation of Pod,
+// for callers which admit the pod unchanged instead of rejecting it.
+func (e *Expander) FailureResult(pod *corev1.Pod, annotationErr *AnnotationError) (*Result, error) {
+	result := &Result{
+		Pod:              pod.DeepCopy(),
+		Changes:          make(map[string]*Change),
+		MissingLabelKeys: make([]MissingLabelKey, 0),
+		Warnings:         make([]Warning, 0),
+		Status: &Status{
+			Sources: []SourceStatus{{Annotation: annotationErr.Key, Error: annotationErr.Err.Error()}},
+		},
+	}
+	modified, err := e.writeStatus(result.Pod, result.Status)
+	if err != nil {
+		return nil, err
+	}
+	result.Modified = modified
+	return result, nil
+}
@@ -0,0 +1,84 @@
+package kep3633
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExpandStatus(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx", "pod-template-hash": "abcdef"}
+	pod.Annotations = map[string]string{
+		DefaultAnnotationPrefix + "/" + AnnotationNamePodAntiAffinityHard: `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"], "mismatchLabelKeys": ["tenant"]}]`,
+	}
+	pod.Spec.Affinity = &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+				{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis"}}, TopologyKey: "kubernetes.io/hostname"},
+			},
+		},
+	}
+
+	expander := NewExpander(Options{})
+	expanded, _, err := expander.Expand(pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	status, err := expander.ReadStatus(expanded)
+	if err != nil {
+		t.Fatalf("failed to read status: %v", err)
+	}
+	expected := &Status{
+		Sources: []SourceStatus{
+			{
+				Annotation:        DefaultAnnotationPrefix + "/" + AnnotationNamePodAntiAffinityHard,
+				Injected:          []StatusTerm{{Path: "/spec/affinity/podAntiAffinity/requiredDuringSchedulingIgnoredDuringExecution", Index: 1}},
+				ResolvedLabelKeys: []StatusLabelKey{{Field: "matchLabelKeys", Key: "pod-template-hash", Value: "abcdef"}},
+				SkippedLabelKeys:  []StatusLabelKey{{Field: "mismatchLabelKeys", Key: "tenant"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("unexpected status: %#v", status)
+	}
+
+	status, err = expander.ReadStatus(pod)
+	if err != nil || status != nil {
+		t.Errorf("status should not be recorded on the original pod: %#v, %v", status, err)
+	}
+}
+
+func TestFailureResult(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Annotations = map[string]string{
+		DefaultAnnotationPrefix + "/" + AnnotationNameTopologySpreadConstraints: `broken`,
+	}
+	expander := NewExpander(Options{})
+	_, err := expander.ExpandResult(pod)
+	var annotationErr *AnnotationError
+	if !errors.As(err, &annotationErr) {
+		t.Fatalf("AnnotationError should be returned: %v", err)
+	}
+
+	result, err := expander.FailureResult(pod, annotationErr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	status, err := expander.ReadStatus(result.Pod)
+	if err != nil {
+		t.Fatalf("failed to read status: %v", err)
+	}
+	if !result.Modified || status == nil || len(status.Sources) != 1 || status.Sources[0].Annotation != annotationErr.Key || status.Sources[0].Error == "" {
+		t.Errorf("error should be recorded in status: %#v", status)
+	}
+
+	// recording the same error again changes nothing
+	result, err = expander.FailureResult(result.Pod, annotationErr)
+	if err != nil || result.Modified {
+		t.Errorf("the same status should not modify pod: %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package kep3633
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PodAffinityTerm is corev1.PodAffinityTerm with matchLabelKeys and mismatchLabelKeys proposed by KEP-3633.
+//
+// +k8s:deepcopy-gen=true
+type PodAffinityTerm struct {
+	corev1.PodAffinityTerm `json:",inline"`
+	MatchLabelKeys         []string `json:"matchLabelKeys,omitempty"`
+	MismatchLabelKeys      []string `json:"mismatchLabelKeys,omitempty"`
+}
+
+// WeightedPodAffinityTerm is corev1.WeightedPodAffinityTerm whose podAffinityTerm is PodAffinityTerm.
+//
+// +k8s:deepcopy-gen=true
+type WeightedPodAffinityTerm struct {
+	corev1.WeightedPodAffinityTerm `json:",inline"`
+	PodAffinityTerm                PodAffinityTerm `json:"podAffinityTerm,omitempty"`
+}
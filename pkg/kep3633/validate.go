@@ -0,0 +1,91 @@
+package kep3633
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ValidateAnnotation strictly parses value of the annotation named annotationName (without prefix),
+// and validates its terms with the rules of KEP-3633.
+//
+// Unlike Expand, which ignores unknown fields the same as the API server, unknown fields are errors here,
+// so that typos like "matchLableKeys" are found before the terms silently lose their label keys.
+func ValidateAnnotation(annotationName, value string) error {
+	var errs field.ErrorList
+	switch annotationName {
+	case AnnotationNamePodAffinityHard, AnnotationNamePodAntiAffinityHard:
+		var terms []PodAffinityTerm
+		err := decodeStrict(value, &terms)
+		if err != nil {
+			return err
+		}
+		errs = validatePodAffinityTerms(terms)
+	case AnnotationNamePodAffinitySoft, AnnotationNamePodAntiAffinitySoft:
+		var terms []WeightedPodAffinityTerm
+		err := decodeStrict(value, &terms)
+		if err != nil {
+			return err
+		}
+		errs = validateWeightedPodAffinityTerms(terms)
+	case AnnotationNameTopologySpreadConstraints:
+		var constraints []corev1.TopologySpreadConstraint
+		err := decodeStrict(value, &constraints)
+		if err != nil {
+			return err
+		}
+		errs = validateTopologySpreadConstraints(constraints)
+	default:
+		return fmt.Errorf("unknown annotation %q", annotationName)
+	}
+	if len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+	return nil
+}
+
+func decodeStrict(value string, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("unexpected end of JSON input")
+	}
+	if err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after the top-level value at offset %d", decoder.InputOffset())
+	}
+	return nil
+}
+
+func validatePodAffinityTerms(terms []PodAffinityTerm) field.ErrorList {
+	errs := field.ErrorList{}
+	for idx, term := range terms {
+		errs = append(errs, ValidateLabelKeys(term.LabelSelector, term.MatchLabelKeys, term.MismatchLabelKeys, field.NewPath("terms").Index(idx))...)
+	}
+	return errs
+}
+
+func validateWeightedPodAffinityTerms(terms []WeightedPodAffinityTerm) field.ErrorList {
+	errs := field.ErrorList{}
+	for idx, weightedTerm := range terms {
+		term := weightedTerm.PodAffinityTerm
+		errs = append(errs, ValidateLabelKeys(term.LabelSelector, term.MatchLabelKeys, term.MismatchLabelKeys, field.NewPath("terms").Index(idx).Child("podAffinityTerm"))...)
+	}
+	return errs
+}
+
+func validateTopologySpreadConstraints(constraints []corev1.TopologySpreadConstraint) field.ErrorList {
+	errs := field.ErrorList{}
+	for idx, constraint := range constraints {
+		errs = append(errs, ValidateLabelKeys(constraint.LabelSelector, constraint.MatchLabelKeys, nil, field.NewPath("constraints").Index(idx))...)
+	}
+	return errs
+}
@@ -0,0 +1,83 @@
+package kep3633
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAnnotation(t *testing.T) {
+	tests := []struct {
+		Name           string
+		AnnotationName string
+		Value          string
+		// ExpectedError is a substring of the error, or empty if valid.
+		ExpectedError string
+	}{
+		{
+			Name:           "valid hard terms",
+			AnnotationName: AnnotationNamePodAntiAffinityHard,
+			Value:          `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}]`,
+		},
+		{
+			Name:           "valid soft terms",
+			AnnotationName: AnnotationNamePodAffinitySoft,
+			Value:          `[{"weight": 10, "podAffinityTerm": {"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "mismatchLabelKeys": ["tenant"]}}]`,
+		},
+		{
+			Name:           "invalid JSON",
+			AnnotationName: AnnotationNamePodAffinityHard,
+			Value:          `[{"topologyKey": }]`,
+			ExpectedError:  "invalid character",
+		},
+		{
+			Name:           "truncated JSON",
+			AnnotationName: AnnotationNamePodAffinityHard,
+			Value:          `[{"topologyKey": "kubernetes.io/hostname"}`,
+			ExpectedError:  "unexpected end of JSON input",
+		},
+		{
+			Name:           "trailing data",
+			AnnotationName: AnnotationNamePodAffinityHard,
+			Value:          `[] []`,
+			ExpectedError:  "unexpected data after the top-level value",
+		},
+		{
+			Name:           "misspelled field",
+			AnnotationName: AnnotationNamePodAffinityHard,
+			Value:          `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLableKeys": ["pod-template-hash"]}]`,
+			ExpectedError:  `unknown field "matchLableKeys"`,
+		},
+		{
+			Name:           "mismatchLabelKeys of topologySpreadConstraints",
+			AnnotationName: AnnotationNameTopologySpreadConstraints,
+			Value:          `[{"maxSkew": 1, "topologyKey": "kubernetes.io/hostname", "whenUnsatisfiable": "DoNotSchedule", "mismatchLabelKeys": ["tenant"]}]`,
+			ExpectedError:  `unknown field "mismatchLabelKeys"`,
+		},
+		{
+			Name:           "label keys without labelSelector",
+			AnnotationName: AnnotationNamePodAntiAffinityHard,
+			Value:          `[{"topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}]`,
+			ExpectedError:  "terms[0]",
+		},
+		{
+			Name:           "unknown annotation",
+			AnnotationName: AnnotationNameInjected,
+			Value:          `{}`,
+			ExpectedError:  "unknown annotation",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			err := ValidateAnnotation(tt.AnnotationName, tt.Value)
+			if tt.ExpectedError == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.ExpectedError) {
+				t.Errorf("expected error containing %q, got %v", tt.ExpectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+// runPostRender rewrites manifests rendered by Helm on stdin and writes them to stdout,
+// so that the binary can be given to "helm install --post-renderer".
+func runPostRender(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("post-render", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: kep3633alt post-render [flags]")
+		fmt.Fprintln(stderr, "Rewrite manifests rendered by Helm on stdin and write them to stdout, as a Helm post-renderer.")
+		flags.PrintDefaults()
+	}
+	mode := flags.String("mode", transformModeConvert, "\""+transformModeConvert+"\" to move native label keys into annotations, or \""+transformModeExpand+"\" to expand annotations whose label keys are all in template labels")
+	annotationPrefix := flags.String("annotation-prefix", kep3633.DefaultAnnotationPrefix, "Prefix of annotations to read and write")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintln(stderr, "post-render reads stdin only")
+		return 2
+	}
+	transform, err := lookupTransform(*mode)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	return rewriteYAMLFiles(nil, false, stdin, stdout, stderr, func(d *yamlDocument) (int, error) {
+		return transform(d, *annotationPrefix, stderr)
+	})
+}
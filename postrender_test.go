@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// postRenderTestManifests is the shape of "helm template" output, with source comments and empty documents.
+const postRenderTestManifests = `---
+# Source: web/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  selector:
+    app: web
+---
+# Source: web/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      topologySpreadConstraints:
+        - maxSkew: 1
+          topologyKey: kubernetes.io/hostname
+          whenUnsatisfiable: DoNotSchedule
+          labelSelector:
+            matchLabels:
+              app: web
+          matchLabelKeys:
+            - pod-template-hash
+      containers:
+        - name: web
+          image: nginx
+`
+
+func TestPostRender(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Args     []string
+		Input    string
+		Expected []string
+	}{
+		{
+			Name:     "convert",
+			Input:    postRenderTestManifests,
+			Expected: []string{"# Source: web/templates/deployment.yaml", "kep-3633-alt.10h.in/topologySpreadConstraints: |"},
+		},
+		{
+			Name: "expand",
+			Args: []string{"-mode", "expand"},
+			Input: `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+spec:
+  template:
+    metadata:
+      labels:
+        app: migrate
+      annotations:
+        kep-3633-alt.10h.in/podAffinity.preferredDuringSchedulingIgnoredDuringExecution: '[{"weight": 10, "podAffinityTerm": {"labelSelector": {"matchLabels": {"role": "db"}}, "topologyKey": "kubernetes.io/hostname", "mismatchLabelKeys": ["app"]}}]'
+    spec:
+      restartPolicy: Never
+      containers:
+        - name: migrate
+          image: busybox
+`,
+			Expected: []string{"operator: NotIn", "kep-3633-alt.10h.in/injected:"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+			code := runPostRender(tt.Args, strings.NewReader(tt.Input), stdout, stderr)
+			if code != 0 {
+				t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+			}
+			for _, expected := range tt.Expected {
+				if !strings.Contains(stdout.String(), expected) {
+					t.Errorf("%q should be written: %s", expected, stdout.String())
+				}
+			}
+		})
+	}
+}
+
+func TestPostRenderInvalidMode(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	code := runPostRender([]string{"-mode", "inject"}, strings.NewReader(postRenderTestManifests), &bytes.Buffer{}, stderr)
+	if code != 2 || !strings.Contains(stderr.String(), `invalid mode "inject"`) {
+		t.Errorf("invalid mode should be rejected: %d: %s", code, stderr.String())
+	}
+}
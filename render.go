@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v5"
+	"sigs.k8s.io/yaml"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+const (
+	renderOutputYAML  = "yaml"
+	renderOutputJSON  = "json"
+	renderOutputPatch = "patch"
+)
+
+// runRender expands annotations of pod templates in manifests read from files in args (or stdin),
+// the same as the webhook does on pod creation, so that annotation-form manifests can be checked without a cluster.
+//
+// Output is the expanded objects as multi-document YAML or JSON lines,
+// or a JSON patch per object with a pod template, relative to the object.
+func runRender(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: kep3633alt render [flags] [FILE...]")
+		fmt.Fprintln(stderr, "Expand annotations of Pods, PodTemplates and workloads read from FILEs (or stdin) and write them to stdout.")
+		flags.PrintDefaults()
+	}
+	labels := labelsFlag{}
+	flags.Var(labels, "label", "Comma separated key=value pairs of labels only set at runtime (e.g. pod-template-hash=abc); can be repeated")
+	output := flags.String("output", renderOutputYAML, "Output format: \""+renderOutputYAML+"\" or \""+renderOutputJSON+"\" of expanded objects, or \""+renderOutputPatch+"\" for a JSON patch per pod template")
+	annotationPrefix := flags.String("annotation-prefix", kep3633.DefaultAnnotationPrefix, "Prefix of annotations to expand")
+	duplicateTermPolicy := flags.String("duplicate-term-policy", duplicateTermPolicySkip, "How to handle terms equal to ones already in spec: \""+duplicateTermPolicySkip+"\" or \""+duplicateTermPolicyMerge+"\"")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *output != renderOutputYAML && *output != renderOutputJSON && *output != renderOutputPatch {
+		fmt.Fprintf(stderr, "invalid output %q: must be %q, %q or %q\n", *output, renderOutputYAML, renderOutputJSON, renderOutputPatch)
+		return 2
+	}
+	if *duplicateTermPolicy != duplicateTermPolicySkip && *duplicateTermPolicy != duplicateTermPolicyMerge {
+		fmt.Fprintf(stderr, "invalid duplicate-term-policy %q: must be %q or %q\n", *duplicateTermPolicy, duplicateTermPolicySkip, duplicateTermPolicyMerge)
+		return 2
+	}
+
+	manifests, err := readManifestFiles(flags.Args(), stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	expander := kep3633.NewExpander(kep3633.Options{
+		AnnotationPrefix:    *annotationPrefix,
+		DuplicateTermPolicy: kep3633.DuplicateTermPolicy(*duplicateTermPolicy),
+	})
+
+	failed := false
+	written := 0
+	for _, m := range manifests {
+		patch, warnings, err := renderPatch(expander, m, labels)
+		for _, w := range warnings {
+			fmt.Fprintf(stderr, "%s: warning: %s\n", m, w.Message)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", m, err)
+			failed = true
+			continue
+		}
+
+		switch *output {
+		case renderOutputPatch:
+			if patch != nil {
+				fmt.Fprintln(stdout, string(patch))
+			}
+			continue
+		case renderOutputJSON:
+			err = writeRenderedJSON(stdout, m, patch)
+		default:
+			if written > 0 {
+				fmt.Fprintln(stdout, "---")
+			}
+			err = writeRenderedYAML(stdout, m, patch)
+		}
+		written++
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", m, err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// renderPatch returns JSON patch which expands the pod template of m, relative to m.
+// labels are added to the pod before expansion, but not to the patch.
+// Patch is nil if m has no pod template, and "[]" if nothing is expanded.
+func renderPatch(expander *kep3633.Expander, m *manifest, labels map[string]string) ([]byte, []kep3633.Warning, error) {
+	templateBytes, err := m.podTemplateJSON()
+	if err != nil || templateBytes == nil {
+		return nil, nil, err
+	}
+	original, err := m.podTemplate()
+	if err != nil {
+		return nil, nil, err
+	}
+	pod := original.DeepCopy()
+	if pod.Labels == nil && len(labels) > 0 {
+		pod.Labels = make(map[string]string, len(labels))
+	}
+	for k, v := range labels {
+		pod.Labels[k] = v
+	}
+
+	result, err := expander.ExpandResult(pod)
+	var annotationErr *kep3633.AnnotationError
+	if errors.As(err, &annotationErr) {
+		return nil, nil, errors.New(describeAnnotationFailure(annotationErr))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !result.Modified {
+		return []byte("[]"), result.Warnings, nil
+	}
+	mutated := result.Pod.DeepCopy()
+	mutated.Labels = original.Labels
+	patch, err := kep3633.CreateJSONPatchFromRaw(templateBytes, original, mutated)
+	if err != nil {
+		return nil, result.Warnings, err
+	}
+	pointer, _ := m.podTemplatePointer()
+	patch, err = prefixJSONPatch(patch, pointer)
+	return patch, result.Warnings, err
+}
+
+// describeAnnotationFailure names the annotation which could not be applied and why.
+func describeAnnotationFailure(annotationErr *kep3633.AnnotationError) string {
+	return fmt.Sprintf("annotation %s: %s", annotationErr.Key, describeAnnotationError(annotationErr.Err))
+}
+
+// prefixJSONPatch returns patch with prefix prepended to paths of its operations.
+func prefixJSONPatch(patch []byte, prefix string) ([]byte, error) {
+	if prefix == "" {
+		return patch, nil
+	}
+	operations := make([]map[string]interface{}, 0)
+	err := json.Unmarshal(patch, &operations)
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range operations {
+		for _, key := range []string{"path", "from"} {
+			if path, ok := op[key].(string); ok {
+				op[key] = prefix + path
+			}
+		}
+	}
+	return json.Marshal(operations)
+}
+
+// renderedJSON returns m in JSON with patch applied.
+func renderedJSON(m *manifest, patch []byte) ([]byte, error) {
+	objBytes, err := json.Marshal(m.Object)
+	if err != nil {
+		return nil, err
+	}
+	if patch == nil {
+		return objBytes, nil
+	}
+	patchObj, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	return patchObj.Apply(objBytes)
+}
+
+func writeRenderedJSON(w io.Writer, m *manifest, patch []byte) error {
+	objBytes, err := renderedJSON(m, patch)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(objBytes))
+	return err
+}
+
+func writeRenderedYAML(w io.Writer, m *manifest, patch []byte) error {
+	objBytes, err := renderedJSON(m, patch)
+	if err != nil {
+		return err
+	}
+	yamlBytes, err := yaml.JSONToYAML(objBytes)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(yamlBytes)
+	return err
+}
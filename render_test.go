@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const renderTestDeployment = `# comment
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx
+spec:
+  selector:
+    matchLabels:
+      app: nginx
+  template:
+    metadata:
+      annotations:
+        kep-3633-alt.10h.in/podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution: |
+          [{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}]
+      labels:
+        app: nginx
+    spec:
+      containers:
+        - name: nginx
+          image: nginx
+---
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: nginx
+spec:
+  ports:
+    - port: 80
+`
+
+func TestRender(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runRender([]string{"-label", "pod-template-hash=abcdef"}, strings.NewReader(renderTestDeployment), stdout, stderr)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	docs := strings.Split(stdout.String(), "\n---\n")
+	if len(docs) != 2 {
+		t.Fatalf("unexpected documents: %s", stdout.String())
+	}
+	deployment := &appsv1.Deployment{}
+	err := yaml.UnmarshalStrict([]byte(docs[0]), deployment)
+	if err != nil {
+		t.Fatalf("failed to decode rendered deployment: %v", err)
+	}
+	template := deployment.Spec.Template
+	if _, exists := template.Labels["pod-template-hash"]; exists {
+		t.Errorf("runtime labels should not be rendered: %v", template.Labels)
+	}
+	if template.Spec.Affinity == nil || template.Spec.Affinity.PodAntiAffinity == nil || len(template.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution) != 1 {
+		t.Fatalf("term should be injected: %#v", template.Spec.Affinity)
+	}
+	requirements := template.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution[0].LabelSelector.MatchExpressions
+	if len(requirements) != 1 || requirements[0].Key != "pod-template-hash" || requirements[0].Values[0] != "abcdef" {
+		t.Errorf("label key should be resolved with runtime labels: %#v", requirements)
+	}
+	if !strings.Contains(docs[1], "kind: Service") {
+		t.Errorf("objects without pod template should be written as they are: %s", docs[1])
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("unexpected warnings: %s", stderr.String())
+	}
+}
+
+func TestRenderPatch(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runRender([]string{"-output", "patch"}, strings.NewReader(renderTestDeployment), stdout, stderr)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("a patch per pod template is expected: %s", stdout.String())
+	}
+	operations := make([]map[string]interface{}, 0)
+	err := json.Unmarshal([]byte(lines[0]), &operations)
+	if err != nil {
+		t.Fatalf("failed to decode patch: %v", err)
+	}
+	for _, op := range operations {
+		if !strings.HasPrefix(op["path"].(string), "/spec/template/") {
+			t.Errorf("paths should be relative to the object: %v", op)
+		}
+	}
+	if !strings.Contains(stderr.String(), `"pod-template-hash" is not found`) {
+		t.Errorf("missing runtime label should be warned: %s", stderr.String())
+	}
+}
+
+func TestRenderCronJobJSON(t *testing.T) {
+	cronJob := `{"apiVersion": "batch/v1", "kind": "CronJob", "metadata": {"name": "backup"}, "spec": {"schedule": "@daily", "jobTemplate": {"spec": {"template": {
+		"metadata": {"labels": {"app": "backup"}, "annotations": {"kep-3633-alt.10h.in/topologySpreadConstraints": "[{\"maxSkew\": 1, \"topologyKey\": \"topology.kubernetes.io/zone\", \"whenUnsatisfiable\": \"ScheduleAnyway\", \"labelSelector\": {\"matchLabels\": {\"app\": \"backup\"}}, \"matchLabelKeys\": [\"batch.kubernetes.io/controller-uid\"]}]"}},
+		"spec": {"restartPolicy": "OnFailure", "containers": [{"name": "backup", "image": "busybox"}]}}}}}}`
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runRender([]string{"-output", "json", "-label", "batch.kubernetes.io/controller-uid=uid"}, strings.NewReader(cronJob), stdout, stderr)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	rendered := &batchv1.CronJob{}
+	err := json.Unmarshal(stdout.Bytes(), rendered)
+	if err != nil {
+		t.Fatalf("failed to decode rendered cron job: %v", err)
+	}
+	constraints := rendered.Spec.JobTemplate.Spec.Template.Spec.TopologySpreadConstraints
+	if len(constraints) != 1 || len(constraints[0].LabelSelector.MatchExpressions) != 1 {
+		t.Errorf("constraint should be injected: %#v", constraints)
+	}
+}
+
+func TestRenderAnnotationError(t *testing.T) {
+	pod := `apiVersion: v1
+kind: Pod
+metadata:
+  name: nginx
+  annotations:
+    kep-3633-alt.10h.in/topologySpreadConstraints: '[{'
+spec:
+  containers:
+    - name: nginx
+      image: nginx
+`
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runRender(nil, strings.NewReader(pod), stdout, stderr)
+	if code != 1 {
+		t.Errorf("unexpected exit code %d", code)
+	}
+	if !strings.Contains(stderr.String(), "-#0 Pod/nginx: annotation kep-3633-alt.10h.in/topologySpreadConstraints: invalid JSON at offset 2") {
+		t.Errorf("unexpected error: %s", stderr.String())
+	}
+}
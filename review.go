@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const kindAdmissionReview = "AdmissionReview"
+
+var (
+	admissionv1APIVersion      = admissionv1.SchemeGroupVersion.String()
+	admissionv1beta1APIVersion = admissionv1beta1.SchemeGroupVersion.String()
+)
+
+// decodeAdmissionReview decodes AdmissionReview of admission.k8s.io/v1 or v1beta1 detected from its apiVersion.
+// v1beta1 reviews are converted to v1, keeping apiVersion, so that the response can be written in the received version.
+func decodeAdmissionReview(bodyBytes []byte) (*admissionv1.AdmissionReview, error) {
+	typeMeta := metav1.TypeMeta{}
+	err := json.Unmarshal(bodyBytes, &typeMeta)
+	if err != nil {
+		return nil, err
+	}
+	if typeMeta.Kind != kindAdmissionReview {
+		return nil, fmt.Errorf("kind %q is not supported; accept only %s", typeMeta.Kind, kindAdmissionReview)
+	}
+
+	switch typeMeta.APIVersion {
+	case admissionv1APIVersion:
+		reqReview := &admissionv1.AdmissionReview{}
+		err = json.Unmarshal(bodyBytes, reqReview)
+		if err != nil {
+			return nil, err
+		}
+		return reqReview, nil
+	case admissionv1beta1APIVersion:
+		v1beta1Review := &admissionv1beta1.AdmissionReview{}
+		err = json.Unmarshal(bodyBytes, v1beta1Review)
+		if err != nil {
+			return nil, err
+		}
+		return &admissionv1.AdmissionReview{
+			TypeMeta: v1beta1Review.TypeMeta,
+			Request:  convertRequestFromV1beta1(v1beta1Review.Request),
+		}, nil
+	default:
+		return nil, fmt.Errorf("apiVersion %q is not supported; accept only %s or %s", typeMeta.APIVersion, admissionv1APIVersion, admissionv1beta1APIVersion)
+	}
+}
+
+// encodeAdmissionReview encodes reviewResponse into AdmissionReview of apiVersion, which is either of v1 or v1beta1.
+func encodeAdmissionReview(apiVersion string, reviewResponse *admissionv1.AdmissionResponse) ([]byte, error) {
+	typeMeta := metav1.TypeMeta{
+		APIVersion: apiVersion,
+		Kind:       kindAdmissionReview,
+	}
+	if apiVersion == admissionv1beta1APIVersion {
+		return json.Marshal(admissionv1beta1.AdmissionReview{
+			TypeMeta: typeMeta,
+			Response: convertResponseToV1beta1(reviewResponse),
+		})
+	}
+	return json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: typeMeta,
+		Response: reviewResponse,
+	})
+}
+
+func convertRequestFromV1beta1(in *admissionv1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	if in == nil {
+		return nil
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:                in.UID,
+		Kind:               in.Kind,
+		Resource:           in.Resource,
+		SubResource:        in.SubResource,
+		RequestKind:        in.RequestKind,
+		RequestResource:    in.RequestResource,
+		RequestSubResource: in.RequestSubResource,
+		Name:               in.Name,
+		Namespace:          in.Namespace,
+		Operation:          admissionv1.Operation(in.Operation),
+		UserInfo:           in.UserInfo,
+		Object:             in.Object,
+		OldObject:          in.OldObject,
+		DryRun:             in.DryRun,
+		Options:            in.Options,
+	}
+}
+
+func convertResponseToV1beta1(in *admissionv1.AdmissionResponse) *admissionv1beta1.AdmissionResponse {
+	if in == nil {
+		return nil
+	}
+	out := &admissionv1beta1.AdmissionResponse{
+		UID:              in.UID,
+		Allowed:          in.Allowed,
+		Result:           in.Result,
+		Patch:            in.Patch,
+		AuditAnnotations: in.AuditAnnotations,
+		Warnings:         in.Warnings,
+	}
+	if in.PatchType != nil {
+		patchType := admissionv1beta1.PatchType(*in.PatchType)
+		out.PatchType = &patchType
+	}
+	return out
+}
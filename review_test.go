@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestMutateAdmissionReviewV1(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx", "pod-template-hash": "abcdef"}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}]`,
+	}
+	reqReview, err := newPodReview(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqBody, err := json.Marshal(reqReview)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := doRequest(http.MethodPost, reqBody)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d; body: %s", recorder.Code, recorder.Body.String())
+	}
+	var respReview admissionv1.AdmissionReview
+	err = json.Unmarshal(recorder.Body.Bytes(), &respReview)
+	if err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if respReview.APIVersion != "admission.k8s.io/v1" || respReview.Kind != "AdmissionReview" {
+		t.Errorf("unexpected apiVersion/kind: %s/%s", respReview.APIVersion, respReview.Kind)
+	}
+	if respReview.Response == nil || respReview.Response.UID != reqReview.Request.UID || respReview.Response.Patch == nil {
+		t.Errorf("unexpected response: %s", recorder.Body.String())
+	}
+}
+
+func TestMutateAdmissionReviewV1beta1(t *testing.T) {
+	pod := prepareBasicPod()
+	pod.Labels = map[string]string{"app": "nginx", "pod-template-hash": "abcdef"}
+	pod.Annotations = map[string]string{
+		config.AnnotationKey(annotationNamePodAntiAffinityHard): `[{"labelSelector": {"matchLabels": {"app": "nginx"}}, "topologyKey": "kubernetes.io/hostname", "matchLabelKeys": ["pod-template-hash"]}]`,
+	}
+	podJSON, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqReview := admissionv1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1beta1",
+			Kind:       "AdmissionReview",
+		},
+		Request: &admissionv1beta1.AdmissionRequest{
+			UID:       types.UID(uuid.New().String()),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  podsv1GVR,
+			Namespace: pod.Namespace,
+			Operation: admissionv1beta1.Create,
+			UserInfo:  authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:replicaset-controller"},
+			Object:    runtime.RawExtension{Raw: podJSON},
+		},
+	}
+	reqBody, err := json.Marshal(reqReview)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := doRequest(http.MethodPost, reqBody)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d; body: %s", recorder.Code, recorder.Body.String())
+	}
+	var respReview admissionv1beta1.AdmissionReview
+	err = json.Unmarshal(recorder.Body.Bytes(), &respReview)
+	if err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if respReview.APIVersion != "admission.k8s.io/v1beta1" || respReview.Kind != "AdmissionReview" {
+		t.Errorf("response should be in the received version: %s/%s", respReview.APIVersion, respReview.Kind)
+	}
+	reviewResponse := respReview.Response
+	if reviewResponse == nil || reviewResponse.UID != reqReview.Request.UID {
+		t.Fatalf("unexpected response: %s", recorder.Body.String())
+	}
+	if !reviewResponse.Allowed || reviewResponse.PatchType == nil || *reviewResponse.PatchType != admissionv1beta1.PatchTypeJSONPatch {
+		t.Errorf("pod should be patched: %s", recorder.Body.String())
+	}
+	patchedPod, err := applyPatchDocument(pod, reviewResponse.Patch)
+	if err != nil {
+		t.Fatalf("failed to apply patch: %v", err)
+	}
+	if patchedPod.Spec.Affinity == nil || patchedPod.Spec.Affinity.PodAntiAffinity == nil || len(patchedPod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution) != 1 {
+		t.Errorf("term should be injected: %#v", patchedPod.Spec.Affinity)
+	}
+}
+
+func TestMutateAdmissionReviewUnsupportedVersion(t *testing.T) {
+	for _, body := range []string{
+		`{"apiVersion":"admission.k8s.io/v2","kind":"AdmissionReview","request":{"uid":"0"}}`,
+		`{"apiVersion":"admission.k8s.io/v1","kind":"Pod","request":{"uid":"0"}}`,
+	} {
+		recorder := doRequest(http.MethodPost, ([]byte)(body))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code for %s: %d", body, recorder.Code)
+		}
+	}
+}
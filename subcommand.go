@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// subcommand runs with args following its name and returns the exit code.
+type subcommand func(args []string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// subcommands are run instead of the webhook server when named by the first argument, e.g. "kep3633alt render".
+var subcommands = map[string]subcommand{
+	"convert":           runConvert,
+	"krm":               runKRMFunction,
+	"lint":              runLint,
+	"migrate-to-native": runMigrateToNative,
+	"post-render":       runPostRender,
+	"render":            runRender,
+}
+
+// labelsFlag is a flag of key=value pairs, given repeatedly or comma separated.
+type labelsFlag map[string]string
+
+func (l labelsFlag) String() string {
+	pairs := make([]string, 0, len(l))
+	for k, v := range l {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l labelsFlag) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("missing value for label %s", pair)
+		}
+		l[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/10hin/kep-3633-alt/pkg/kep3633"
+)
+
+const (
+	transformModeConvert = "convert"
+	transformModeExpand  = "expand"
+)
+
+// documentTransform rewrites d in place, reporting what it did to stderr, and returns the number of changes.
+type documentTransform func(d *yamlDocument, annotationPrefix string, stderr io.Writer) (int, error)
+
+// documentTransforms are the modes of pipeline integrations (KRM function and Helm post-renderer).
+var documentTransforms = map[string]documentTransform{
+	transformModeConvert: convertDocument,
+	transformModeExpand:  expandDocument,
+}
+
+// lookupTransform returns the documentTransform of mode, or an error naming the valid modes.
+func lookupTransform(mode string) (documentTransform, error) {
+	transform, ok := documentTransforms[mode]
+	if !ok {
+		return nil, fmt.Errorf("invalid mode %q: must be %q or %q", mode, transformModeConvert, transformModeExpand)
+	}
+	return transform, nil
+}
+
+// expandDocument expands annotations of the pod template of d ahead of admission, and returns the number of injected terms.
+// Only templates whose label keys are all resolved by labels in the template are expanded;
+// others, e.g. referring pod-template-hash set by controllers, are left to the webhook as they are.
+//
+// Source annotations and the provenance are kept, so the webhook recomputes the terms if labels change at runtime.
+func expandDocument(d *yamlDocument, annotationPrefix string, stderr io.Writer) (int, error) {
+	if d.podTemplate() == nil {
+		return 0, nil
+	}
+	objBytes, err := nodeToJSON(d.Root())
+	if err != nil {
+		return 0, err
+	}
+	m := &manifest{Source: d.Source, Index: d.Index}
+	err = json.Unmarshal(objBytes, &m.Object)
+	if err != nil {
+		return 0, err
+	}
+	templateBytes, err := m.podTemplateJSON()
+	if err != nil {
+		return 0, err
+	}
+	pod, err := m.podTemplate()
+	if err != nil {
+		return 0, err
+	}
+
+	expander := kep3633.NewExpander(kep3633.Options{AnnotationPrefix: annotationPrefix})
+	result, err := expander.ExpandResult(pod)
+	var annotationErr *kep3633.AnnotationError
+	if errors.As(err, &annotationErr) {
+		return 0, errors.New(describeAnnotationFailure(annotationErr))
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !result.Modified {
+		return 0, nil
+	}
+	if len(result.MissingLabelKeys) > 0 {
+		fmt.Fprintf(stderr, "%s: left to the webhook: label keys not in template labels: %s\n", d, missingLabelKeyNames(result.MissingLabelKeys))
+		return 0, nil
+	}
+
+	patch, err := kep3633.CreateJSONPatchFromRaw(templateBytes, pod, result.Pod)
+	if err != nil {
+		return 0, err
+	}
+	err = applyJSONPatch(d.podTemplate(), patch)
+	if err != nil {
+		return 0, err
+	}
+
+	injected := 0
+	for _, change := range result.Changes {
+		injected += len(change.Injected)
+	}
+	fmt.Fprintf(stderr, "%s: injected %d terms\n", d, injected)
+	return injected, nil
+}
+
+// missingLabelKeyNames returns sorted distinct label keys of keys, comma separated.
+func missingLabelKeyNames(keys []kep3633.MissingLabelKey) string {
+	names := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if !seen[k.Key] {
+			seen[k.Key] = true
+			names = append(names, k.Key)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
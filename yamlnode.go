@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlDocument is a YAML document kept as nodes, so that it can be rewritten preserving comments and field order.
+type yamlDocument struct {
+	// Source is the file name the document is read from, or "-" for stdin.
+	Source string
+	// Index is the index of the document in Source.
+	Index int
+	Node  *yaml.Node
+}
+
+// Root returns the top level node of d.
+func (d *yamlDocument) Root() *yaml.Node {
+	if d.Node.Kind == yaml.DocumentNode && len(d.Node.Content) > 0 {
+		return d.Node.Content[0]
+	}
+	return d.Node
+}
+
+func (d *yamlDocument) Kind() string {
+	return scalarValue(mappingValue(d.Root(), "kind"))
+}
+
+func (d *yamlDocument) Name() string {
+	return scalarValue(mappingLookup(d.Root(), "metadata", "name"))
+}
+
+// String identifies d in messages, the same as manifest.
+func (d *yamlDocument) String() string {
+	return fmt.Sprintf("%s#%d %s/%s", d.Source, d.Index, d.Kind(), d.Name())
+}
+
+// podTemplate returns the mapping node of the pod template of d, or nil if d does not have one.
+func (d *yamlDocument) podTemplate() *yaml.Node {
+	path, ok := podTemplatePaths[d.Kind()]
+	if !ok {
+		return nil
+	}
+	template := mappingLookup(d.Root(), path...)
+	if template == nil || template.Kind != yaml.MappingNode {
+		return nil
+	}
+	return template
+}
+
+// decodeYAMLDocuments reads all documents in r as nodes.
+func decodeYAMLDocuments(source string, r io.Reader) ([]*yamlDocument, error) {
+	decoder := yaml.NewDecoder(r)
+	docs := make([]*yamlDocument, 0)
+	for index := 0; ; index++ {
+		node := &yaml.Node{}
+		err := decoder.Decode(node)
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s#%d: failed to parse document: %w", source, index, err)
+		}
+		docs = append(docs, &yamlDocument{Source: source, Index: index, Node: node})
+	}
+}
+
+// encodeYAMLDocuments writes docs as multi-document YAML.
+func encodeYAMLDocuments(w io.Writer, docs []*yamlDocument) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	for _, d := range docs {
+		err := encoder.Encode(d.Node)
+		if err != nil {
+			return fmt.Errorf("%s: failed to write document: %w", d, err)
+		}
+	}
+	return encoder.Close()
+}
+
+// mappingValue returns the value of key in mapping node, or nil if not found.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return resolveAlias(node.Content[i+1])
+		}
+	}
+	return nil
+}
+
+// mappingLookup returns the value at path of nested mapping nodes, or nil if not found.
+func mappingLookup(node *yaml.Node, path ...string) *yaml.Node {
+	for _, key := range path {
+		node = mappingValue(node, key)
+	}
+	return node
+}
+
+// removeMappingKey removes key and its value from mapping node.
+func removeMappingKey(node *yaml.Node, key string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// setMappingValue sets value to key of mapping node, appending key if not found.
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// ensureMapping returns the mapping node at path of nested mapping nodes, creating missing ones.
+func ensureMapping(node *yaml.Node, path ...string) *yaml.Node {
+	for _, key := range path {
+		child := mappingValue(node, key)
+		if child == nil || child.Kind != yaml.MappingNode {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			setMappingValue(node, key, child)
+		}
+		node = child
+	}
+	return node
+}
+
+// pruneEmpty removes the value at path of nested mapping nodes when it is empty,
+// then its ancestors up to (but not including) node when they become empty.
+func pruneEmpty(node *yaml.Node, path ...string) {
+	for len(path) > 0 {
+		parent := mappingLookup(node, path[:len(path)-1]...)
+		value := mappingValue(parent, path[len(path)-1])
+		if parent == nil || value == nil || len(value.Content) > 0 || value.Kind == yaml.ScalarNode {
+			return
+		}
+		removeMappingKey(parent, path[len(path)-1])
+		path = path[:len(path)-1]
+	}
+}
+
+func scalarValue(node *yaml.Node) string {
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// nodeToJSON returns node as JSON, keeping the order of mapping keys.
+func nodeToJSON(node *yaml.Node) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := writeNodeJSON(buf, node)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeNodeJSON(buf *bytes.Buffer, node *yaml.Node) error {
+	node = resolveAlias(node)
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			buf.WriteString("null")
+			return nil
+		}
+		return writeNodeJSON(buf, node.Content[0])
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			keyBytes, err := json.Marshal(node.Content[i].Value)
+			if err != nil {
+				return err
+			}
+			buf.Write(keyBytes)
+			buf.WriteByte(':')
+			err = writeNodeJSON(buf, node.Content[i+1])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeNodeJSON(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	default:
+		var value interface{}
+		err := node.Decode(&value)
+		if err != nil {
+			return err
+		}
+		valueBytes, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		buf.Write(valueBytes)
+		return nil
+	}
+}
+
+// jsonPatchOperation is an operation of JSON patch created by kep3633.CreateJSONPatch.
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies add, replace and remove operations of patch to node in place,
+// so that the rest of the document keeps its comments and field order.
+// Missing mappings on the path of add operations are created, since pod templates may omit ones the Pod type has.
+func applyJSONPatch(node *yaml.Node, patch []byte) error {
+	operations := make([]jsonPatchOperation, 0)
+	err := json.Unmarshal(patch, &operations)
+	if err != nil {
+		return err
+	}
+	for _, op := range operations {
+		err = applyJSONPatchOperation(node, op)
+		if err != nil {
+			return fmt.Errorf("failed to %s %s: %w", op.Op, op.Path, err)
+		}
+	}
+	return nil
+}
+
+func applyJSONPatchOperation(node *yaml.Node, op jsonPatchOperation) error {
+	if op.Op != "add" && op.Op != "replace" && op.Op != "remove" {
+		return fmt.Errorf("unsupported operation")
+	}
+	tokens := strings.Split(strings.TrimPrefix(op.Path, "/"), "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	parent := node
+	for _, token := range tokens[:len(tokens)-1] {
+		var child *yaml.Node
+		switch parent.Kind {
+		case yaml.MappingNode:
+			child = mappingValue(parent, token)
+			if child == nil && op.Op == "add" {
+				child = ensureMapping(parent, token)
+			}
+		case yaml.SequenceNode:
+			index, err := strconv.Atoi(token)
+			if err == nil && index >= 0 && index < len(parent.Content) {
+				child = resolveAlias(parent.Content[index])
+			}
+		}
+		if child == nil {
+			return fmt.Errorf("%q not found", token)
+		}
+		parent = child
+	}
+
+	var value *yaml.Node
+	if op.Op != "remove" {
+		var err error
+		value, err = jsonToNode(op.Value)
+		if err != nil {
+			return err
+		}
+	}
+	last := tokens[len(tokens)-1]
+	switch parent.Kind {
+	case yaml.MappingNode:
+		if op.Op == "remove" {
+			removeMappingKey(parent, last)
+		} else {
+			setMappingValue(parent, last, value)
+		}
+		return nil
+	case yaml.SequenceNode:
+		index := len(parent.Content)
+		if last != "-" {
+			var err error
+			index, err = strconv.Atoi(last)
+			if err != nil || index < 0 || index > len(parent.Content) || (op.Op != "add" && index == len(parent.Content)) {
+				return fmt.Errorf("invalid index %q", last)
+			}
+		}
+		switch op.Op {
+		case "add":
+			parent.Content = append(parent.Content[:index], append([]*yaml.Node{value}, parent.Content[index:]...)...)
+		case "replace":
+			parent.Content[index] = value
+		default:
+			parent.Content = append(parent.Content[:index], parent.Content[index+1:]...)
+		}
+		return nil
+	default:
+		return fmt.Errorf("parent is not a mapping or list")
+	}
+}
+
+// jsonToNode returns v marshaled with its json tags as a block style node.
+func jsonToNode(v interface{}) (*yaml.Node, error) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	node := &yaml.Node{}
+	err = yaml.Unmarshal(jsonBytes, node)
+	if err != nil {
+		return nil, err
+	}
+	resetNodeStyle(node)
+	return node.Content[0], nil
+}
+
+// resetNodeStyle clears the flow and quoting styles of JSON, so that node is written the same as hand-written YAML.
+func resetNodeStyle(node *yaml.Node) {
+	node.Style = 0
+	node.Line = 0
+	node.Column = 0
+	for _, child := range node.Content {
+		resetNodeStyle(child)
+	}
+}